@@ -14,24 +14,47 @@ import (
 )
 
 type CloudWatchQuerier struct {
-	client *cloudwatch.Client
+	client    *cloudwatch.Client
+	maxPoints int // maximum number of points a query may return, zero for no limit
 }
 
 var _ Querier = (*CloudWatchQuerier)(nil)
 
-func NewCloudWatchQuerier(ctx context.Context, region string, accessKeyID string, secretAccessKey string) (*CloudWatchQuerier, error) {
-	credProv := credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, "")
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithRegion(region),
-		config.WithCredentialsProvider(credProv),
-	)
+// NewCloudWatchQuerier creates a querier authenticated according to the auth type, see loadAWSConfig.
+func NewCloudWatchQuerier(ctx context.Context, authType AuthType, ps ProviderSecrets, region string, maxPoints int) (*CloudWatchQuerier, error) {
+	cfg, err := loadAWSConfig(ctx, authType, ps, region)
 	if err != nil {
 		return nil, err
 	}
 
 	client := cloudwatch.NewFromConfig(cfg)
 
-	return &CloudWatchQuerier{client: client}, nil
+	return &CloudWatchQuerier{client: client, maxPoints: maxPoints}, nil
+}
+
+// loadAWSConfig loads the aws configuration for the auth type. AuthTypeAWSAccessKey uses static access keys
+// and region from the secrets. AuthTypeAWSProfile loads credentials and region from a named profile in the
+// shared aws config files. A non-empty region overrides the region from the secrets or profile, allowing a
+// single provider to serve sources in many regions.
+func loadAWSConfig(ctx context.Context, authType AuthType, ps ProviderSecrets, region string) (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+	switch authType {
+	case AuthTypeAWSAccessKey:
+		credProv := credentials.NewStaticCredentialsProvider(ps[SecretTypeAccessKeyID], ps[SecretTypeSecretAccessKey], "")
+		opts = append(opts,
+			config.WithRegion(ps[SecretTypeRegion]),
+			config.WithCredentialsProvider(credProv),
+		)
+	case AuthTypeAWSProfile:
+		opts = append(opts, config.WithSharedConfigProfile(ps[SecretTypeProfile]))
+	default:
+		return aws.Config{}, fmt.Errorf("unsupported auth type for cloudwatch: %q", authType)
+	}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	return config.LoadDefaultConfig(ctx, opts...)
 }
 
 type CloudWatchQuery struct {
@@ -39,7 +62,7 @@ type CloudWatchQuery struct {
 	Stat string
 }
 
-func (c *CloudWatchQuerier) Execute(ctx context.Context, queryJSON string, fromTime, toTime time.Time, interval QueryInterval) ([]DataPoint, error) {
+func (c *CloudWatchQuerier) Execute(ctx context.Context, queryJSON string, fromTime, toTime time.Time, interval QueryInterval, factor int) ([]DataPoint, error) {
 	query := &CloudWatchQuery{}
 	if err := json.Unmarshal([]byte(queryJSON), query); err != nil {
 		return nil, err
@@ -54,6 +77,12 @@ func (c *CloudWatchQuerier) Execute(ctx context.Context, queryJSON string, fromT
 	case QueryIntervalWeekly:
 		period = 604800
 	}
+	period *= int32(factor)
+	if interval == QueryIntervalMonthly {
+		// months vary in length so the whole range is requested as a single period, which cloudwatch
+		// requires to be a multiple of a minute
+		period = int32((toTime.Sub(fromTime) + time.Minute - 1) / time.Minute * 60)
+	}
 
 	metricDataQuery := types.MetricDataQuery{
 		Id: aws.String("caracolrequest"),
@@ -71,16 +100,26 @@ func (c *CloudWatchQuerier) Execute(ctx context.Context, queryJSON string, fromT
 		StartTime:         aws.Time(fromTime),
 		EndTime:           aws.Time(toTime),
 	}
+	if c.maxPoints > 0 {
+		// one more than the limit so that exceeding it can be detected
+		params.MaxDatapoints = aws.Int32(int32(c.maxPoints) + 1)
+	}
 	output, err := c.client.GetMetricData(ctx, params)
 	if err != nil {
 		return nil, err
 	}
+	if body, err := json.Marshal(output.MetricDataResults); err == nil {
+		recordResponse(ctx, body)
+	}
 
 	if len(output.MetricDataResults) != 1 {
 		return nil, fmt.Errorf("expected 1 result, got %d", len(output.MetricDataResults))
 	}
 
 	result := output.MetricDataResults[0]
+	if c.maxPoints > 0 && len(result.Values) > c.maxPoints {
+		return nil, fmt.Errorf("query returns more than the limit of %d points", c.maxPoints)
+	}
 
 	dataPoints := make([]DataPoint, len(result.Values))
 	for i, ts := range result.Timestamps {
@@ -104,3 +143,28 @@ func (c *CloudWatchQuerier) Execute(ctx context.Context, queryJSON string, fromT
 
 	return dataPoints, nil
 }
+
+// ListCloudWatchMetrics returns the metrics visible to the credentials of the auth type in the region, see
+// loadAWSConfig, optionally restricted to a single namespace.
+func ListCloudWatchMetrics(ctx context.Context, authType AuthType, ps ProviderSecrets, region string, namespace string) ([]types.Metric, error) {
+	cfg, err := loadAWSConfig(ctx, authType, ps, region)
+	if err != nil {
+		return nil, err
+	}
+
+	in := &cloudwatch.ListMetricsInput{}
+	if namespace != "" {
+		in.Namespace = aws.String(namespace)
+	}
+
+	var metrics []types.Metric
+	p := cloudwatch.NewListMetricsPaginator(cloudwatch.NewFromConfig(cfg), in)
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list metrics: %w", err)
+		}
+		metrics = append(metrics, out.Metrics...)
+	}
+	return metrics, nil
+}
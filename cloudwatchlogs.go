@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	logsInsightsPollInterval = time.Second
+	logsInsightsTimeout      = 2 * time.Minute // maximum time to wait for a query to complete
+)
+
+// A CloudWatchLogsQuerier executes CloudWatch Logs Insights queries. Logs Insights queries are asynchronous so
+// the querier starts the query and polls for its results until it completes, is abandoned or times out. The
+// query is a JSON CloudWatchLogsQueryJSON naming the log groups, the Logs Insights query and the field of the
+// first result row that holds the value, for example:
+//
+//	{
+//	  "LogGroupNames": ["/aws/lambda/bootstrapper"],
+//	  "QueryString": "filter @message like /connected/ | stats count(*) as connections",
+//	  "Field": "connections"
+//	}
+//
+// Requests are made to the Logs api directly, signed with the credentials loaded by loadAWSConfig.
+type CloudWatchLogsQuerier struct {
+	cfg  aws.Config
+	api  string
+	opts HTTPOptions
+}
+
+var _ Querier = (*CloudWatchLogsQuerier)(nil)
+
+func NewCloudWatchLogsQuerier(ctx context.Context, authType AuthType, ps ProviderSecrets, region string, opts HTTPOptions) (*CloudWatchLogsQuerier, error) {
+	cfg, err := loadAWSConfig(ctx, authType, ps, region)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("region must be supplied")
+	}
+
+	return &CloudWatchLogsQuerier{
+		cfg:  cfg,
+		api:  fmt.Sprintf("https://logs.%s.amazonaws.com/", cfg.Region),
+		opts: opts,
+	}, nil
+}
+
+type CloudWatchLogsQueryJSON struct {
+	LogGroupNames []string
+	QueryString   string
+	Field         string // name of the field in the first result row that holds the value
+}
+
+type cloudWatchLogsStartQueryJSON struct {
+	LogGroupNames []string `json:"logGroupNames"`
+	QueryString   string   `json:"queryString"`
+	StartTime     int64    `json:"startTime"` // seconds since epoch
+	EndTime       int64    `json:"endTime"`   // seconds since epoch
+}
+
+type cloudWatchLogsQueryIDJSON struct {
+	QueryID string `json:"queryId"`
+}
+
+type cloudWatchLogsQueryResultsJSON struct {
+	Status  string                            `json:"status"`
+	Results [][]cloudWatchLogsResultFieldJSON `json:"results"`
+}
+
+type cloudWatchLogsResultFieldJSON struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+func (c *CloudWatchLogsQuerier) Execute(ctx context.Context, queryJSON string, fromTime, toTime time.Time, interval QueryInterval, factor int) ([]DataPoint, error) {
+	var query CloudWatchLogsQueryJSON
+	if err := json.Unmarshal([]byte(queryJSON), &query); err != nil {
+		return nil, err
+	}
+	if len(query.LogGroupNames) == 0 {
+		return nil, fmt.Errorf("query must specify at least one log group")
+	}
+	if query.Field == "" {
+		return nil, fmt.Errorf("query must specify the field that holds the value")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, logsInsightsTimeout)
+	defer cancel()
+
+	slog.Debug("starting logs insights query", "log_groups", query.LogGroupNames, "query", query.QueryString, "from", fromTime, "to", toTime)
+
+	var started cloudWatchLogsQueryIDJSON
+	err := c.call(ctx, "StartQuery", cloudWatchLogsStartQueryJSON{
+		LogGroupNames: query.LogGroupNames,
+		QueryString:   query.QueryString,
+		StartTime:     fromTime.Unix(),
+		EndTime:       toTime.Unix() - 1, // the end time is inclusive
+	}, &started)
+	if err != nil {
+		return nil, fmt.Errorf("start query: %w", err)
+	}
+
+	var results cloudWatchLogsQueryResultsJSON
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				// stop the query so it does not continue to consume the account's concurrency limit
+				stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Second)
+				if err := c.call(stopCtx, "StopQuery", started, nil); err != nil {
+					slog.Debug("failed to stop logs insights query", "query_id", started.QueryID, "error", err)
+				}
+				stopCancel()
+				return nil, fmt.Errorf("query %s did not complete within %s", started.QueryID, logsInsightsTimeout)
+			}
+			return nil, ctx.Err()
+		case <-time.After(logsInsightsPollInterval):
+		}
+
+		if err := c.call(ctx, "GetQueryResults", started, &results); err != nil {
+			return nil, fmt.Errorf("get query results: %w", err)
+		}
+
+		slog.Debug("polled logs insights query", "query_id", started.QueryID, "status", results.Status)
+		switch results.Status {
+		case "Scheduled", "Running":
+			continue
+		case "Complete":
+		default:
+			return nil, fmt.Errorf("query %s ended with status %s", started.QueryID, results.Status)
+		}
+		break
+	}
+
+	if len(results.Results) == 0 {
+		// no log events matched within the time range
+		return []DataPoint{}, nil
+	}
+
+	for _, f := range results.Results[0] {
+		if f.Field != query.Field {
+			continue
+		}
+		v, err := strconv.ParseFloat(f.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for field %q: %w", query.Field, err)
+		}
+		return []DataPoint{{Time: toTime, Value: v}}, nil
+	}
+
+	return nil, fmt.Errorf("field %q not found in query results", query.Field)
+}
+
+// call invokes an action of the CloudWatch Logs api, decoding the response into out if it is not nil.
+func (c *CloudWatchLogsQuerier) call(ctx context.Context, action string, in any, out any) error {
+	reqBody, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+	hash := sha256.Sum256(reqBody)
+	payloadHash := hex.EncodeToString(hash[:])
+
+	creds, err := c.cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("retrieve credentials: %w", err)
+	}
+
+	signer := v4.NewSigner()
+	resp, err := sendRequest(ctx, c.opts, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", c.api, bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+		req.Header.Set("X-Amz-Target", "Logs_20140328."+action)
+		if err := signer.SignHTTP(ctx, creds, req, payloadHash, "logs", c.cfg.Region, time.Now()); err != nil {
+			return nil, err
+		}
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read body request: %w", err)
+	}
+	slog.Debug("received response", "action", action, "body", string(body))
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp, body)
+	}
+	if action == "GetQueryResults" {
+		recordResponse(ctx, body)
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
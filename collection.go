@@ -1,13 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/exp/slog"
 )
@@ -20,7 +30,24 @@ var collectionCommand = &cli.Command{
 			Name:   "list",
 			Usage:  "List known collections.",
 			Action: CollectionList,
-			Flags:  union([]cli.Flag{}, dbFlags, loggingFlags, hlogDefaultTrue),
+			Flags: union([]cli.Flag{
+				&cli.StringFlag{
+					Name:  "group",
+					Usage: "Only list collections for queries in this group.",
+				},
+				&cli.StringFlag{
+					Name:  "name",
+					Usage: "Only list collections for queries whose name contains this text.",
+				},
+				&cli.BoolFlag{
+					Name:  "with-gaps-only",
+					Usage: "Only list collections that have missing sequences.",
+				},
+				&cli.BoolFlag{
+					Name:  "include-empty",
+					Usage: "Also count sequences for which the provider has repeatedly returned no data and that are treated as permanently empty.",
+				},
+			}, dbFlags, loggingFlags, hlogDefaultTrue),
 		},
 		{
 			Name:   "gaps",
@@ -32,19 +59,84 @@ var collectionCommand = &cli.Command{
 					Required: true,
 					Usage:    "ID of query.",
 				},
-			}, dbFlags, loggingFlags),
+				&cli.BoolFlag{
+					Name:  "include-empty",
+					Usage: "Also list sequences for which the provider has repeatedly returned no data and that are treated as permanently empty.",
+				},
+			}, seqWindowFlags, dbFlags, loggingFlags),
 		},
 		{
-			Name:   "fill",
-			Usage:  "Fill missing sequences in a collection.",
+			Name:  "fill",
+			Usage: "Fill missing sequences in a collection.",
+			Description: "Exits with status 0 when every gap was filled or found to be empty, 2 when the fill completed but some\n" +
+				"sequences or, with --provider-id, some of the collections could not be filled and 1 when the fill was aborted\n" +
+				"or every collection failed.",
 			Action: CollectionFill,
 			Flags: union([]cli.Flag{
 				&cli.IntFlag{
 					Name:     "id",
-					Required: true,
+					Required: false,
 					Usage:    "ID of query.",
 				},
-			}, dbFlags, loggingFlags),
+				&cli.IntFlag{
+					Name:     "provider-id",
+					Required: false,
+					Usage:    "Fill the collections of every active query of this provider in turn instead of a single query.",
+				},
+				&cli.BoolFlag{
+					Name:     "newest-first",
+					Required: false,
+					Usage:    "Fill the most recent missing sequences first.",
+				},
+				&cli.BoolFlag{
+					Name:     "store-raw",
+					Required: false,
+					Usage:    "Store the raw response received from the provider for each sequence filled.",
+				},
+				&cli.StringFlag{
+					Name:     "collection-log",
+					Required: false,
+					Usage:    "Append a JSON line recording every collected value written to `FILE`.",
+				},
+				&cli.IntFlag{
+					Name:     "max-empty-attempts",
+					Required: false,
+					Value:    defaultMaxEmptyAttempts,
+					Usage:    "Number of times the provider may return no data for a sequence before it is treated as permanently empty.",
+				},
+				&cli.BoolFlag{
+					Name:     "retry-empty",
+					Required: false,
+					Usage:    "Also fill sequences that have been treated as permanently empty.",
+				},
+				&cli.IntFlag{
+					Name:     "batch",
+					Required: false,
+					Value:    1,
+					Usage:    "Number of collected points to write in each transaction. If a batch fails its sequences are written individually.",
+				},
+				&cli.BoolFlag{
+					Name:     "until-caught-up",
+					Required: false,
+					Usage:    "Search for gaps again after filling, repeating until none remain so that intervals which close during the fill are also collected.",
+				},
+				&cli.IntFlag{
+					Name:     "max-passes",
+					Required: false,
+					Value:    10,
+					Usage:    "Maximum number of passes made with --until-caught-up, zero for no limit.",
+				},
+				&cli.DurationFlag{
+					Name:     "deadline",
+					Required: false,
+					Usage:    "Stop starting new passes with --until-caught-up after this long, zero for no limit.",
+				},
+				&cli.BoolFlag{
+					Name:     "dry-run",
+					Required: false,
+					Usage:    "List the sequences that would be filled and the time range of each without querying the provider or writing anything.",
+				},
+			}, seqWindowFlags, httpFlags, dbFlags, loggingFlags),
 		},
 		{
 			Name:   "collect",
@@ -64,7 +156,7 @@ var collectionCommand = &cli.Command{
 					Name:  "force",
 					Usage: "Force collected value to be written to sequence.",
 				},
-			}, dbFlags, loggingFlags),
+			}, httpFlags, dbFlags, loggingFlags),
 		},
 		{
 			Name:   "get",
@@ -86,8 +178,120 @@ var collectionCommand = &cli.Command{
 					Required: false,
 					Usage:    "Show values with sequence equal to or less than this number.",
 				},
+				&cli.StringFlag{
+					Name:     "series",
+					Required: false,
+					Usage:    "Label set of the series to show values for, for queries that collect multiple series.",
+				},
+				&cli.StringFlag{
+					Name:     "aggregate",
+					Required: false,
+					Usage:    "Summarise the values in each bucket using this function, one of avg, sum, min, max or count. Requires --bucket.",
+				},
+				&cli.StringFlag{
+					Name:     "bucket",
+					Required: false,
+					Usage:    "Interval of the buckets values are summarised over, one of hourly, daily or weekly, aligned to the start of the query.",
+				},
+			}, seqWindowFlags, dbFlags, loggingFlags),
+		},
+		{
+			Name:   "verify",
+			Usage:  "Verify collected values against fresh values from the provider.",
+			Action: CollectionVerify,
+			Flags: union([]cli.Flag{
+				&cli.IntFlag{
+					Name:     "id",
+					Required: true,
+					Usage:    "ID of query.",
+				},
+				&cli.IntFlag{
+					Name:     "from",
+					Required: false,
+					Usage:    "Verify values with sequence equal to or greater than this number.",
+				},
+				&cli.IntFlag{
+					Name:     "to",
+					Required: false,
+					Usage:    "Verify values with sequence equal to or less than this number.",
+				},
+				&cli.StringFlag{
+					Name:     "series",
+					Required: false,
+					Usage:    "Label set of the series to verify, for queries that collect multiple series.",
+				},
+				&cli.Float64Flag{
+					Name:     "tolerance",
+					Required: false,
+					Usage:    "Maximum absolute difference between stored and fresh values that is not reported as a mismatch.",
+				},
+				&cli.BoolFlag{
+					Name:     "fix",
+					Required: false,
+					Usage:    "Overwrite mismatched and missing values with the fresh value.",
+				},
+			}, httpFlags, dbFlags, loggingFlags),
+		},
+		{
+			Name:   "promote",
+			Usage:  "Promote values held in staging into a collection.",
+			Action: CollectionPromote,
+			Flags: union([]cli.Flag{
+				&cli.IntFlag{
+					Name:     "id",
+					Required: true,
+					Usage:    "ID of query.",
+				},
+				&cli.IntFlag{
+					Name:     "from",
+					Required: false,
+					Usage:    "Promote values with sequence equal to or greater than this number.",
+				},
+				&cli.IntFlag{
+					Name:     "to",
+					Required: false,
+					Usage:    "Promote values with sequence equal to or less than this number.",
+				},
 			}, dbFlags, loggingFlags),
 		},
+		{
+			Name:   "export",
+			Usage:  "Export the values collected for a query.",
+			Action: CollectionExport,
+			Flags: union([]cli.Flag{
+				&cli.IntFlag{
+					Name:     "id",
+					Required: true,
+					Usage:    "ID of query.",
+				},
+				&cli.IntFlag{
+					Name:     "from",
+					Required: false,
+					Usage:    "Export values with sequence equal to or greater than this number.",
+				},
+				&cli.IntFlag{
+					Name:     "to",
+					Required: false,
+					Usage:    "Export values with sequence equal to or less than this number.",
+				},
+				&cli.StringFlag{
+					Name:     "series",
+					Required: false,
+					Usage:    "Label set of the series to export values for, for queries that collect multiple series. Ignored by the influx format, which exports every series.",
+				},
+				&cli.StringFlag{
+					Name:     "format",
+					Required: false,
+					Value:    "influx",
+					Usage:    "Format of the exported values: influx, for InfluxDB line protocol, csv or json. The csv and json formats include every sequence, leaving the value empty or null when it is missing.",
+				},
+				&cli.StringFlag{
+					Name:     "out",
+					Required: false,
+					Usage:    "Write the exported values to this file instead of stdout.",
+				},
+			}, seqWindowFlags, dbFlags, loggingFlags),
+		},
 		{
 			Name:   "set",
 			Usage:  "Set a sequence value in a collection.",
@@ -108,11 +312,117 @@ var collectionCommand = &cli.Command{
 					Required: true,
 					Usage:    "Value to set.",
 				},
+				&cli.StringFlag{
+					Name:     "series",
+					Required: false,
+					Usage:    "Label set of the series to set the value for, for queries that collect multiple series.",
+				},
 			}, dbFlags, loggingFlags),
 		},
+		{
+			Name:  "rollup",
+			Usage: "Commands for daily rollups of collections.",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "get",
+					Usage:  "Get the daily rollups of a collection.",
+					Action: CollectionRollupGet,
+					Flags: union([]cli.Flag{
+						&cli.IntFlag{
+							Name:     "id",
+							Required: true,
+							Usage:    "ID of query.",
+						},
+						&cli.StringFlag{
+							Name:     "from",
+							Required: false,
+							Usage:    "Show rollups for days on or after this date, in the form 2006-01-02.",
+						},
+						&cli.StringFlag{
+							Name:     "to",
+							Required: false,
+							Usage:    "Show rollups for days on or before this date, in the form 2006-01-02.",
+						},
+						&cli.StringFlag{
+							Name:     "series",
+							Required: false,
+							Usage:    "Label set of the series to show rollups for, for queries that collect multiple series.",
+						},
+					}, dbFlags, loggingFlags),
+				},
+			},
+		},
+	},
+}
+
+// seqWindowFlags scope a collection command to the sequences whose intervals fall within a window of time.
+var seqWindowFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "since",
+		Usage: "Only include sequences whose interval ends after this time. Either a time formatted as '2006-01-02T15:04:05Z', a unix timestamp or a duration before now such as 36h or 7d. Takes precedence over --from.",
+	},
+	&cli.StringFlag{
+		Name:  "until",
+		Usage: "Only include sequences whose interval ends at or before this time, in the same forms as --since. Takes precedence over --to.",
 	},
 }
 
+// seqWindow resolves the --since and --until flags to a range of sequences of the query, overriding from and to
+// when they are set. A nil bound is left open.
+func seqWindow(cc *cli.Context, q *Query, from, to *int) (*int, *int, error) {
+	now := time.Now().UTC()
+	if cc.IsSet("since") {
+		t, err := parseWindowTime(strings.TrimSpace(cc.String("since")), now)
+		if err != nil {
+			return nil, nil, fmt.Errorf("since: %w", err)
+		}
+		seq := 1
+		if t.After(q.Start) {
+			seq = q.SeqAfter(t)
+		}
+		from = &seq
+	}
+	if cc.IsSet("until") {
+		t, err := parseWindowTime(strings.TrimSpace(cc.String("until")), now)
+		if err != nil {
+			return nil, nil, fmt.Errorf("until: %w", err)
+		}
+		seq := 0
+		if t.After(q.Start) {
+			seq = q.SeqAfter(t) - 1
+		}
+		to = &seq
+	}
+	if from != nil && to != nil && *from > *to {
+		return nil, nil, fmt.Errorf("window contains no sequences")
+	}
+	return from, to, nil
+}
+
+// parseWindowTime parses a time accepted by parseTime or a duration before now, which may use a d suffix for days.
+func parseWindowTime(s string, now time.Time) (time.Time, error) {
+	if t, err := parseTime(s); err == nil {
+		return t, nil
+	}
+	d, err := parseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must be a time formatted as '2006-01-02T15:04:05Z', a unix timestamp or a duration such as 36h or 7d")
+	}
+	return now.Add(-d), nil
+}
+
+// filterSeqs returns the sequences that fall within the range from and to, either of which may be nil.
+func filterSeqs(seqs []int, from, to *int) []int {
+	var filtered []int
+	for _, seq := range seqs {
+		if (from != nil && seq < *from) || (to != nil && seq > *to) {
+			continue
+		}
+		filtered = append(filtered, seq)
+	}
+	return filtered
+}
+
 func CollectionList(cc *cli.Context) error {
 	ctx := cc.Context
 	setupLogging()
@@ -123,7 +433,23 @@ func CollectionList(cc *cli.Context) error {
 		return fmt.Errorf("connect: %w", err)
 	}
 
-	rows, err := conn.Query(ctx, "select q.id, q.name, max(c.seq) from queries q left join collections c on q.id=c.query_id group by q.id, q.name order by q.id, q.name")
+	var args []any
+	var conds []string
+	sql := "select q.id, q.name, q.group_name, max(c.seq) from queries q left join collections c on q.id=c.query_id"
+	if cc.IsSet("group") {
+		args = append(args, strings.TrimSpace(cc.String("group")))
+		conds = append(conds, fmt.Sprintf("q.group_name=$%d", len(args)))
+	}
+	if cc.IsSet("name") {
+		args = append(args, "%"+strings.TrimSpace(cc.String("name"))+"%")
+		conds = append(conds, fmt.Sprintf("q.name ilike $%d", len(args)))
+	}
+	if len(conds) > 0 {
+		sql += " where " + strings.Join(conds, " and ")
+	}
+	sql += " group by q.id, q.name, q.group_name order by q.group_name, q.id, q.name"
+
+	rows, err := conn.Query(ctx, sql, args...)
 	if err != nil {
 		return fmt.Errorf("query: %w", err)
 	}
@@ -131,6 +457,7 @@ func CollectionList(cc *cli.Context) error {
 	type CollectionInfoRow struct {
 		QueryID int
 		Name    string
+		Group   string
 		Seq     *int
 	}
 
@@ -139,23 +466,47 @@ func CollectionList(cc *cli.Context) error {
 		return fmt.Errorf("collect: %w", err)
 	}
 
+	gaps, err := CountCollectionGaps(ctx, db, gapMaxEmptyAttempts(cc))
+	if err != nil {
+		return fmt.Errorf("count collection gaps: %w", err)
+	}
+
+	if cc.Bool("with-gaps-only") {
+		filtered := cis[:0]
+		for _, ci := range cis {
+			if gaps[ci.QueryID] > 0 {
+				filtered = append(filtered, ci)
+			}
+		}
+		cis = filtered
+	}
+
 	if len(cis) == 0 {
 		fmt.Println("No collections found")
 		return nil
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
-	fmt.Fprintln(w, "Query ID\t| Name\t| Last Seq")
+	fmt.Fprintln(w, "Query ID\t| Name\t| Group\t| Last Seq\t| Gaps")
 	for _, ci := range cis {
 		seq := "--"
 		if ci.Seq != nil {
 			seq = strconv.Itoa(*ci.Seq)
 		}
-		fmt.Fprintf(w, "%d\t| %s\t| %s\n", ci.QueryID, ci.Name, seq)
+		fmt.Fprintf(w, "%d\t| %s\t| %s\t| %s\t| %d\n", ci.QueryID, ci.Name, ci.Group, seq, gaps[ci.QueryID])
 	}
 	return w.Flush()
 }
 
+// gapMaxEmptyAttempts returns the number of empty attempts after which a sequence is not reported as a gap,
+// matching the default used when filling gaps unless --include-empty is set.
+func gapMaxEmptyAttempts(cc *cli.Context) int {
+	if cc.Bool("include-empty") {
+		return 0
+	}
+	return defaultMaxEmptyAttempts
+}
+
 func CollectionGaps(cc *cli.Context) error {
 	ctx := cc.Context
 	setupLogging()
@@ -168,18 +519,24 @@ func CollectionGaps(cc *cli.Context) error {
 
 	db := NewDB(dbConnStr())
 
-	seqs, err := FindCollectionGaps(ctx, db, queryID)
+	q, err := GetQuery(ctx, db, queryID)
 	if err != nil {
-		return fmt.Errorf("find collection gaps: %w", err)
+		return fmt.Errorf("get query: %w", err)
 	}
-	if len(seqs) == 0 {
-		fmt.Println("No gaps found")
-		return nil
+
+	fromSeq, toSeq, err := seqWindow(cc, q, nil, nil)
+	if err != nil {
+		return err
 	}
 
-	q, err := GetQuery(ctx, db, queryID)
+	seqs, err := FindCollectionGaps(ctx, db, queryID, gapMaxEmptyAttempts(cc))
 	if err != nil {
-		return fmt.Errorf("get query: %w", err)
+		return fmt.Errorf("find collection gaps: %w", err)
+	}
+	seqs = filterSeqs(seqs, fromSeq, toSeq)
+	if len(seqs) == 0 {
+		printStatus("No gaps found")
+		return nil
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
@@ -194,106 +551,444 @@ func CollectionFill(cc *cli.Context) error {
 	ctx := cc.Context
 	setupLogging()
 
-	queryID := cc.Int("id")
+	if cc.IsSet("id") == cc.IsSet("provider-id") {
+		return fmt.Errorf("exactly one of id or provider-id must be supplied")
+	}
 
+	queryID := cc.Int("id")
 	if queryID < 0 {
 		return fmt.Errorf("ID must be a positive integer")
 	}
 
+	providerID := cc.Int("provider-id")
+	if providerID < 0 {
+		return fmt.Errorf("provider ID must be a positive integer")
+	}
+
 	db := NewDB(dbConnStr())
 
-	seqs, err := FindCollectionGaps(ctx, db, queryID)
-	if err != nil {
-		return fmt.Errorf("find collection gaps: %w", err)
+	if cc.Bool("dry-run") {
+		return collectionFillDryRun(cc, db, queryID, providerID)
 	}
 
-	if len(seqs) == 0 {
-		fmt.Println("No gaps found")
-		return nil
+	var clog *CollectionLog
+	if path := strings.TrimSpace(cc.String("collection-log")); path != "" {
+		var err error
+		clog, err = OpenCollectionLog(path)
+		if err != nil {
+			return err
+		}
+		defer clog.Close()
 	}
 
-	conn, err := db.NewConn(ctx)
-	if err != nil {
-		return fmt.Errorf("connect: %w", err)
+	if cc.IsSet("id") {
+		qry, err := GetQuery(ctx, db, queryID)
+		if err != nil {
+			return fmt.Errorf("get query: %w", err)
+		}
+
+		ss := new(SecretStore)
+		secrets, err := ss.Secrets(qry.ProviderID, qry.AuthType)
+		if err != nil {
+			return fmt.Errorf("failed to get secrets for provider: %w", err)
+		}
+
+		res, err := fillQueryPasses(cc, db, qry, secrets, clog)
+		if err != nil {
+			return err
+		}
+		if res.Gaps == 0 {
+			printStatus("No gaps found")
+		}
+		if res.Failed > 0 {
+			return &PartialFailureError{Err: fmt.Errorf("failed to collect %d of %d sequences", res.Failed, res.Gaps)}
+		}
+		return nil
 	}
 
-	qry, err := GetQuery(ctx, db, queryID)
+	qs, err := FetchActiveProviderQueries(ctx, db, providerID)
 	if err != nil {
-		return fmt.Errorf("get query: %w", err)
+		return fmt.Errorf("fetch provider queries: %w", err)
+	}
+	if len(qs) == 0 {
+		printStatus("No active queries found")
+		return nil
 	}
 
 	ss := new(SecretStore)
-	secrets, err := ss.Secrets(qry.ProviderID, qry.AuthType)
+	secrets, err := ss.Secrets(providerID, qs[0].AuthType)
 	if err != nil {
 		return fmt.Errorf("failed to get secrets for provider: %w", err)
 	}
 
-	for _, seq := range seqs {
-		slog.Info("filling gap", "query_id", queryID, "seq", seq)
-
-		points, err := DispatchQuery(ctx, qry, seq, secrets)
-		if err != nil {
-			return fmt.Errorf("failed to execute query: %w", err)
+	// fill every query even if some fail, so that one bad query does not block recovery of the rest
+	results := make([]fillResult, len(qs))
+	errs := make([]error, len(qs))
+	failed, failedSeqs := 0, 0
+	for i, qry := range qs {
+		slog.Info("filling collection", "query_id", qry.ID, "name", qry.Name)
+		results[i], errs[i] = fillQueryPasses(cc, db, qry, secrets, clog)
+		if errs[i] != nil {
+			slog.Error("failed to fill collection", "query_id", qry.ID, "error", errs[i])
+			failed++
 		}
+		failedSeqs += results[i].Failed
+	}
 
-		if len(points) == 0 {
-			return fmt.Errorf("no points found")
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
+	fmt.Fprintln(w, "Query ID\t| Name\t| Gaps\t| Filled\t| Empty\t| Failed\t| Error")
+	for i, qry := range qs {
+		errStr := ""
+		if errs[i] != nil {
+			errStr = errs[i].Error()
 		}
+		fmt.Fprintf(w, "%d\t| %s\t| %d\t| %d\t| %d\t| %d\t| %s\n", qry.ID, qry.Name, results[i].Gaps, results[i].Filled, results[i].Empty, results[i].Failed, errStr)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
 
-		if len(points) > 1 {
-			return fmt.Errorf("too many points found: %d", len(points))
-		}
+	if failed == len(qs) {
+		return fmt.Errorf("failed to fill all %d collections", failed)
+	}
+	if failed > 0 {
+		// the other collections were filled, so the fill completed with errors rather than being aborted
+		return &PartialFailureError{Err: fmt.Errorf("failed to fill %d of %d collections", failed, len(qs))}
+	}
+	if failedSeqs > 0 {
+		return &PartialFailureError{Err: fmt.Errorf("failed to collect %d sequences", failedSeqs)}
+	}
+	return nil
+}
+
+// collectionFillDryRun lists the gaps that CollectionFill would fill for a query, or for every active query of
+// a provider, in the order they would be filled.
+func collectionFillDryRun(cc *cli.Context, db *DB, queryID, providerID int) error {
+	ctx := cc.Context
 
-		tx, err := conn.Begin(ctx)
+	var qs []*Query
+	if cc.IsSet("id") {
+		qry, err := GetQuery(ctx, db, queryID)
 		if err != nil {
-			return fmt.Errorf("begin transaction: %w", err)
+			return fmt.Errorf("get query: %w", err)
 		}
-		defer tx.Rollback(ctx)
-
-		slog.Info("inserting collected value", "query_id", queryID, "seq", points[0].Seq, "value", points[0].Value)
-		_, err = tx.Exec(ctx, "insert into collections(query_id,seq,value) values ($1,$2,$3)", queryID, points[0].Seq, points[0].Value)
+		qs = []*Query{qry}
+	} else {
+		var err error
+		qs, err = FetchActiveProviderQueries(ctx, db, providerID)
 		if err != nil {
-			return fmt.Errorf("exec (%T): %w", err, err)
+			return fmt.Errorf("fetch provider queries: %w", err)
 		}
+		if len(qs) == 0 {
+			printStatus("No active queries found")
+			return nil
+		}
+	}
 
-		err = tx.Commit(ctx)
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
+	fmt.Fprintln(w, "Query ID\t| Seq\t| From\t| To")
+	total := 0
+	for _, qry := range qs {
+		seqs, err := findFillGaps(cc, db, qry)
 		if err != nil {
-			return fmt.Errorf("commit: %w", err)
+			return fmt.Errorf("query %d: %w", qry.ID, err)
 		}
-
-		time.Sleep(time.Second)
+		if cc.Bool("newest-first") {
+			sort.Sort(sort.Reverse(sort.IntSlice(seqs)))
+		}
+		for _, seq := range seqs {
+			fmt.Fprintf(w, "%d\t| %d\t| %s\t| %s\n", qry.ID, seq, qry.SeqTime(seq-1).Format("2006-01-02T15:04:05Z"), qry.SeqTime(seq).Format("2006-01-02T15:04:05Z"))
+		}
+		total += len(seqs)
 	}
-
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	printStatus("Dry run: %d gaps would be filled", total)
 	return nil
 }
 
-func CollectionCollect(cc *cli.Context) error {
-	ctx := cc.Context
-	setupLogging()
+// fillResult summarises the gaps filled for a query.
+type fillResult struct {
+	Gaps   int // number of gaps found
+	Filled int // number of gaps filled
+	Empty  int // number of gaps for which the provider returned no data
+	Failed int // number of gaps that could not be collected because the query failed
+}
 
-	queryID := cc.Int("id")
-	seq := cc.Int("seq")
-	force := cc.Bool("force")
+// fillQueryPasses fills the gaps in the collection of a query. With --until-caught-up the gaps are searched for
+// again after each pass and filled until none remain, the provider stops returning data for them or the limits
+// on passes and time are reached.
+func fillQueryPasses(cc *cli.Context, db *DB, qry *Query, secrets ProviderSecrets, clog *CollectionLog) (fillResult, error) {
+	if !cc.Bool("until-caught-up") {
+		return fillQuery(cc, db, qry, secrets, clog)
+	}
 
-	if queryID < 0 {
-		return fmt.Errorf("ID must be a positive integer")
+	maxPasses := cc.Int("max-passes")
+	var deadline time.Time
+	if d := cc.Duration("deadline"); d > 0 {
+		deadline = time.Now().Add(d)
 	}
 
-	if seq <= 0 {
-		return fmt.Errorf("sequence must be greater than zero")
+	var total fillResult
+	for pass := 1; ; pass++ {
+		res, err := fillQuery(cc, db, qry, secrets, clog)
+		if pass == 1 {
+			total.Gaps = res.Gaps
+		}
+		total.Filled += res.Filled
+		total.Empty += res.Empty
+		total.Failed += res.Failed
+		if err != nil {
+			return total, err
+		}
+
+		if res.Gaps == 0 {
+			slog.Info("collection caught up", "query_id", qry.ID, "passes", pass)
+			return total, nil
+		}
+		if res.Filled == 0 {
+			// every remaining gap returned no data, so another pass straight away would make no progress
+			slog.Warn("collection not caught up, provider returned no data for remaining gaps", "query_id", qry.ID, "passes", pass, "gaps", res.Gaps)
+			return total, nil
+		}
+
+		if (maxPasses > 0 && pass >= maxPasses) || (!deadline.IsZero() && time.Now().After(deadline)) {
+			seqs, err := findFillGaps(cc, db, qry)
+			if err != nil {
+				return total, err
+			}
+			if len(seqs) == 0 {
+				slog.Info("collection caught up", "query_id", qry.ID, "passes", pass)
+				return total, nil
+			}
+			return total, &PartialFailureError{Err: fmt.Errorf("collection not caught up after %d passes, %d gaps remain", pass, len(seqs))}
+		}
+
+		slog.Info("searching for new gaps", "query_id", qry.ID, "pass", pass+1)
 	}
+}
 
-	db := NewDB(dbConnStr())
+// findFillGaps returns the gaps in the collection of a query to be filled, scoped by the flags of the fill command.
+func findFillGaps(cc *cli.Context, db *DB, qry *Query) ([]int, error) {
+	maxEmptyAttempts := cc.Int("max-empty-attempts")
+	if cc.Bool("retry-empty") {
+		maxEmptyAttempts = 0
+	}
 
-	qry, err := GetQuery(ctx, db, queryID)
+	fromSeq, toSeq, err := seqWindow(cc, qry, nil, nil)
 	if err != nil {
-		return fmt.Errorf("get query: %w", err)
+		return nil, err
 	}
 
-	ss := new(SecretStore)
-	secrets, err := ss.Secrets(qry.ProviderID, qry.AuthType)
+	seqs, err := FindCollectionGaps(cc.Context, db, qry.ID, maxEmptyAttempts)
 	if err != nil {
-		return fmt.Errorf("failed to get secrets for provider: %w", err)
+		return nil, fmt.Errorf("find collection gaps: %w", err)
+	}
+	return filterSeqs(seqs, fromSeq, toSeq), nil
+}
+
+// fillQuery fills the gaps in the collection of a query, scoped by the flags of the fill command.
+func fillQuery(cc *cli.Context, db *DB, qry *Query, secrets ProviderSecrets, clog *CollectionLog) (fillResult, error) {
+	ctx := cc.Context
+	var res fillResult
+
+	seqs, err := findFillGaps(cc, db, qry)
+	if err != nil {
+		return res, err
+	}
+
+	res.Gaps = len(seqs)
+	if len(seqs) == 0 {
+		return res, nil
+	}
+
+	if cc.Bool("newest-first") {
+		sort.Sort(sort.Reverse(sort.IntSlice(seqs)))
+	}
+
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return res, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	batchSize := cc.Int("batch")
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	// pending holds the points collected for each sequence that have not yet been committed
+	var pending [][]DataPoint
+	npending := 0
+
+	committed := func(points []DataPoint) {
+		res.Filled++
+		for _, pt := range points {
+			if clog == nil || !claimCollectionLog(ctx, db, slog.Default(), qry, pt) {
+				continue
+			}
+			if err := clog.Write(qry.ID, pt); err != nil {
+				slog.Error("failed to write to collection log", "query_id", qry.ID, "seq", pt.Seq, "error", err)
+			}
+		}
+	}
+
+	flush := func() error {
+		defer func() {
+			pending = pending[:0]
+			npending = 0
+		}()
+		if len(pending) == 0 {
+			return nil
+		}
+
+		var all []DataPoint
+		for _, points := range pending {
+			all = append(all, points...)
+		}
+		err := insertCollectionPoints(ctx, conn, qry, all)
+		if err == nil {
+			for _, points := range pending {
+				committed(points)
+			}
+			return nil
+		}
+		if len(pending) == 1 {
+			return err
+		}
+
+		// commit each sequence separately so that one bad point does not lose the whole batch
+		slog.Warn("failed to commit batch, committing sequences individually", "query_id", qry.ID, "sequences", len(pending), "error", err)
+		for _, points := range pending {
+			if err := insertCollectionPoints(ctx, conn, qry, points); err != nil {
+				return err
+			}
+			committed(points)
+		}
+		return nil
+	}
+
+	for _, seq := range seqs {
+		slog.Info("filling gap", "query_id", qry.ID, "seq", seq)
+
+		var points []DataPoint
+		if cc.Bool("store-raw") {
+			points, err = DispatchQueryStoringRaw(ctx, db, qry, seq, secrets)
+		} else {
+			points, err = DispatchQuery(ctx, qry, seq, secrets)
+		}
+		if err != nil {
+			if errors.Is(err, ErrCredentialsRejected) || ctx.Err() != nil {
+				// every other sequence would fail the same way
+				err = fmt.Errorf("failed to execute query: %w", err)
+				break
+			}
+			slog.Error("failed to execute query", "query_id", qry.ID, "seq", seq, "error", err)
+			res.Failed++
+			err = nil
+			continue
+		}
+
+		if len(points) == 0 {
+			var attempts int
+			attempts, err = RecordEmptyCollection(ctx, db, qry.ID, seq)
+			if err != nil {
+				err = fmt.Errorf("record empty collection: %w", err)
+				break
+			}
+			slog.Warn("no points found", "query_id", qry.ID, "seq", seq, "attempts", attempts)
+			res.Empty++
+			continue
+		}
+
+		points, err = ResolveMultipoint(qry, points)
+		if err != nil {
+			slog.Error("failed to resolve points", "query_id", qry.ID, "seq", seq, "error", err)
+			res.Failed++
+			err = nil
+			continue
+		}
+
+		pending = append(pending, points)
+		npending += len(points)
+		if npending >= batchSize {
+			if err = flush(); err != nil {
+				break
+			}
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	// commit whatever was collected before any failure
+	if ferr := flush(); ferr != nil && err == nil {
+		err = ferr
+	}
+
+	return res, err
+}
+
+// insertCollectionPoints inserts the points into the collection of a query in a single transaction, or into
+// staging if the query's values must be promoted after review.
+func insertCollectionPoints(ctx context.Context, conn *pgxpool.Conn, qry *Query, points []DataPoint) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	for _, pt := range points {
+		if qry.Staged && !pt.Provisional {
+			slog.Info("staging collected value", "query_id", qry.ID, "seq", pt.Seq, "series", pt.Series, "value", pt.Value)
+			if _, err := tx.Exec(ctx, insertStagedCollectionSQL, qry.ID, pt.Seq, pt.Series, pt.Value); err != nil {
+				return fmt.Errorf("exec (%T): %w", err, err)
+			}
+			continue
+		}
+		slog.Info("inserting collected value", "query_id", qry.ID, "seq", pt.Seq, "series", pt.Series, "value", pt.Value)
+		tag, err := tx.Exec(ctx, insertCollectionSQL, qry.ID, pt.Seq, pt.Series, pt.Value, pt.Provisional)
+		if err != nil {
+			return fmt.Errorf("exec (%T): %w", err, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return fmt.Errorf("sequence %d has already been collected", pt.Seq)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+func CollectionCollect(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	queryID := cc.Int("id")
+	seq := cc.Int("seq")
+	force := cc.Bool("force")
+
+	if queryID < 0 {
+		return fmt.Errorf("ID must be a positive integer")
+	}
+
+	if seq <= 0 {
+		return fmt.Errorf("sequence must be greater than zero")
+	}
+
+	db := NewDB(dbConnStr())
+
+	qry, err := GetQuery(ctx, db, queryID)
+	if err != nil {
+		return fmt.Errorf("get query: %w", err)
+	}
+
+	ss := new(SecretStore)
+	secrets, err := ss.Secrets(qry.ProviderID, qry.AuthType)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets for provider: %w", err)
 	}
 
 	points, err := DispatchQuery(ctx, qry, seq, secrets)
@@ -305,13 +1000,24 @@ func CollectionCollect(cc *cli.Context) error {
 		return fmt.Errorf("no points found")
 	}
 
-	if len(points) > 1 {
-		return fmt.Errorf("too many points found: %d", len(points))
+	points, err = ResolveMultipoint(qry, points)
+	if err != nil {
+		return err
 	}
 
-	slog.Info("inserting collected value", "query_id", queryID, "seq", points[0].Seq, "value", points[0].Value)
-	if err := WriteCollectionSeq(ctx, db, queryID, points[0].Seq, points[0].Value, force); err != nil {
-		return fmt.Errorf("write collection sequence: %w", err)
+	for _, pt := range points {
+		if qry.Staged && !pt.Provisional {
+			// values of staged queries are held for review until promoted, even when forced
+			slog.Info("staging collected value", "query_id", queryID, "seq", pt.Seq, "series", pt.Series, "value", pt.Value)
+			if err := WriteStagedCollectionSeq(ctx, db, queryID, pt); err != nil {
+				return fmt.Errorf("write staged collection sequence: %w", err)
+			}
+			continue
+		}
+		slog.Info("inserting collected value", "query_id", queryID, "seq", pt.Seq, "series", pt.Series, "value", pt.Value)
+		if err := WriteCollectionSeq(ctx, db, queryID, pt, force); err != nil {
+			return fmt.Errorf("write collection sequence: %w", err)
+		}
 	}
 
 	return nil
@@ -350,10 +1056,28 @@ func CollectionGet(cc *cli.Context) error {
 
 	}
 
-	slog.Debug("getting collection values", "query_id", queryID, "from", fromSeq, "to", toSeq)
+	series := strings.TrimSpace(cc.String("series"))
+
 	db := NewDB(dbConnStr())
 
-	points, err := GetCollectionValues(ctx, db, queryID, fromSeq, toSeq)
+	if cc.IsSet("since") || cc.IsSet("until") {
+		q, err := GetQuery(ctx, db, queryID)
+		if err != nil {
+			return fmt.Errorf("get query: %w", err)
+		}
+		fromSeq, toSeq, err = seqWindow(cc, q, fromSeq, toSeq)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cc.IsSet("aggregate") || cc.IsSet("bucket") {
+		return collectionGetAggregates(cc, db, queryID, series, fromSeq, toSeq)
+	}
+
+	slog.Debug("getting collection values", "query_id", queryID, "series", series, "from", fromSeq, "to", toSeq)
+
+	points, err := GetCollectionValues(ctx, db, queryID, series, fromSeq, toSeq)
 	if err != nil {
 		return fmt.Errorf("failed to execute query: %w", err)
 	}
@@ -362,18 +1086,278 @@ func CollectionGet(cc *cli.Context) error {
 		return fmt.Errorf("no points found")
 	}
 
+	staged, err := GetStagedCollectionValues(ctx, db, queryID, series, fromSeq, toSeq)
+	if err != nil {
+		return fmt.Errorf("get staged values: %w", err)
+	}
+
 	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
 	fmt.Fprintln(w, "Seq\t| Time\t| Value")
 	for _, pt := range points {
 		v := "(missing)"
 		if pt.Value != nil {
 			v = formatFloat64(*pt.Value)
+			if pt.Provisional {
+				v += " (provisional)"
+			}
+		}
+		if sv, ok := staged[pt.Seq]; ok && (pt.Value == nil || pt.Provisional) {
+			v = formatFloat64(sv) + " (staged)"
 		}
 		fmt.Fprintf(w, "%d\t| %s\t| %v\t\n", pt.Seq, pt.Time.Format("2006-01-02T15:04:05Z"), v)
 	}
 	return w.Flush()
 }
 
+func CollectionPromote(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	queryID := cc.Int("id")
+	if queryID < 0 {
+		return fmt.Errorf("ID must be a positive integer")
+	}
+
+	var fromSeq, toSeq *int
+	if cc.IsSet("from") {
+		from := cc.Int("from")
+		fromSeq = &from
+	}
+	if cc.IsSet("to") {
+		to := cc.Int("to")
+		toSeq = &to
+	}
+	if fromSeq != nil && toSeq != nil && *fromSeq > *toSeq {
+		return fmt.Errorf("from must not be greater than to")
+	}
+
+	db := NewDB(dbConnStr())
+
+	qry, err := GetQuery(ctx, db, queryID)
+	if err != nil {
+		return fmt.Errorf("get query: %w", err)
+	}
+
+	seqs, err := PromoteStagedCollections(ctx, db, queryID, fromSeq, toSeq)
+	if err != nil {
+		return fmt.Errorf("promote staged collections: %w", err)
+	}
+	if len(seqs) == 0 {
+		printStatus("No staged values found")
+		return nil
+	}
+
+	if qry.Rollup {
+		days := make(map[time.Time]int)
+		for _, seq := range seqs {
+			days[qry.SeqDay(seq)] = seq
+		}
+		for _, seq := range days {
+			if err := UpdateCollectionRollup(ctx, db, qry, seq); err != nil {
+				return fmt.Errorf("update collection rollup: %w", err)
+			}
+		}
+	}
+
+	printStatus("Promoted %d sequences", len(seqs))
+	return nil
+}
+
+func CollectionExport(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	queryID := cc.Int("id")
+	if queryID < 0 {
+		return fmt.Errorf("ID must be a positive integer")
+	}
+
+	format := strings.TrimSpace(cc.String("format"))
+	switch format {
+	case "influx", "csv", "json":
+	default:
+		return fmt.Errorf("unsupported export format: must be one of 'influx','csv','json'")
+	}
+
+	var fromSeq, toSeq *int
+	if cc.IsSet("from") {
+		from := cc.Int("from")
+		if from <= 0 {
+			return fmt.Errorf("from must be greater than zero")
+		}
+		fromSeq = &from
+	}
+	if cc.IsSet("to") {
+		to := cc.Int("to")
+		if to <= 0 {
+			return fmt.Errorf("to must be greater than zero")
+		}
+		toSeq = &to
+	}
+	if fromSeq != nil && toSeq != nil && *fromSeq > *toSeq {
+		return fmt.Errorf("from must not be greater than to")
+	}
+
+	db := NewDB(dbConnStr())
+
+	qry, err := GetQuery(ctx, db, queryID)
+	if err != nil {
+		return fmt.Errorf("get query: %w", err)
+	}
+	fromSeq, toSeq, err = seqWindow(cc, qry, fromSeq, toSeq)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if path := strings.TrimSpace(cc.String("out")); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("create output file: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+
+	if format == "influx" {
+		points, err := GetCollectionPoints(ctx, db, qry)
+		if err != nil {
+			return fmt.Errorf("get collection points: %w", err)
+		}
+		for _, pt := range points {
+			if (fromSeq != nil && pt.Seq < *fromSeq) || (toSeq != nil && pt.Seq > *toSeq) {
+				continue
+			}
+			fmt.Fprintln(w, influxLine(qry.Name, pt))
+		}
+		return w.Flush()
+	}
+
+	series := strings.TrimSpace(cc.String("series"))
+	values, err := GetCollectionValues(ctx, db, queryID, series, fromSeq, toSeq)
+	if err != nil {
+		return fmt.Errorf("get collection values: %w", err)
+	}
+
+	if format == "csv" {
+		err = writeCollectionCSV(w, values)
+	} else {
+		err = writeCollectionJSON(w, values)
+	}
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// writeCollectionCSV writes collection values as csv with seq, time and value columns, leaving the value empty
+// for missing sequences.
+func writeCollectionCSV(w io.Writer, values []CollectionValue) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"seq", "time", "value"}); err != nil {
+		return fmt.Errorf("write csv: %w", err)
+	}
+	for _, v := range values {
+		val := ""
+		if v.Value != nil {
+			val = formatFloat64(*v.Value)
+		}
+		if err := cw.Write([]string{strconv.Itoa(v.Seq), v.Time.UTC().Format(time.RFC3339), val}); err != nil {
+			return fmt.Errorf("write csv: %w", err)
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("write csv: %w", err)
+	}
+	return nil
+}
+
+// CollectionValueJSON is an exported collection value, with a null value for a missing sequence.
+type CollectionValueJSON struct {
+	Seq   int      `json:"seq"`
+	Time  string   `json:"time"`
+	Value *float64 `json:"value"`
+}
+
+// writeCollectionJSON writes collection values as a json array.
+func writeCollectionJSON(w io.Writer, values []CollectionValue) error {
+	vals := make([]CollectionValueJSON, len(values))
+	for i, v := range values {
+		vals[i] = CollectionValueJSON{
+			Seq:   v.Seq,
+			Time:  v.Time.UTC().Format(time.RFC3339),
+			Value: v.Value,
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(vals); err != nil {
+		return fmt.Errorf("write json: %w", err)
+	}
+	return nil
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ")
+	influxTagEscaper         = strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+)
+
+// influxLine formats a point in InfluxDB line protocol, using the measurement name and tagging the point with
+// its series when it has one.
+func influxLine(measurement string, pt DataPoint) string {
+	key := influxMeasurementEscaper.Replace(measurement)
+	if pt.Series != "" {
+		key += ",series=" + influxTagEscaper.Replace(pt.Series)
+	}
+	return fmt.Sprintf("%s value=%s %d", key, strconv.FormatFloat(pt.Value, 'f', -1, 64), pt.Time.UnixNano())
+}
+
+// collectionGetAggregates shows the values of a collection summarised over buckets of time.
+func collectionGetAggregates(cc *cli.Context, db *DB, queryID int, series string, fromSeq, toSeq *int) error {
+	ctx := cc.Context
+
+	fn := strings.TrimSpace(cc.String("aggregate"))
+	bucket := QueryInterval(strings.TrimSpace(cc.String("bucket")))
+	if fn == "" || bucket == "" {
+		return fmt.Errorf("aggregate and bucket must be supplied together")
+	}
+	if _, ok := aggregateFuncs[fn]; !ok {
+		return fmt.Errorf("unsupported aggregate: must be one of 'avg','sum','min','max','count'")
+	}
+	if bucket.Duration() == 0 || bucket == QueryIntervalMonthly {
+		return fmt.Errorf("unsupported bucket: must be one of 'hourly','daily','weekly'")
+	}
+
+	q, err := GetQuery(ctx, db, queryID)
+	if err != nil {
+		return fmt.Errorf("get query: %w", err)
+	}
+	step := q.IntervalDuration()
+	if bucket.Duration() < step {
+		return fmt.Errorf("bucket must not be shorter than the query interval of %s", q.IntervalString())
+	}
+	expected := int(bucket.Duration() / step)
+
+	slog.Debug("getting collection aggregates", "query_id", queryID, "series", series, "aggregate", fn, "bucket", bucket, "from", fromSeq, "to", toSeq)
+	aggs, err := GetCollectionAggregates(ctx, db, queryID, series, fn, bucket, fromSeq, toSeq)
+	if err != nil {
+		return fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	if len(aggs) == 0 {
+		return fmt.Errorf("no points found")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
+	fmt.Fprintln(w, "Bucket\t| "+strings.ToUpper(fn[:1])+fn[1:]+"\t| Points")
+	for _, agg := range aggs {
+		fmt.Fprintf(w, "%s\t| %s\t| %d/%d\n", agg.Start.UTC().Format("2006-01-02T15:04:05Z"), formatFloat64(agg.Value), agg.Count, expected)
+	}
+	return w.Flush()
+}
+
 func CollectionSet(cc *cli.Context) error {
 	ctx := cc.Context
 	setupLogging()
@@ -389,6 +1373,7 @@ func CollectionSet(cc *cli.Context) error {
 	}
 
 	value := cc.Float64("value")
+	series := strings.TrimSpace(cc.String("series"))
 
 	db := NewDB(dbConnStr())
 
@@ -403,11 +1388,14 @@ func CollectionSet(cc *cli.Context) error {
 	}
 	defer tx.Rollback(ctx)
 
-	slog.Info("inserting collected value", "query_id", queryID, "seq", seq, "value", value)
-	_, err = tx.Exec(ctx, "insert into collections(query_id,seq,value) values ($1,$2,$3)", queryID, seq, value)
+	slog.Info("inserting collected value", "query_id", queryID, "seq", seq, "series", series, "value", value)
+	tag, err := tx.Exec(ctx, insertCollectionSQL, queryID, seq, series, value, false)
 	if err != nil {
 		return fmt.Errorf("exec (%T): %w", err, err)
 	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("sequence %d has already been collected", seq)
+	}
 
 	err = tx.Commit(ctx)
 	if err != nil {
@@ -416,3 +1404,173 @@ func CollectionSet(cc *cli.Context) error {
 
 	return nil
 }
+
+func CollectionVerify(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	queryID := cc.Int("id")
+	if queryID < 0 {
+		return fmt.Errorf("ID must be a positive integer")
+	}
+
+	var fromSeq *int
+	var toSeq *int
+
+	if cc.IsSet("from") {
+		from := cc.Int("from")
+		fromSeq = &from
+		if *fromSeq <= 0 {
+			return fmt.Errorf("from must be greater than zero")
+		}
+	}
+	if cc.IsSet("to") {
+		to := cc.Int("to")
+		toSeq = &to
+
+		if *toSeq <= 0 {
+			return fmt.Errorf("to must be greater than zero")
+		}
+
+		if fromSeq != nil && *fromSeq > *toSeq {
+			return fmt.Errorf("from must not be greater than to")
+		}
+	}
+
+	series := strings.TrimSpace(cc.String("series"))
+	tolerance := cc.Float64("tolerance")
+	if tolerance < 0 {
+		return fmt.Errorf("tolerance must not be negative")
+	}
+	fix := cc.Bool("fix")
+
+	db := NewDB(dbConnStr())
+
+	qry, err := GetQuery(ctx, db, queryID)
+	if err != nil {
+		return fmt.Errorf("get query: %w", err)
+	}
+
+	ss := new(SecretStore)
+	secrets, err := ss.Secrets(qry.ProviderID, qry.AuthType)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets for provider: %w", err)
+	}
+
+	stored, err := GetCollectionValues(ctx, db, queryID, series, fromSeq, toSeq)
+	if err != nil {
+		return fmt.Errorf("get collection values: %w", err)
+	}
+
+	if len(stored) == 0 {
+		return fmt.Errorf("no points found")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
+	fmt.Fprintln(w, "Seq\t| Time\t| Stored\t| Fresh\t| Status")
+
+	mismatches := 0
+	for i, sv := range stored {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+
+		storedStr := "(missing)"
+		if sv.Value != nil {
+			storedStr = formatFloat64(*sv.Value)
+		}
+
+		slog.Info("verifying collected value", "query_id", queryID, "seq", sv.Seq, "series", series)
+		points, err := DispatchQuery(ctx, qry, sv.Seq, secrets)
+		if err != nil {
+			return fmt.Errorf("failed to execute query: %w", err)
+		}
+		points, err = ResolveMultipoint(qry, points)
+		if err != nil {
+			return fmt.Errorf("seq %d: %w", sv.Seq, err)
+		}
+
+		var fresh *DataPoint
+		for i := range points {
+			if points[i].Series == series {
+				fresh = &points[i]
+				break
+			}
+		}
+
+		if fresh == nil {
+			fmt.Fprintf(w, "%d\t| %s\t| %s\t| %s\t| %s\n", sv.Seq, sv.Time.Format("2006-01-02T15:04:05Z"), storedStr, "(missing)", "no fresh value")
+			continue
+		}
+
+		status := "ok"
+		if sv.Value == nil || math.Abs(*sv.Value-fresh.Value) > tolerance {
+			mismatches++
+			status = "mismatch"
+			if fix {
+				if err := WriteCollectionSeq(ctx, db, queryID, *fresh, true); err != nil {
+					return fmt.Errorf("write collection sequence: %w", err)
+				}
+				status = "fixed"
+			}
+		}
+		fmt.Fprintf(w, "%d\t| %s\t| %s\t| %s\t| %s\n", sv.Seq, sv.Time.Format("2006-01-02T15:04:05Z"), storedStr, formatFloat64(fresh.Value), status)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if mismatches > 0 && !fix {
+		return fmt.Errorf("found %d mismatched values", mismatches)
+	}
+	return nil
+}
+
+func CollectionRollupGet(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	queryID := cc.Int("id")
+	if queryID < 0 {
+		return fmt.Errorf("ID must be a positive integer")
+	}
+
+	var from, to *time.Time
+	if cc.IsSet("from") {
+		t, err := time.Parse("2006-01-02", strings.TrimSpace(cc.String("from")))
+		if err != nil {
+			return fmt.Errorf("from must be a date in the form 2006-01-02: %w", err)
+		}
+		from = &t
+	}
+	if cc.IsSet("to") {
+		t, err := time.Parse("2006-01-02", strings.TrimSpace(cc.String("to")))
+		if err != nil {
+			return fmt.Errorf("to must be a date in the form 2006-01-02: %w", err)
+		}
+		to = &t
+		if from != nil && from.After(*to) {
+			return fmt.Errorf("from must not be after to")
+		}
+	}
+
+	series := strings.TrimSpace(cc.String("series"))
+
+	db := NewDB(dbConnStr())
+	rs, err := GetCollectionRollups(ctx, db, queryID, series, from, to)
+	if err != nil {
+		return fmt.Errorf("get collection rollups: %w", err)
+	}
+
+	if len(rs) == 0 {
+		return fmt.Errorf("no rollups found")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
+	fmt.Fprintln(w, "Day\t| Min\t| Max\t| Avg\t| Last\t| Count")
+	for _, r := range rs {
+		fmt.Fprintf(w, "%s\t| %s\t| %s\t| %s\t| %s\t| %d\n", r.Day.Format("2006-01-02"), formatFloat64(r.Min), formatFloat64(r.Max), formatFloat64(r.Avg), formatFloat64(r.Last), r.Count)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// A CollectionLog appends a JSON line to a file for every collected value written, providing an audit
+// trail that is independent of the application log. A nil CollectionLog discards all entries.
+type CollectionLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+type CollectionLogEntryJSON struct {
+	QueryID     int       `json:"query_id"`
+	Seq         int       `json:"seq"`
+	Series      string    `json:"series,omitempty"`
+	Time        time.Time `json:"time"`
+	Value       float64   `json:"value"`
+	Provisional bool      `json:"provisional,omitempty"`
+	WrittenAt   time.Time `json:"written_at"`
+}
+
+// OpenCollectionLog opens the collection log at path for appending, creating it if necessary.
+func OpenCollectionLog(path string) (*CollectionLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open collection log: %w", err)
+	}
+	return &CollectionLog{
+		f:   f,
+		enc: json.NewEncoder(f),
+	}, nil
+}
+
+// Write appends an entry recording that pt was written to the collection of the query.
+func (l *CollectionLog) Write(queryID int, pt DataPoint) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(CollectionLogEntryJSON{
+		QueryID:     queryID,
+		Seq:         pt.Seq,
+		Series:      pt.Series,
+		Time:        pt.Time,
+		Value:       pt.Value,
+		Provisional: pt.Provisional,
+		WrittenAt:   time.Now().UTC(),
+	})
+}
+
+func (l *CollectionLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
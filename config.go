@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+var configFlag = &cli.StringFlag{
+	Name:    "config",
+	Usage:   "Read default values for flags from YAML `FILE`, keyed by flag name",
+	EnvVars: []string{envPrefix + "CONFIG"},
+}
+
+var configCommand = &cli.Command{
+	Name:  "config",
+	Usage: "Commands for inspecting configuration",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "show",
+			Usage:  "Show the configuration in effect after applying flags, environment variables and the config file, with secrets redacted.",
+			Action: ConfigShow,
+			Flags:  union([]cli.Flag{diagAddrFlag}, httpFlags, dbFlags, loggingFlags, hlogDefaultFalse),
+		},
+	},
+}
+
+func ConfigShow(cc *cli.Context) error {
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
+	fmt.Fprintln(w, "Setting\t| Value")
+	fmt.Fprintf(w, "config file\t| %s\n", cc.String("config"))
+	fmt.Fprintf(w, "secrets dir\t| %s\n", secretsDir)
+	fmt.Fprintf(w, "database connection\t| %s\n", redactConnStr(dbConnStr()))
+	fmt.Fprintf(w, "ssh host\t| %s\n", sshOpts.host)
+	fmt.Fprintf(w, "ssh user\t| %s\n", sshOpts.user)
+	fmt.Fprintf(w, "ssh key\t| %s\n", sshOpts.keyFile)
+	fmt.Fprintf(w, "ssh known hosts\t| %s\n", sshOpts.knownHostsFile)
+	fmt.Fprintf(w, "request timeout\t| %s\n", httpOpts.requestTimeout)
+	fmt.Fprintf(w, "max retries\t| %d\n", httpOpts.maxRetries)
+	fmt.Fprintf(w, "verbose\t| %t\n", loggingOpts.Verbose)
+	fmt.Fprintf(w, "very verbose\t| %t\n", loggingOpts.VeryVerbose)
+	fmt.Fprintf(w, "hlog\t| %t\n", loggingOpts.Hlog)
+	fmt.Fprintf(w, "db trace\t| %t\n", loggingOpts.DBTrace)
+	fmt.Fprintf(w, "diag addr\t| %s\n", daemonOpts.diagnosticsAddr)
+	return w.Flush()
+}
+
+var connStrPasswordRegexp = regexp.MustCompile(`password=('(?:[^'\\]|\\.)*'|\S*)`)
+
+// redactConnStr masks the password in a postgres connection string given either as a URL or as keyword/value pairs.
+func redactConnStr(connstr string) string {
+	if strings.HasPrefix(connstr, "postgres://") || strings.HasPrefix(connstr, "postgresql://") {
+		u, err := url.Parse(connstr)
+		if err != nil {
+			return "(invalid url)"
+		}
+		if q := u.Query(); q.Has("password") {
+			q.Set("password", "xxxxx")
+			u.RawQuery = q.Encode()
+		}
+		return u.Redacted()
+	}
+	return connStrPasswordRegexp.ReplaceAllString(connstr, "password=xxxxx")
+}
+
+// loadConfigFile reads the YAML config file named by the config flag, if any, and uses its values as
+// defaults for flags that can be set using environment variables. Each value is applied by setting the
+// flag's environment variable when it is not already set, so that values set in the environment take
+// precedence over the file and values passed as flags take precedence over both.
+func loadConfigFile(cc *cli.Context) error {
+	path := cc.String("config")
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("parse config file: %w", err)
+	}
+
+	envVars := make(map[string][]string)
+	collectFlagEnvVars(cc.App.Commands, envVars)
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		vars, ok := envVars[name]
+		if !ok {
+			return fmt.Errorf("config file: unsupported setting %q", name)
+		}
+
+		val, err := configValueString(values[name])
+		if err != nil {
+			return fmt.Errorf("config file: setting %q: %w", name, err)
+		}
+
+		if envVarSet(vars) {
+			continue
+		}
+
+		if err := os.Setenv(vars[0], val); err != nil {
+			return fmt.Errorf("config file: setting %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// collectFlagEnvVars records the environment variables of every flag of the commands, keyed by flag name.
+func collectFlagEnvVars(cmds []*cli.Command, envVars map[string][]string) {
+	for _, cmd := range cmds {
+		for _, f := range cmd.Flags {
+			ef, ok := f.(interface{ GetEnvVars() []string })
+			if !ok || len(ef.GetEnvVars()) == 0 {
+				continue
+			}
+			for _, name := range f.Names() {
+				envVars[name] = ef.GetEnvVars()
+			}
+		}
+		collectFlagEnvVars(cmd.Subcommands, envVars)
+	}
+}
+
+func envVarSet(vars []string) bool {
+	for _, v := range vars {
+		if _, ok := os.LookupEnv(v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// configValueString converts a value read from the config file to the form expected in an environment variable.
+func configValueString(v any) (string, error) {
+	switch tv := v.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		parts := make([]string, 0, len(tv))
+		for _, e := range tv {
+			s, err := configValueString(e)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	case map[any]any:
+		return "", fmt.Errorf("nested values are not supported")
+	default:
+		return fmt.Sprint(tv), nil
+	}
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/iand/pontium/prom"
@@ -15,38 +21,261 @@ import (
 	"golang.org/x/exp/slog"
 )
 
+var diagAddrFlag = &cli.StringFlag{
+	Name:        "diag-addr",
+	Aliases:     []string{"da"},
+	Usage:       "Run diagnostics server for metrics on `ADDRESS:PORT`",
+	Value:       "",
+	EnvVars:     []string{envPrefix + "DIAG_ADDR"},
+	Destination: &daemonOpts.diagnosticsAddr,
+}
+
 var daemonCommand = &cli.Command{
 	Name:   "daemon",
 	Usage:  "Run a daemon that continually keeps collections up to date.",
 	Action: Daemon,
 	Flags: union([]cli.Flag{
+		diagAddrFlag,
+		&cli.StringFlag{
+			Name:        "health-addr",
+			Usage:       "Run a server for the /healthz and /readyz probes on `ADDRESS:PORT`. The daemon is ready once it has first fetched the active queries",
+			EnvVars:     []string{envPrefix + "HEALTH_ADDR"},
+			Destination: &daemonOpts.healthAddr,
+		},
+		&cli.BoolFlag{
+			Name:        "admin-endpoints",
+			Usage:       "Serve the /admin/monitors endpoints for listing and cancelling query monitors on the health server",
+			EnvVars:     []string{envPrefix + "ADMIN_ENDPOINTS"},
+			Destination: &daemonOpts.adminEndpoints,
+		},
 		&cli.StringFlag{
-			Name:        "diag-addr",
-			Aliases:     []string{"da"},
-			Usage:       "Run diagnostics server for metrics on `ADDRESS:PORT`",
+			Name:        "error-report-url",
+			Usage:       "Post a JSON report of collection failures to `URL`",
 			Value:       "",
-			EnvVars:     []string{envPrefix + "DIAG_ADDR"},
-			Destination: &daemonOpts.diagnosticsAddr,
+			EnvVars:     []string{envPrefix + "ERROR_REPORT_URL"},
+			Destination: &daemonOpts.errorReportURL,
+		},
+		&cli.DurationFlag{
+			Name:        "error-report-interval",
+			Usage:       "Minimum time between error reports for a single query",
+			Value:       time.Hour,
+			EnvVars:     []string{envPrefix + "ERROR_REPORT_INTERVAL"},
+			Destination: &daemonOpts.errorReportInterval,
+		},
+		&cli.StringFlag{
+			Name:        "metrics-prefix",
+			Usage:       "Prefix applied to the name of every metric reported by the daemon",
+			Value:       appName + "_",
+			EnvVars:     []string{envPrefix + "METRICS_PREFIX"},
+			Destination: &daemonOpts.metricsPrefix,
+		},
+		&cli.BoolFlag{
+			Name:        "newest-first",
+			Usage:       "Fill the most recent collection gaps first",
+			EnvVars:     []string{envPrefix + "NEWEST_FIRST"},
+			Destination: &daemonOpts.newestFirst,
+		},
+		&cli.DurationFlag{
+			Name:        "monitor-min-interval",
+			Usage:       "Minimum time a query monitor waits between looking for collection gaps",
+			Value:       10 * time.Second,
+			EnvVars:     []string{envPrefix + "MONITOR_MIN_INTERVAL"},
+			Destination: &daemonOpts.monitorMinInterval,
+		},
+		&cli.DurationFlag{
+			Name:        "monitor-max-interval",
+			Usage:       "Maximum time a query monitor waits between looking for collection gaps",
+			Value:       10 * time.Minute,
+			EnvVars:     []string{envPrefix + "MONITOR_MAX_INTERVAL"},
+			Destination: &daemonOpts.monitorMaxInterval,
+		},
+		&cli.Float64Flag{
+			Name:        "monitor-jitter",
+			Usage:       "Jitter factor applied to the time a query monitor waits between looking for collection gaps",
+			Value:       0.5,
+			EnvVars:     []string{envPrefix + "MONITOR_JITTER"},
+			Destination: &daemonOpts.monitorJitter,
+		},
+		&cli.DurationFlag{
+			Name:        "monitor-stagger",
+			Usage:       "Maximum random delay before a query monitor first looks for collection gaps, spreading monitors over time so they do not send requests in bursts",
+			Value:       time.Minute,
+			EnvVars:     []string{envPrefix + "MONITOR_STAGGER"},
+			Destination: &daemonOpts.monitorStagger,
+		},
+		&cli.IntFlag{
+			Name:        "max-empty-attempts",
+			Usage:       "Number of times the provider may return no data for a sequence before it is treated as permanently empty",
+			Value:       defaultMaxEmptyAttempts,
+			EnvVars:     []string{envPrefix + "MAX_EMPTY_ATTEMPTS"},
+			Destination: &daemonOpts.maxEmptyAttempts,
+		},
+		&cli.BoolFlag{
+			Name:        "retry-empty",
+			Usage:       "Keep collecting sequences that have been treated as permanently empty",
+			EnvVars:     []string{envPrefix + "RETRY_EMPTY"},
+			Destination: &daemonOpts.retryEmpty,
+		},
+		&cli.BoolFlag{
+			Name:        "require-secrets",
+			Usage:       "Fail at startup if any active query references a provider with missing secrets",
+			EnvVars:     []string{envPrefix + "REQUIRE_SECRETS"},
+			Destination: &daemonOpts.requireSecrets,
+		},
+		&cli.StringFlag{
+			Name:        "collection-log",
+			Usage:       "Append a JSON line recording every collected value written to `FILE`",
+			EnvVars:     []string{envPrefix + "COLLECTION_LOG"},
+			Destination: &daemonOpts.collectionLog,
+		},
+		&cli.BoolFlag{
+			Name:        "store-raw",
+			Usage:       "Store the raw response received from the provider for each collection",
+			EnvVars:     []string{envPrefix + "STORE_RAW"},
+			Destination: &daemonOpts.storeRaw,
+		},
+		&cli.DurationFlag{
+			Name:        "gap-lookback",
+			Usage:       "Only fill gaps in sequences that end within this duration before now, leaving older gaps for collection fill. 0 fills all gaps",
+			EnvVars:     []string{envPrefix + "GAP_LOOKBACK"},
+			Destination: &daemonOpts.gapLookback,
+		},
+		&cli.IntFlag{
+			Name:        "max-gaps-per-cycle",
+			Usage:       "Maximum number of gaps each query fills in a single cycle, leaving the rest for later cycles so that one query's backlog does not delay the others. 0 fills all gaps",
+			EnvVars:     []string{envPrefix + "MAX_GAPS_PER_CYCLE"},
+			Destination: &daemonOpts.maxGapsPerCycle,
+		},
+		&cli.IntFlag{
+			Name:        "fill-concurrency",
+			Usage:       "Number of gaps each query fills at the same time. Values above 1 fill gaps in no particular order",
+			Value:       1,
+			EnvVars:     []string{envPrefix + "FILL_CONCURRENCY"},
+			Destination: &daemonOpts.fillConcurrency,
 		},
-	}, dbFlags, loggingFlags, hlogDefaultFalse),
+		&cli.Float64Flag{
+			Name:        "provider-rate-limit",
+			Usage:       "Maximum number of requests per second made to each provider, shared by all of its queries. 0 does not limit requests",
+			EnvVars:     []string{envPrefix + "PROVIDER_RATE_LIMIT"},
+			Destination: &daemonOpts.providerRateLimit,
+		},
+		&cli.BoolFlag{
+			Name:        "dry-run",
+			Usage:       "Log the gaps each query would fill and the time range of each without querying providers or writing collections",
+			EnvVars:     []string{envPrefix + "DRY_RUN"},
+			Destination: &daemonOpts.dryRun,
+		},
+		&cli.DurationFlag{
+			Name:        "auth-cooloff",
+			Usage:       "How long to stop collecting for a provider after it rejects its credentials",
+			Value:       time.Hour,
+			EnvVars:     []string{envPrefix + "AUTH_COOLOFF"},
+			Destination: &daemonOpts.authCooloff,
+		},
+		&cli.DurationFlag{
+			Name:        "raw-retention",
+			Usage:       "Delete stored raw responses older than this duration, 0 retains them indefinitely",
+			Value:       30 * 24 * time.Hour,
+			EnvVars:     []string{envPrefix + "RAW_RETENTION"},
+			Destination: &daemonOpts.rawRetention,
+		},
+	}, httpFlags, dbFlags, loggingFlags, hlogDefaultFalse),
 }
 
 var daemonOpts struct {
-	diagnosticsAddr string
+	diagnosticsAddr     string
+	healthAddr          string
+	adminEndpoints      bool
+	metricsPrefix       string
+	errorReportURL      string
+	errorReportInterval time.Duration
+	monitorMinInterval  time.Duration
+	monitorMaxInterval  time.Duration
+	monitorJitter       float64
+	monitorStagger      time.Duration
+	newestFirst         bool
+	maxEmptyAttempts    int
+	retryEmpty          bool
+	requireSecrets      bool
+	collectionLog       string
+	storeRaw            bool
+	rawRetention        time.Duration
+	authCooloff         time.Duration
+	gapLookback         time.Duration
+	maxGapsPerCycle     int
+	fillConcurrency     int
+	providerRateLimit   float64
+	dryRun              bool
 }
 
 func Daemon(cc *cli.Context) error {
 	ctx := cc.Context
 	setupLogging()
 
+	if daemonOpts.monitorMinInterval > daemonOpts.monitorMaxInterval {
+		return fmt.Errorf("monitor-min-interval must not be greater than monitor-max-interval")
+	}
+	if daemonOpts.monitorJitter < 0 {
+		return fmt.Errorf("monitor-jitter must not be negative")
+	}
+	if daemonOpts.monitorStagger < 0 {
+		return fmt.Errorf("monitor-stagger must not be negative")
+	}
+	if daemonOpts.maxGapsPerCycle < 0 {
+		return fmt.Errorf("max-gaps-per-cycle must not be negative")
+	}
+	if daemonOpts.fillConcurrency < 1 {
+		return fmt.Errorf("fill-concurrency must be at least 1")
+	}
+	if daemonOpts.providerRateLimit < 0 {
+		return fmt.Errorf("provider-rate-limit must not be negative")
+	}
+
 	g := new(run.Group)
 
 	qc := new(QueryCollector)
 	qc.db = NewDB(dbConnStr())
 	qc.ss = new(SecretStore)
 	qc.monitors = new(sync.Map)
+	qc.cooloff = NewProviderCooloff(daemonOpts.authCooloff)
+	if daemonOpts.providerRateLimit > 0 {
+		qc.limiter = NewProviderRateLimiter(daemonOpts.providerRateLimit)
+	}
+	if daemonOpts.errorReportURL != "" {
+		qc.reporter = NewErrorReporter(daemonOpts.errorReportURL, daemonOpts.errorReportInterval)
+	}
+	if daemonOpts.collectionLog != "" {
+		clog, err := OpenCollectionLog(daemonOpts.collectionLog)
+		if err != nil {
+			return err
+		}
+		defer clog.Close()
+		qc.clog = clog
+	}
+
+	if err := qc.preflightSecrets(ctx); err != nil {
+		if daemonOpts.requireSecrets {
+			return err
+		}
+		slog.Warn("secrets preflight failed, affected queries will be skipped until secrets are available", "error", err)
+	}
+
+	qc.logStartupSummary(ctx)
+
 	g.Add(qc)
 
+	if daemonOpts.adminEndpoints && daemonOpts.healthAddr == "" {
+		return fmt.Errorf("admin-endpoints requires health-addr to be set")
+	}
+	if daemonOpts.healthAddr != "" {
+		hs := NewHealthServer(daemonOpts.healthAddr, qc.ready.Load)
+		if daemonOpts.adminEndpoints {
+			hs.Handle("/admin/monitors", http.HandlerFunc(qc.serveMonitors))
+			hs.Handle("/admin/monitors/cancel", http.HandlerFunc(qc.serveCancelMonitor))
+		}
+		g.Add(hs)
+	}
+
 	// Init metric reporting if required
 	if daemonOpts.diagnosticsAddr != "" {
 		pr, err := prom.NewPrometheusServer(daemonOpts.diagnosticsAddr, "/metrics", appName)
@@ -62,32 +291,205 @@ func Daemon(cc *cli.Context) error {
 type QueryCollector struct {
 	db                 *DB
 	ss                 *SecretStore
+	reporter           *ErrorReporter
+	clog               *CollectionLog
 	monitors           *sync.Map
 	activeQueriesGauge prom.Gauge
 	monitorGauge       prom.Gauge
+	orphanedGauge      prom.Gauge
+	pollErrorCounter   prom.Counter
+	maxLagGauge        prom.Gauge
+	ready              atomic.Bool // set once active queries have been fetched successfully
+	cooloff            *ProviderCooloff
+	limiter            *ProviderRateLimiter
+
+	secretErrorCounters map[int]prom.Counter // counters of secret resolution failures, by provider id
+}
+
+// preflightSecrets checks that the secrets for the provider of every active query are available and logs
+// a report of the queries that will be skipped because of missing secrets.
+func (qc *QueryCollector) preflightSecrets(ctx context.Context) error {
+	qs, err := FetchActiveQueries(ctx, qc.db)
+	if err != nil {
+		return fmt.Errorf("fetch active queries: %w", err)
+	}
+
+	type providerFailure struct {
+		err      error
+		queryIDs []int
+	}
+	failures := make(map[int]*providerFailure)
+	var providerIDs []int
+	for _, q := range qs {
+		if _, err := qc.ss.Secrets(q.ProviderID, q.AuthType); err != nil {
+			pf, ok := failures[q.ProviderID]
+			if !ok {
+				pf = &providerFailure{err: err}
+				failures[q.ProviderID] = pf
+				providerIDs = append(providerIDs, q.ProviderID)
+			}
+			pf.queryIDs = append(pf.queryIDs, q.ID)
+		}
+	}
+
+	if len(failures) == 0 {
+		slog.Info("secrets preflight passed", "active_queries", len(qs))
+		return nil
+	}
+
+	skipped := 0
+	sort.Ints(providerIDs)
+	for _, id := range providerIDs {
+		pf := failures[id]
+		skipped += len(pf.queryIDs)
+		slog.Error("missing secrets for provider", "provider_id", id, "query_ids", pf.queryIDs, "error", pf.err)
+	}
+
+	return fmt.Errorf("missing secrets for %d providers used by %d of %d active queries", len(failures), skipped, len(qs))
+}
+
+// logStartupSummary logs the active queries that will be monitored along with the number of gaps each has
+// to be filled, so the configuration can be confirmed before the monitors report.
+func (qc *QueryCollector) logStartupSummary(ctx context.Context) {
+	qs, err := FetchActiveQueries(ctx, qc.db)
+	if err != nil {
+		slog.Error("failed to fetch active queries for startup summary", "error", err)
+		return
+	}
+
+	maxEmptyAttempts := daemonOpts.maxEmptyAttempts
+	if daemonOpts.retryEmpty {
+		maxEmptyAttempts = 0
+	}
+	gaps, err := CountCollectionGaps(ctx, qc.db, maxEmptyAttempts)
+	if err != nil {
+		slog.Error("failed to count collection gaps for startup summary", "error", err)
+		return
+	}
+
+	total := 0
+	for _, q := range qs {
+		total += gaps[q.ID]
+		slog.Info("active query", "query_id", q.ID, "name", q.Name, "provider_id", q.ProviderID, "api_type", q.ApiType, "interval", q.IntervalString(), "gaps", gaps[q.ID])
+	}
+	slog.Info("daemon starting", "active_queries", len(qs), "total_gaps", total)
 }
 
 func (qc *QueryCollector) Run(ctx context.Context) error {
 	var err error
-	qc.activeQueriesGauge, err = prom.NewPrometheusGauge("active_queries", "Current number of active queries", nil)
+	qc.activeQueriesGauge, err = prom.NewPrometheusGauge(metricName("active_queries"), "Current number of active queries", nil)
 	if err != nil {
 		return fmt.Errorf("create active_queries gauge: %w", err)
 	}
-	qc.monitorGauge, err = prom.NewPrometheusGauge("monitored_queries", "Current number of queries being monitored", nil)
+	qc.monitorGauge, err = prom.NewPrometheusGauge(metricName("monitored_queries"), "Current number of queries being monitored", nil)
 	if err != nil {
 		return fmt.Errorf("create monitored_queries gauge: %w", err)
 	}
+	qc.orphanedGauge, err = prom.NewPrometheusGauge(metricName("query_orphaned_total"), "Current number of active queries that are not collected because their source or provider is missing", nil)
+	if err != nil {
+		return fmt.Errorf("create query_orphaned_total gauge: %w", err)
+	}
+	qc.maxLagGauge, err = prom.NewPrometheusGauge(metricName("max_collection_lag_seconds"), "Largest number of seconds since the most recently collected sequence of any monitored query", nil)
+	if err != nil {
+		return fmt.Errorf("create max_collection_lag_seconds gauge: %w", err)
+	}
+	qc.pollErrorCounter, err = prom.NewPrometheusCounter(metricName("daemon_poll_error_total"), "Total number of poll cycles that failed to fetch the active queries", nil)
+	if err != nil {
+		return fmt.Errorf("create daemon_poll_error_total counter: %w", err)
+	}
 	return wait.Forever(ctx, qc.monitorActiveQueries, 0, 10*time.Minute, 0.1)
 }
 
+const (
+	pollFetchAttempts = 4               // number of attempts to fetch the active queries in a single poll cycle
+	pollFetchBackoff  = 2 * time.Second // delay before the first retry, doubled for each subsequent retry
+
+	// sideEffectRetention is how long the idempotency keys of emitted side effects are kept, well beyond
+	// the period over which a sequence might be retried
+	sideEffectRetention = 7 * 24 * time.Hour
+)
+
+// fetchActiveQueries fetches the active queries, retrying a few times with a short backoff so that a brief
+// loss of the database does not leave a whole poll cycle without monitoring.
+func (qc *QueryCollector) fetchActiveQueries(ctx context.Context) ([]*Query, error) {
+	backoff := pollFetchBackoff
+	for attempt := 1; ; attempt++ {
+		qs, err := FetchActiveQueries(ctx, qc.db)
+		if err == nil {
+			return qs, nil
+		}
+		if attempt == pollFetchAttempts {
+			return nil, err
+		}
+		slog.Warn("failed to fetch active queries, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// countSecretError increments the counter of secret resolution failures for a provider.
+func (qc *QueryCollector) countSecretError(providerID int) {
+	if qc.secretErrorCounters == nil {
+		qc.secretErrorCounters = make(map[int]prom.Counter)
+	}
+	c, ok := qc.secretErrorCounters[providerID]
+	if !ok {
+		var err error
+		c, err = prom.NewPrometheusCounter(metricName("secret_resolution_error_total"), "Total number of failures to resolve the secrets for a provider", map[string]string{
+			"provider_id": strconv.Itoa(providerID),
+		})
+		if err != nil {
+			slog.Error("failed to create secret_resolution_error_total counter", "provider_id", providerID, "error", err)
+			return
+		}
+		qc.secretErrorCounters[providerID] = c
+	}
+	c.Inc()
+}
+
 func (qc *QueryCollector) monitorActiveQueries(ctx context.Context) error {
-	qs, err := FetchActiveQueries(ctx, qc.db)
+	qs, err := qc.fetchActiveQueries(ctx)
 	if err != nil {
-		slog.Error("failed to fetch active queries", "error", err)
+		qc.pollErrorCounter.Inc()
+		slog.Error("failed to fetch active queries", "attempts", pollFetchAttempts, "error", err)
 		return nil
 	}
 
 	qc.activeQueriesGauge.Set(float64(len(qs)))
+	if !qc.ready.Swap(true) {
+		slog.Info("daemon is ready", "active_queries", len(qs))
+	}
+
+	orphaned, err := FindOrphanedQueries(ctx, qc.db)
+	if err != nil {
+		slog.Error("failed to check for orphaned queries", "error", err)
+	} else {
+		qc.orphanedGauge.Set(float64(len(orphaned)))
+		if len(orphaned) > 0 {
+			slog.Warn("active queries reference a missing source or provider and will not be collected", "query_ids", orphaned)
+		}
+	}
+
+	if daemonOpts.storeRaw && daemonOpts.rawRetention > 0 && !daemonOpts.dryRun {
+		n, err := PruneCollectionResponses(ctx, qc.db, time.Now().Add(-daemonOpts.rawRetention))
+		if err != nil {
+			slog.Error("failed to prune raw responses", "error", err)
+		} else if n > 0 {
+			slog.Info("pruned raw responses", "count", n)
+		}
+	}
+
+	if !daemonOpts.dryRun {
+		if n, err := PruneSideEffects(ctx, qc.db, time.Now().Add(-sideEffectRetention)); err != nil {
+			slog.Error("failed to prune side effects", "error", err)
+		} else if n > 0 {
+			slog.Debug("pruned side effects", "count", n)
+		}
+	}
 
 	for _, q := range qs {
 		q := q
@@ -95,20 +497,52 @@ func (qc *QueryCollector) monitorActiveQueries(ctx context.Context) error {
 		ps, err := qc.ss.Secrets(q.ProviderID, q.AuthType)
 		if err != nil {
 			slog.Error("failed to get secrets for provider", "provider_id", q.ProviderID, "error", err)
+			qc.countSecretError(q.ProviderID)
 			continue
 		}
 
 		qm := &QueryMonitor{
-			db:    qc.db,
-			query: q,
-			ps:    ps,
+			db:          qc.db,
+			query:       q,
+			ps:          ps,
+			reporter:    qc.reporter,
+			clog:        qc.clog,
+			cooloff:     qc.cooloff,
+			limiter:     qc.limiter,
+			minInterval: daemonOpts.monitorMinInterval,
+			maxInterval: daemonOpts.monitorMaxInterval,
+			jitter:      daemonOpts.monitorJitter,
+		}
+		if v, running := qc.monitors.Load(q.ID); running {
+			if prev := v.(*QueryMonitor); !reflect.DeepEqual(*prev.query, *q) {
+				// the stored query has changed, such as by query update, so the monitor is restarted to use it
+				slog.Info("query definition changed, restarting monitor", "query_id", q.ID, "name", q.Name)
+				prev.cancel()
+				qc.monitors.CompareAndDelete(q.ID, prev)
+			}
 		}
+
+		mctx, cancel := context.WithCancel(ctx)
+		qm.cancel = cancel
+		qm.started = time.Now().UTC()
 		if _, running := qc.monitors.LoadOrStore(qm.query.ID, qm); !running {
 			slog.Debug("no monitor found for query", "query_id", q.ID, "name", q.Name)
 			qc.monitorGauge.Inc()
 			go func(ctx context.Context, qm *QueryMonitor) {
-				defer qc.monitors.Delete(qm.query.ID)
+				// only remove this monitor, which may already have been replaced by another for the query
+				defer qc.monitors.CompareAndDelete(qm.query.ID, qm)
 				defer qc.monitorGauge.Dec()
+				defer qm.cancel()
+
+				if daemonOpts.monitorStagger > 0 {
+					delay := time.Duration(rand.Int63n(int64(daemonOpts.monitorStagger)))
+					slog.Debug("staggering query monitor start", "query_id", qm.query.ID, "delay", delay)
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(delay):
+					}
+				}
 
 				slog.Info("starting query monitor", "query_id", qm.query.ID, "name", q.Name)
 				if err := qm.Run(ctx); err != nil {
@@ -118,100 +552,724 @@ func (qc *QueryCollector) monitorActiveQueries(ctx context.Context) error {
 						slog.Error("monitor query stopped", "query_id", qm.query.ID, "error", err)
 					}
 				}
-			}(ctx, qm)
+			}(mctx, qm)
+		} else {
+			cancel()
 		}
 
 	}
 
+	qc.stopInactiveMonitors(qs)
+	qc.updateMaxCollectionLag()
+
 	return nil
 }
 
+// stopInactiveMonitors cancels the monitors of queries that are no longer active, such as those that have
+// been archived or have finished, so they stop collecting without waiting for the daemon to restart.
+func (qc *QueryCollector) stopInactiveMonitors(qs []*Query) {
+	active := make(map[int]bool, len(qs))
+	for _, q := range qs {
+		active[q.ID] = true
+	}
+	qc.monitors.Range(func(key, value any) bool {
+		if id := key.(int); !active[id] {
+			slog.Info("query is no longer active, stopping monitor", "query_id", id)
+			value.(*QueryMonitor).cancel()
+		}
+		return true
+	})
+}
+
+// updateMaxCollectionLag sets the gauge reporting the worst collection lag across the monitored queries, using
+// the most recently collected sequence each monitor has found. Monitors that have not yet checked their
+// collection are ignored.
+func (qc *QueryCollector) updateMaxCollectionLag() {
+	now := time.Now()
+	var maxLag time.Duration
+	qc.monitors.Range(func(_, v any) bool {
+		qm := v.(*QueryMonitor)
+		if ts := qm.lastCollected.Load(); ts != 0 {
+			if lag := now.Sub(time.Unix(ts, 0)); lag > maxLag {
+				maxLag = lag
+			}
+		}
+		return true
+	})
+	qc.maxLagGauge.Set(maxLag.Seconds())
+}
+
+// A ProviderCooloff records the providers that have rejected their credentials so that collection for all of
+// their queries can be paused until the cool-off period has passed, rather than repeating requests that will
+// fail and risk being blocked by the provider. A nil ProviderCooloff never pauses collection.
+type ProviderCooloff struct {
+	period time.Duration
+
+	mu       sync.Mutex
+	until    map[int]time.Time
+	counters map[int]prom.Counter // counters of rejected credentials, by provider id
+}
+
+func NewProviderCooloff(period time.Duration) *ProviderCooloff {
+	return &ProviderCooloff{
+		period:   period,
+		until:    make(map[int]time.Time),
+		counters: make(map[int]prom.Counter),
+	}
+}
+
+// Start begins a cool-off for the provider, returning the time at which it ends.
+func (p *ProviderCooloff) Start(providerID int) time.Time {
+	if p == nil {
+		return time.Time{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	until := time.Now().Add(p.period)
+	p.until[providerID] = until
+
+	c, ok := p.counters[providerID]
+	if !ok {
+		var err error
+		c, err = prom.NewPrometheusCounter(metricName("provider_credentials_rejected_total"), "Total number of times a provider has rejected its credentials", map[string]string{
+			"provider_id": strconv.Itoa(providerID),
+		})
+		if err != nil {
+			slog.Error("failed to create provider_credentials_rejected_total counter", "provider_id", providerID, "error", err)
+			return until
+		}
+		p.counters[providerID] = c
+	}
+	c.Inc()
+	return until
+}
+
+// Until reports whether the provider is in a cool-off and the time at which it ends.
+func (p *ProviderCooloff) Until(providerID int) (time.Time, bool) {
+	if p == nil {
+		return time.Time{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	until, ok := p.until[providerID]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !time.Now().Before(until) {
+		delete(p.until, providerID)
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// A ProviderRateLimiter spaces out the requests made to each provider so that queries sharing a provider do
+// not exceed its rate limits, however many of them are collecting at once. A nil ProviderRateLimiter never
+// delays requests.
+type ProviderRateLimiter struct {
+	interval time.Duration // minimum time between requests to a provider
+
+	mu   sync.Mutex
+	next map[int]time.Time // time of the next available request slot, by provider id
+}
+
+// NewProviderRateLimiter creates a limiter allowing rate requests per second to each provider.
+func NewProviderRateLimiter(rate float64) *ProviderRateLimiter {
+	return &ProviderRateLimiter{
+		interval: time.Duration(float64(time.Second) / rate),
+		next:     make(map[int]time.Time),
+	}
+}
+
+// Wait blocks until a request may be made to the provider or the context is canceled.
+func (p *ProviderRateLimiter) Wait(ctx context.Context, providerID int) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	now := time.Now()
+	slot := p.next[providerID]
+	if slot.Before(now) {
+		slot = now
+	}
+	p.next[providerID] = slot.Add(p.interval)
+	p.mu.Unlock()
+
+	delay := slot.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
 type QueryMonitor struct {
-	db                *DB
-	query             *Query
-	ps                ProviderSecrets
-	collectionCounter prom.Counter
-	errorCounter      prom.Counter
+	db                     *DB
+	query                  *Query
+	ps                     ProviderSecrets
+	reporter               *ErrorReporter
+	clog                   *CollectionLog
+	cooloff                *ProviderCooloff
+	limiter                *ProviderRateLimiter
+	started                time.Time          // when the monitor was launched
+	cancel                 context.CancelFunc // stops the monitor
+	lastCycle              atomic.Int64       // unix time at which the monitor last began looking for gaps
+	lastCollected          atomic.Int64       // unix time of the most recently collected sequence, zero until known
+	minInterval            time.Duration      // minimum wait between looking for gaps
+	maxInterval            time.Duration      // maximum wait between looking for gaps
+	jitter                 float64            // jitter factor applied to wait between looking for gaps
+	collectionCounter      prom.Counter
+	errorCounter           prom.Counter
+	multipointCounter      prom.Counter
+	lastCollectionAgeGauge prom.Gauge
+	cadenceRatioGauge      prom.Gauge
+}
+
+// MonitorInfoJSON describes a running query monitor.
+type MonitorInfoJSON struct {
+	QueryID   int        `json:"query_id"`
+	Name      string     `json:"name"`
+	Started   time.Time  `json:"started"`
+	LastCycle *time.Time `json:"last_cycle,omitempty"` // when the monitor last began looking for gaps
+}
+
+// serveMonitors responds with the query monitors that are running.
+func (qc *QueryCollector) serveMonitors(w http.ResponseWriter, r *http.Request) {
+	infos := []MonitorInfoJSON{}
+	qc.monitors.Range(func(key, value any) bool {
+		qm := value.(*QueryMonitor)
+		info := MonitorInfoJSON{
+			QueryID: qm.query.ID,
+			Name:    qm.query.Name,
+			Started: qm.started,
+		}
+		if ts := qm.lastCycle.Load(); ts != 0 {
+			t := time.Unix(ts, 0).UTC()
+			info.LastCycle = &t
+		}
+		infos = append(infos, info)
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].QueryID < infos[j].QueryID })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		slog.Error("failed to write monitors response", "error", err)
+	}
+}
+
+// serveCancelMonitor cancels the monitor of the query given by the id parameter. The monitor is started again
+// when the active queries are next polled.
+func (qc *QueryCollector) serveCancelMonitor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "id must be a query id", http.StatusBadRequest)
+		return
+	}
+	v, ok := qc.monitors.Load(id)
+	if !ok {
+		http.Error(w, "no monitor found for query", http.StatusNotFound)
+		return
+	}
+	slog.Warn("cancelling query monitor", "query_id", id)
+	v.(*QueryMonitor).cancel()
+	w.WriteHeader(http.StatusAccepted)
 }
 
 func (m *QueryMonitor) Run(ctx context.Context) error {
 	var err error
-	m.collectionCounter, err = prom.NewPrometheusCounter("query_collection_total", "Total number of collections made for a query", map[string]string{
+	m.collectionCounter, err = prom.NewPrometheusCounter(metricName("query_collection_total"), "Total number of collections made for a query", map[string]string{
 		"query_id": strconv.Itoa(m.query.ID),
+		"group":    m.query.Group,
 	})
 	if err != nil {
 		return fmt.Errorf("create active_queries gauge: %w", err)
 	}
-	m.errorCounter, err = prom.NewPrometheusCounter("query_error_total", "Total number of errors encountered when collecting for a query", map[string]string{
+	m.errorCounter, err = prom.NewPrometheusCounter(metricName("query_error_total"), "Total number of errors encountered when collecting for a query", map[string]string{
 		"query_id": strconv.Itoa(m.query.ID),
+		"group":    m.query.Group,
 	})
 	if err != nil {
 		return fmt.Errorf("create active_queries gauge: %w", err)
 	}
+	m.multipointCounter, err = prom.NewPrometheusCounter(metricName("query_multipoint_total"), "Total number of collections for a query that returned more than one point for a single series", map[string]string{
+		"query_id": strconv.Itoa(m.query.ID),
+		"group":    m.query.Group,
+	})
+	if err != nil {
+		return fmt.Errorf("create query_multipoint_total counter: %w", err)
+	}
+	m.lastCollectionAgeGauge, err = prom.NewPrometheusGauge(metricName("query_seconds_since_last_collection"), "Number of seconds since the end of the interval covered by the most recently collected sequence for a query", map[string]string{
+		"query_id": strconv.Itoa(m.query.ID),
+		"group":    m.query.Group,
+	})
+	if err != nil {
+		return fmt.Errorf("create query_seconds_since_last_collection gauge: %w", err)
+	}
+	m.cadenceRatioGauge, err = prom.NewPrometheusGauge(metricName("query_cadence_ratio"), "Mean time between the collection of recent sequences for a query relative to its interval, greater than one when collection is falling behind", map[string]string{
+		"query_id": strconv.Itoa(m.query.ID),
+		"group":    m.query.Group,
+	})
+	if err != nil {
+		return fmt.Errorf("create query_cadence_ratio gauge: %w", err)
+	}
 
-	return wait.Forever(ctx, m.MonitorQuery, 10*time.Second, 10*time.Minute, 0.5)
+	return wait.Forever(ctx, m.MonitorQuery, m.minInterval, m.maxInterval, m.jitter)
 }
 
 func (m *QueryMonitor) MonitorQuery(ctx context.Context) error {
+	m.lastCycle.Store(time.Now().Unix())
 	logger := slog.With("query_id", m.query.ID)
-	logger.Info("looking for collection gaps", "name", m.query.Name)
+	defer m.updateLastCollectionAge(ctx, logger)
+	defer m.updateCadence(ctx, logger)
+	if m.query.AllowPartial && !daemonOpts.dryRun {
+		defer m.collectProvisional(ctx, logger)
+	}
 
-	seqs, err := FindCollectionGaps(ctx, m.db, m.query.ID)
-	if err != nil {
-		return fmt.Errorf("find collection gaps: %w", err)
+	if until, cooling := m.cooloff.Until(m.query.ProviderID); cooling {
+		logger.Info("skipping collection while provider credentials are rejected", "provider_id", m.query.ProviderID, "until", until)
+		return nil
+	}
+
+	var seqs []int
+	if m.query.LatestOnly {
+		// history is not needed so only the most recent sequence is checked, avoiding a scan for gaps
+		seq := m.query.LatestSeq(time.Now().UTC())
+		if seq > 0 {
+			gap, err := IsCollectionGap(ctx, m.db, m.query.ID, seq)
+			if err != nil {
+				return fmt.Errorf("check latest sequence: %w", err)
+			}
+			if gap {
+				seqs = []int{seq}
+			}
+		}
+	} else {
+		logger.Info("looking for collection gaps", "name", m.query.Name)
+
+		maxEmptyAttempts := daemonOpts.maxEmptyAttempts
+		if daemonOpts.retryEmpty {
+			maxEmptyAttempts = 0
+		}
+		var err error
+		seqs, err = FindCollectionGaps(ctx, m.db, m.query.ID, maxEmptyAttempts)
+		if err != nil {
+			return fmt.Errorf("find collection gaps: %w", err)
+		}
+	}
+
+	if daemonOpts.gapLookback > 0 {
+		since := time.Now().UTC().Add(-daemonOpts.gapLookback)
+		if since.After(m.query.Start) {
+			from := m.query.SeqAfter(since)
+			if n := len(seqs); n > 0 {
+				seqs = filterSeqs(seqs, &from, nil)
+				if ignored := n - len(seqs); ignored > 0 {
+					logger.Debug("ignoring gaps outside of lookback", "count", ignored, "lookback", daemonOpts.gapLookback)
+				}
+			}
+		}
+	}
+
+	if m.query.OverwriteLookback > 0 && !daemonOpts.dryRun {
+		defer m.overwriteRecent(ctx, logger, seqs)
 	}
 
 	if len(seqs) == 0 {
 		logger.Info("no gaps found")
+		if !daemonOpts.dryRun {
+			m.clearError(ctx, logger)
+		}
 		return nil
 	}
 	logger.Info(fmt.Sprintf("found %d gaps to be collected", len(seqs)))
 
-	errsEncountered := 0
-	for i, seq := range seqs {
-		logger := logger.With("seq", seq, "time", m.query.SeqTime(seq))
-		if i > 0 {
-			if err := wait.WithJitter(ctx, 3*time.Second, 0.1); err != nil {
-				return err
+	if daemonOpts.newestFirst {
+		sort.Sort(sort.Reverse(sort.IntSlice(seqs)))
+	}
+
+	if max := daemonOpts.maxGapsPerCycle; max > 0 && len(seqs) > max {
+		logger.Info(fmt.Sprintf("filling %d gaps this cycle, leaving %d for later cycles", max, len(seqs)-max))
+		seqs = seqs[:max]
+	}
+
+	if daemonOpts.dryRun {
+		for _, seq := range seqs {
+			logger.Info("dry run: would fill gap", "seq", seq, "from", m.query.SeqTime(seq-1), "to", m.query.SeqTime(seq))
+		}
+		return nil
+	}
+
+	var (
+		errsEncountered atomic.Int64
+		stopped         atomic.Bool // set once the provider rejects its credentials
+		wg              sync.WaitGroup
+	)
+	work := make(chan int)
+	workers := daemonOpts.fillConcurrency
+	if workers > len(seqs) {
+		workers = len(seqs)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			filled := 0
+			for seq := range work {
+				if filled > 0 {
+					if err := wait.WithJitter(ctx, 3*time.Second, 0.1); err != nil {
+						continue // drain remaining work so the feeder is not blocked
+					}
+				}
+				if ctx.Err() != nil {
+					continue
+				}
+				filled++
+				errs, stop := m.fillGap(ctx, logger, seq)
+				errsEncountered.Add(int64(errs))
+				if stop {
+					stopped.Store(true)
+				}
 			}
+		}()
+	}
+
+feed:
+	for _, seq := range seqs {
+		if stopped.Load() {
+			break
 		}
-		logger.Info("filling gap")
-		m.collectionCounter.Inc()
-		points, err := DispatchQuery(ctx, m.query, seq, m.ps)
+		select {
+		case <-ctx.Done():
+			break feed
+		case work <- seq:
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if n := errsEncountered.Load(); n == 0 {
+		logger.Info("gap fill completed with no errors")
+		m.clearError(ctx, logger)
+	} else {
+		logger.Warn(fmt.Sprintf("gap fill completed with %d errors", n))
+	}
+	return nil
+}
+
+// fillGap collects and writes a single gap in the query's collection, returning the number of errors
+// encountered and whether gap filling should stop because the provider rejected its credentials. It is safe
+// to call concurrently for different sequences.
+func (m *QueryMonitor) fillGap(ctx context.Context, logger *slog.Logger, seq int) (int, bool) {
+	logger = logger.With("seq", seq, "time", m.query.SeqTime(seq))
+	logger.Info("filling gap")
+	m.collectionCounter.Inc()
+	points, err := m.dispatch(ctx, seq)
+	if err != nil {
+		logger.Error("failed to execute query", "error", err)
+		m.errorCounter.Inc()
+		m.reportError(ctx, logger, seq, err)
+		return 1, m.checkCredentials(logger, err)
+	}
+
+	if len(points) == 0 {
+		attempts, err := RecordEmptyCollection(ctx, m.db, m.query.ID, seq)
 		if err != nil {
-			logger.Error("failed to execute query", "error", err)
+			logger.Error("failed to record empty collection", "error", err)
+		}
+		logger.Error("no points found", "attempts", attempts)
+		m.errorCounter.Inc()
+		m.reportError(ctx, logger, seq, errors.New("no points found"))
+		return 1, false
+	}
+
+	if len(points) > 1 && !m.query.MultiSeries {
+		m.multipointCounter.Inc()
+		points, err = ResolveMultipoint(m.query, points)
+		if err != nil {
+			logger.Error(err.Error())
 			m.errorCounter.Inc()
-			errsEncountered++
-			continue
+			m.reportError(ctx, logger, seq, err)
+			return 1, false
 		}
+		logger.Warn("selected one of multiple points using query's multipoint policy", "policy", m.query.MultipointPolicy, "value", points[0].Value)
+	}
 
-		if len(points) == 0 {
-			logger.Error("no points found")
+	errs := 0
+	for _, pt := range points {
+		logger.Info("writing collection sequence", "value", pt.Value, "series", pt.Series, "staged", m.query.Staged)
+		if err := m.write(ctx, pt, false); err != nil {
+			logger.Error("failed to write collection sequence", "series", pt.Series, "error", err)
 			m.errorCounter.Inc()
-			errsEncountered++
+			m.reportError(ctx, logger, seq, fmt.Errorf("write collection sequence: %w", err))
+			errs++
 			continue
 		}
+		m.logCollection(ctx, logger, pt)
+	}
 
-		if len(points) > 1 {
-			logger.Error(fmt.Sprintf("too many points found: %d", len(points)))
+	if m.query.Rollup && !m.query.Staged {
+		if err := UpdateCollectionRollup(ctx, m.db, m.query, seq); err != nil {
+			logger.Error("failed to update collection rollup", "error", err)
+			m.errorCounter.Inc()
+			errs++
+		}
+	}
+	return errs, false
+}
+
+// collectProvisional collects a provisional value for the interval that is currently in progress,
+// replacing any provisional value collected for it previously.
+func (m *QueryMonitor) collectProvisional(ctx context.Context, logger *slog.Logger) {
+	seq := m.query.SeqAfter(time.Now().UTC())
+	logger = logger.With("seq", seq)
+
+	if _, cooling := m.cooloff.Until(m.query.ProviderID); cooling {
+		return
+	}
+
+	logger.Info("collecting provisional value")
+	m.collectionCounter.Inc()
+	points, err := m.dispatch(ctx, seq)
+	if err != nil {
+		logger.Error("failed to execute query", "error", err)
+		m.errorCounter.Inc()
+		m.checkCredentials(logger, err)
+		return
+	}
+
+	if len(points) > 1 && !m.query.MultiSeries {
+		m.multipointCounter.Inc()
+		points, err = ResolveMultipoint(m.query, points)
+		if err != nil {
+			logger.Error(err.Error())
+			m.errorCounter.Inc()
+			return
+		}
+	}
+
+	for _, pt := range points {
+		logger.Info("writing collection sequence", "value", pt.Value, "series", pt.Series, "provisional", pt.Provisional)
+		if err := WriteCollectionSeq(ctx, m.db, m.query.ID, pt, true); err != nil {
+			logger.Error("failed to write collection sequence", "series", pt.Series, "error", err)
 			m.errorCounter.Inc()
-			errsEncountered++
 			continue
 		}
+		m.logCollection(ctx, logger, pt)
+	}
+}
+
+// overwriteRecent re-collects the most recent completed sequences within the query's overwrite lookback and
+// replaces their values, so corrections made by the provider after a sequence was first collected are picked
+// up. Sequences in gaps were attempted earlier in the cycle and are skipped.
+func (m *QueryMonitor) overwriteRecent(ctx context.Context, logger *slog.Logger, gaps []int) {
+	last := m.query.SeqAfter(m.query.SettledTime(time.Now().UTC())) - 1
+	if m.query.Finish != nil && m.query.Finish.Before(time.Now()) {
+		last = m.query.SeqAfter(*m.query.Finish) - 1
+	}
+	first := last - m.query.OverwriteLookback + 1
+	if first < 1 {
+		first = 1
+	}
 
-		logger.Info("writing collection sequence", "value", points[0].Value)
-		if err := WriteCollectionSeq(ctx, m.db, m.query.ID, points[0].Seq, points[0].Value, false); err != nil {
-			logger.Error("failed to write collection sequence", "error", err)
+	skip := make(map[int]bool, len(gaps))
+	for _, seq := range gaps {
+		skip[seq] = true
+	}
+
+	for seq := first; seq <= last; seq++ {
+		if skip[seq] {
+			continue
+		}
+		logger := logger.With("seq", seq)
+		if err := wait.WithJitter(ctx, 3*time.Second, 0.1); err != nil {
+			return
+		}
+
+		if _, cooling := m.cooloff.Until(m.query.ProviderID); cooling {
+			return
+		}
+
+		logger.Info("re-collecting sequence to overwrite")
+		m.collectionCounter.Inc()
+		points, err := m.dispatch(ctx, seq)
+		if err != nil {
+			logger.Error("failed to execute query", "error", err)
 			m.errorCounter.Inc()
-			errsEncountered++
+			m.checkCredentials(logger, err)
 			continue
 		}
+		if len(points) == 0 {
+			// keep the existing value rather than discarding it
+			logger.Warn("no points found, keeping existing value")
+			continue
+		}
+
+		if len(points) > 1 && !m.query.MultiSeries {
+			m.multipointCounter.Inc()
+			points, err = ResolveMultipoint(m.query, points)
+			if err != nil {
+				logger.Error(err.Error())
+				m.errorCounter.Inc()
+				continue
+			}
+		}
+
+		for _, pt := range points {
+			logger.Info("overwriting collection sequence", "value", pt.Value, "series", pt.Series)
+			if err := m.write(ctx, pt, true); err != nil {
+				logger.Error("failed to write collection sequence", "series", pt.Series, "error", err)
+				m.errorCounter.Inc()
+				continue
+			}
+			m.logCollection(ctx, logger, pt)
+		}
+
+		if m.query.Rollup && !m.query.Staged {
+			if err := UpdateCollectionRollup(ctx, m.db, m.query, seq); err != nil {
+				logger.Error("failed to update collection rollup", "error", err)
+				m.errorCounter.Inc()
+			}
+		}
 	}
+}
 
-	if errsEncountered == 0 {
-		logger.Info("gap fill completed with no errors")
-	} else {
-		logger.Warn(fmt.Sprintf("gap fill completed with %d errors", errsEncountered))
+// reportError sends a collection failure to the error reporter and records it as the query's last error.
+func (m *QueryMonitor) reportError(ctx context.Context, logger *slog.Logger, seq int, err error) {
+	if m.reporter != nil && claimSideEffect(ctx, m.db, logger, SideEffectErrorReport, m.query, seq, err.Error()) {
+		m.reporter.Report(ctx, m.query, seq, err)
 	}
-	return nil
+	if err := SetQueryLastError(ctx, m.db, m.query.ID, fmt.Sprintf("seq %d: %v", seq, err)); err != nil {
+		logger.Error("failed to record last error", "error", err)
+	}
+}
+
+// clearError removes the query's last error once it has collected without errors.
+func (m *QueryMonitor) clearError(ctx context.Context, logger *slog.Logger) {
+	if err := ClearQueryLastError(ctx, m.db, m.query.ID); err != nil {
+		logger.Error("failed to clear last error", "error", err)
+	}
+}
+
+// checkCredentials starts a cool-off for the query's provider if err shows that its credentials were rejected,
+// reporting whether it did so.
+func (m *QueryMonitor) checkCredentials(logger *slog.Logger, err error) bool {
+	if !errors.Is(err, ErrCredentialsRejected) {
+		return false
+	}
+	until := m.cooloff.Start(m.query.ProviderID)
+	logger.Error("credentials rejected by provider, pausing collection for all of its queries", "provider_id", m.query.ProviderID, "until", until, "error", err)
+	return true
+}
+
+// write writes a collected point, to staging if the query's values must be promoted after review. Provisional
+// values are always written to the collection since they are replaced once the interval closes.
+func (m *QueryMonitor) write(ctx context.Context, pt DataPoint, force bool) error {
+	if m.query.Staged && !pt.Provisional {
+		return WriteStagedCollectionSeq(ctx, m.db, m.query.ID, pt)
+	}
+	return WriteCollectionSeq(ctx, m.db, m.query.ID, pt, force)
+}
+
+// logCollection records a written value in the collection log, if one is configured.
+func (m *QueryMonitor) logCollection(ctx context.Context, logger *slog.Logger, pt DataPoint) {
+	if m.clog == nil || !claimCollectionLog(ctx, m.db, logger, m.query, pt) {
+		return
+	}
+	if err := m.clog.Write(m.query.ID, pt); err != nil {
+		logger.Error("failed to write to collection log", "error", err)
+	}
+}
+
+// claimSideEffect claims the side effect of collecting seq for the query, reporting whether the caller should
+// emit it. Side effects that cannot be claimed because of a database error are emitted anyway since a
+// duplicate is preferable to losing one.
+func claimSideEffect(ctx context.Context, db *DB, logger *slog.Logger, kind string, qry *Query, seq int, details ...string) bool {
+	key, err := SideEffectKey(kind, qry, seq, details...)
+	if err != nil {
+		logger.Error("failed to compute idempotency key", "kind", kind, "seq", seq, "error", err)
+		return true
+	}
+	claimed, err := ClaimSideEffect(ctx, db, key, kind, qry.ID, seq)
+	if err != nil {
+		logger.Error("failed to claim side effect", "kind", kind, "seq", seq, "error", err)
+		return true
+	}
+	if !claimed {
+		logger.Debug("side effect already emitted", "kind", kind, "seq", seq)
+	}
+	return claimed
+}
+
+// claimCollectionLog claims the collection log entry for a written point. Each distinct value written for a
+// sequence and series is logged once, so updates to provisional values are still recorded.
+func claimCollectionLog(ctx context.Context, db *DB, logger *slog.Logger, qry *Query, pt DataPoint) bool {
+	return claimSideEffect(ctx, db, logger, SideEffectCollectionLog, qry, pt.Seq, pt.Series, formatFloat64(pt.Value), strconv.FormatBool(pt.Provisional))
+}
+
+// dispatch executes the monitored query for a sequence, once the provider rate limit allows, storing the raw
+// response if configured.
+func (m *QueryMonitor) dispatch(ctx context.Context, seq int) ([]DataPoint, error) {
+	if err := m.limiter.Wait(ctx, m.query.ProviderID); err != nil {
+		return nil, err
+	}
+	if daemonOpts.storeRaw {
+		return DispatchQueryStoringRaw(ctx, m.db, m.query, seq, m.ps)
+	}
+	return DispatchQuery(ctx, m.query, seq, m.ps)
+}
+
+// updateLastCollectionAge sets the gauge reporting how long ago the most recently collected sequence ended.
+// If nothing has been collected yet the age is measured from the start of the query.
+func (m *QueryMonitor) updateLastCollectionAge(ctx context.Context, logger *slog.Logger) {
+	seq, err := GetLastCollectionSeq(ctx, m.db, m.query.ID)
+	if err != nil {
+		logger.Error("failed to get last collection sequence", "error", err)
+		return
+	}
+
+	last := m.query.Start
+	if seq != nil {
+		last = m.query.SeqTime(*seq)
+	}
+	m.lastCollectionAgeGauge.Set(time.Since(last).Seconds())
+	m.lastCollected.Store(last.Unix())
+}
+
+// cadenceWindow is the number of intervals of a query over which its collection cadence is measured.
+const cadenceWindow = 30
+
+// updateCadence sets the gauge comparing the observed cadence of recent collections with the query's interval.
+// The gauge is left unchanged until at least two sequences have been collected within the window.
+func (m *QueryMonitor) updateCadence(ctx context.Context, logger *slog.Logger) {
+	since := time.Now().Add(-cadenceWindow * m.query.IntervalDuration())
+	c, err := GetCollectionCadence(ctx, m.db, m.query.ID, since)
+	if err != nil {
+		logger.Error("failed to get collection cadence", "error", err)
+		return
+	}
+	if c.Seqs < 2 {
+		return
+	}
+	m.cadenceRatioGauge.Set(c.Ratio(m.query))
+}
+
+// metricName returns the name of a metric with the configured prefix applied
+func metricName(name string) string {
+	return daemonOpts.metricsPrefix + name
 }
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestDBConnStr(t *testing.T) {
+	testCases := []struct {
+		name string
+		host string
+		port int
+		want string
+	}{
+		{
+			name: "socket directory",
+			host: "/var/run/postgresql",
+			port: 5432,
+			want: "host=/var/run/postgresql dbname=caracol sslmode=prefer user=caracol password=secret",
+		},
+		{
+			name: "tcp host",
+			host: "db.example.com",
+			port: 5433,
+			want: "host=db.example.com port=5433 dbname=caracol sslmode=prefer user=caracol password=secret",
+		},
+	}
+
+	saved := dbOpts
+	defer func() { dbOpts = saved }()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dbOpts.dbURL = ""
+			dbOpts.dbHost = tc.host
+			dbOpts.dbPort = tc.port
+			dbOpts.dbName = "caracol"
+			dbOpts.dbSSLMode = "prefer"
+			dbOpts.dbUser = "caracol"
+			dbOpts.dbPassword = "secret"
+
+			if got := dbConnStr(); got != tc.want {
+				t.Errorf("got %q, wanted %q", got, tc.want)
+			}
+		})
+	}
+}
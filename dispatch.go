@@ -5,62 +5,189 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/exp/slog"
 )
 
-func DispatchQuery(ctx context.Context, qry *Query, seq int, ps ProviderSecrets) ([]DataPoint, error) {
-	logger := slog.With("query_id", qry.ID, "query", qry.Name)
+// A QueryWindow is the time range queried for a sequence.
+type QueryWindow struct {
+	From        time.Time // start of the interval covered by the sequence
+	To          time.Time // end of the interval covered by the sequence
+	QueryTime   time.Time // end of the range sent to the provider, earlier than To when provisional
+	Provisional bool      // true when the interval has not yet closed
+}
 
-	start := qry.Start.UTC()
-	var fromTime time.Time
-	var toTime time.Time
-
-	switch qry.Interval {
-	case QueryIntervalHourly:
-		fromTime = start.Add(time.Duration(seq-1) * time.Hour)
-		toTime = fromTime.Add(time.Hour)
-	case QueryIntervalDaily:
-		fromTime = start.Add(time.Duration(seq-1) * time.Hour * 24)
-		toTime = fromTime.Add(time.Hour * 24)
-	case QueryIntervalWeekly:
-		fromTime = start.Add(time.Duration(seq-1) * time.Hour * 24 * 7)
-		toTime = fromTime.Add(time.Hour * 24 * 7)
-	default:
-		return nil, fmt.Errorf("unsupported query interval: %q", qry.Interval)
+// Matches reports whether a point returned by the provider at t belongs to the window.
+func (w QueryWindow) Matches(t time.Time) bool {
+	return t.Equal(w.QueryTime) || t.Equal(w.To)
+}
+
+// SeqWindow computes the time range queried for a sequence of the query.
+func SeqWindow(qry *Query, seq int) (QueryWindow, error) {
+	var w QueryWindow
+
+	if qry.IntervalDuration() == 0 {
+		return w, fmt.Errorf("unsupported query interval: %q", qry.Interval)
+	}
+	w.From = qry.SeqTime(seq - 1)
+	w.To = qry.SeqTime(seq)
+
+	// the query time is earlier than the end of the interval when collecting a provisional value for an
+	// interval that has not yet closed
+	w.QueryTime = w.To
+	if qry.AllowPartial {
+		now := time.Now().UTC().Truncate(time.Second)
+		if now.Before(w.To) {
+			if !now.After(w.From) {
+				return w, fmt.Errorf("interval for seq %d has not started", seq)
+			}
+			w.QueryTime = now
+			w.Provisional = true
+		}
+	}
+
+	return w, nil
+}
+
+// ProviderHTTPOptions returns the options for requests made to a provider, applying the provider's overrides
+// of the default request timeout and retries and expanding its headers.
+func ProviderHTTPOptions(requestTimeoutSecs *int, maxRetries *int, extraHeaders map[string]string) (HTTPOptions, error) {
+	hopts := HTTPOptions{
+		Timeout:    httpOpts.requestTimeout,
+		MaxRetries: httpOpts.maxRetries,
+		MaxPoints:  httpOpts.maxPoints,
+	}
+	if requestTimeoutSecs != nil {
+		hopts.Timeout = time.Duration(*requestTimeoutSecs) * time.Second
+	}
+	if maxRetries != nil {
+		hopts.MaxRetries = *maxRetries
+	}
+	headers, err := ExpandHeaders(extraHeaders)
+	if err != nil {
+		return HTTPOptions{}, fmt.Errorf("provider headers: %w", err)
+	}
+	hopts.Headers = headers
+	return hopts, nil
+}
+
+// NewQuerier creates the querier for the query's provider.
+func NewQuerier(ctx context.Context, qry *Query, ps ProviderSecrets) (Querier, error) {
+	hopts, err := ProviderHTTPOptions(qry.RequestTimeoutSecs, qry.MaxRetries, qry.ExtraHeaders)
+	if err != nil {
+		return nil, err
 	}
 
-	var querier Querier
 	switch qry.ApiType {
 	case ApiTypeGrafanaCloud:
-		var err error
-		querier, err = NewGrafanaCloudQuerier(qry.ApiURL, qry.Dataset, qry.QueryType, ps[SecretTypeBearerToken])
+		querier, err := NewGrafanaCloudQuerier(qry.ApiURL, qry.Dataset, grafanaDatasourceType(qry), HTTPAuth{AuthType: qry.AuthType, Secrets: ps}, hopts, qry.MultiSeries)
 		if err != nil {
 			return nil, fmt.Errorf("grafanacloud querier: %w", err)
 		}
+		return querier, nil
 	case ApiTypeElasticSearch:
 		switch qry.QueryType {
 		case QueryTypeElasticSearchAggregate:
-			var err error
-			querier, err = NewElasticSearchAggregateQuerier(qry.ApiURL, qry.Dataset, ps[SecretTypeUsername], ps[SecretTypePassword])
+			querier, err := NewElasticSearchAggregateQuerier(qry.ApiURL, qry.Dataset, HTTPAuth{AuthType: qry.AuthType, Secrets: ps}, hopts)
 			if err != nil {
 				return nil, fmt.Errorf("grafanacloud querier: %w", err)
 			}
-
+			return querier, nil
+		case QueryTypeElasticSearchCount:
+			querier, err := NewElasticSearchCountQuerier(qry.ApiURL, qry.Dataset, HTTPAuth{AuthType: qry.AuthType, Secrets: ps}, hopts)
+			if err != nil {
+				return nil, fmt.Errorf("elasticsearch count querier: %w", err)
+			}
+			return querier, nil
 		default:
 			return nil, fmt.Errorf("unsupported collection type: %q", qry.ApiType)
-
 		}
 	case ApiTypeCloudWatch:
-		var err error
-		querier, err = NewCloudWatchQuerier(ctx, ps[SecretTypeRegion], ps[SecretTypeAccessKeyID], ps[SecretTypeSecretAccessKey])
+		// the source dataset names the region, falling back to the provider's region when empty
+		if qry.QueryType == QueryTypeCloudWatchLogs {
+			querier, err := NewCloudWatchLogsQuerier(ctx, qry.AuthType, ps, strings.TrimSpace(qry.Dataset), hopts)
+			if err != nil {
+				return nil, fmt.Errorf("cloudwatch logs querier: %w", err)
+			}
+			return querier, nil
+		}
+		querier, err := NewCloudWatchQuerier(ctx, qry.AuthType, ps, strings.TrimSpace(qry.Dataset), hopts.MaxPoints)
 		if err != nil {
 			return nil, fmt.Errorf("cloudwatch querier: %w", err)
 		}
+		return querier, nil
+	case ApiTypePrometheus:
+		// the tenant for multi-tenant backends is taken from the provider's secrets, falling back to the source dataset
+		tenant := ps[SecretTypeTenantID]
+		if tenant == "" {
+			tenant = qry.Dataset
+		}
+		querier, err := NewPrometheusQuerier(qry.ApiURL, tenant, HTTPAuth{AuthType: qry.AuthType, Secrets: ps}, hopts, qry.MultiSeries)
+		if err != nil {
+			return nil, fmt.Errorf("prometheus querier: %w", err)
+		}
+		return querier, nil
+	case ApiTypeGrafanaProxy:
+		// the source dataset is the numeric id of the prometheus datasource
+		querier, err := NewGrafanaProxyQuerier(qry.ApiURL, qry.Dataset, HTTPAuth{AuthType: qry.AuthType, Secrets: ps}, hopts, qry.MultiSeries)
+		if err != nil {
+			return nil, fmt.Errorf("grafana proxy querier: %w", err)
+		}
+		return querier, nil
+	case ApiTypeHTTP:
+		querier, err := NewHTTPQuerier(qry.ApiURL, HTTPAuth{AuthType: qry.AuthType, Secrets: ps}, hopts)
+		if err != nil {
+			return nil, fmt.Errorf("http querier: %w", err)
+		}
+		return querier, nil
+	case ApiTypeFixture:
+		querier, err := NewFixtureQuerier(qry.Dataset)
+		if err != nil {
+			return nil, fmt.Errorf("fixture querier: %w", err)
+		}
+		return querier, nil
 	default:
 		return nil, fmt.Errorf("unsupported datasource type: %q", qry.ApiType)
 	}
+}
+
+// ExecuteWindow executes the query for the window using the querier, returning every point the provider returned.
+// The values of the points are transformed by the query's scale and offset, so collections always store values
+// in the converted units and readers never need to know about the conversion.
+func ExecuteWindow(ctx context.Context, querier Querier, qry *Query, w QueryWindow) ([]DataPoint, error) {
+	factor := qry.IntervalFactor
+	if factor < 1 {
+		factor = 1
+	}
+	points, err := querier.Execute(ctx, qry.Query, w.From, w.QueryTime, qry.Interval, factor)
+	if err != nil {
+		return nil, fmt.Errorf("source execute: %w", err)
+	}
+	for i := range points {
+		points[i].Value = qry.TransformValue(points[i].Value)
+	}
+	return points, nil
+}
+
+func DispatchQuery(ctx context.Context, qry *Query, seq int, ps ProviderSecrets) ([]DataPoint, error) {
+	logger := slog.With("query_id", qry.ID, "query", qry.Name)
+
+	w, err := SeqWindow(qry, seq)
+	if err != nil {
+		return nil, err
+	}
+	fromTime, toTime, queryTime, provisional := w.From, w.To, w.QueryTime, w.Provisional
+
+	if qry.Align && !qry.StartAligned() {
+		logger.Warn("query start is not aligned to its interval, data points returned by the provider may not match the expected times and the query start should be corrected", "start", qry.Start.UTC().Format("2006-01-02T15:04:05Z"), "interval", qry.IntervalString())
+	}
+
+	querier, err := NewQuerier(ctx, qry, ps)
+	if err != nil {
+		return nil, err
+	}
 
 	// case QueryIntervalWeek:
 	// 	fromTime = StartOfWeek(fromTime)
@@ -69,29 +196,96 @@ func DispatchQuery(ctx context.Context, qry *Query, seq int, ps ProviderSecrets)
 	// 	return nil, fmt.Errorf("unsupported interval: %q", qry.AggregateInterval)
 	// }
 
-	logger.Info("executing query", "from", fromTime.Format("2006-01-02T15:04:05Z"), "to", toTime.Format("2006-01-02T15:04:05Z"))
-	points, err := querier.Execute(ctx, qry.Query, fromTime, toTime, qry.Interval)
+	logger.Info("executing query", "from", fromTime.Format("2006-01-02T15:04:05Z"), "to", queryTime.Format("2006-01-02T15:04:05Z"), "provisional", provisional)
+	points, err := ExecuteWindow(ctx, querier, qry, w)
 	if err != nil {
-		return nil, fmt.Errorf("source execute: %w", err)
+		return nil, err
+	}
+
+	if qry.MultiSeries {
+		// Keep one point per series, each is stored as a separate collection stream
+		var matched []DataPoint
+		for _, pt := range points {
+			logger.Debug("received data point", "time", pt.Time.Format("2006-01-02T15:04:05Z"), "value", pt.Value, "series", pt.Series)
+			if w.Matches(pt.Time) {
+				matched = append(matched, DataPoint{
+					Seq:         seq,
+					Time:        toTime,
+					Value:       pt.Value,
+					Series:      pt.Series,
+					Provisional: provisional,
+				})
+			}
+		}
+		if len(matched) == 0 {
+			logger.Warn("query did not return expected data point", "seq", seq, "time", queryTime.Format("2006-01-02T15:04:05Z"))
+		}
+		return matched, nil
 	}
 
 	// We may get more points than needed depending on the query capabilities
+	matched := []DataPoint{}
 	for _, pt := range points {
 		logger.Debug("received data point", "time", pt.Time.Format("2006-01-02T15:04:05Z"), "value", pt.Value)
-		if pt.Time.Equal(toTime) {
-			return []DataPoint{
-				{
-					Seq:   seq,
-					Time:  pt.Time,
-					Value: pt.Value,
-				},
-			}, nil
+		if w.Matches(pt.Time) {
+			matched = append(matched, DataPoint{
+				Seq:         seq,
+				Time:        toTime,
+				Value:       pt.Value,
+				Provisional: provisional,
+			})
 		}
 	}
 
-	logger.Warn("query did not return expected data point", "seq", seq, "time", toTime.Format("2006-01-02T15:04:05Z"))
+	switch len(matched) {
+	case 0:
+		logger.Warn("query did not return expected data point", "seq", seq, "time", queryTime.Format("2006-01-02T15:04:05Z"))
+	case 1:
+	default:
+		// usually caused by a query that does not aggregate away all of its labels
+		logger.Warn("query returned more than one data point for the interval", "seq", seq, "matched", len(matched), "returned", len(points), "times", distinctTimes(points), "policy", qry.MultipointPolicy)
+	}
+
+	return matched, nil
+}
 
-	return []DataPoint{}, nil
+// ResolveMultipoint applies the multipoint policy of a query that collects a single series to the points
+// collected for an interval, returning an error if the policy does not permit more than one point.
+func ResolveMultipoint(qry *Query, points []DataPoint) ([]DataPoint, error) {
+	if qry.MultiSeries || len(points) <= 1 {
+		return points, nil
+	}
+
+	switch qry.MultipointPolicy {
+	case MultipointPolicyFirst:
+		return points[:1], nil
+	case MultipointPolicyLast:
+		return points[len(points)-1:], nil
+	case MultipointPolicyMax:
+		max := 0
+		for i := range points {
+			if points[i].Value > points[max].Value {
+				max = i
+			}
+		}
+		return points[max : max+1], nil
+	default:
+		return nil, fmt.Errorf("too many points found: %d", len(points))
+	}
+}
+
+// distinctTimes returns the distinct times of the points, formatted for logging.
+func distinctTimes(points []DataPoint) []string {
+	var times []string
+	seen := make(map[time.Time]bool)
+	for _, pt := range points {
+		if seen[pt.Time] {
+			continue
+		}
+		seen[pt.Time] = true
+		times = append(times, pt.Time.Format("2006-01-02T15:04:05Z"))
+	}
+	return times
 }
 
 func formatFloat64(v float64) string {
@@ -102,3 +296,17 @@ func formatFloat64(v float64) string {
 		return fmt.Sprintf("%e", v)
 	}
 }
+
+// grafanaDatasourceType returns the type of the Grafana datasource to be queried, mapping from the query
+// type when the source does not specify one.
+func grafanaDatasourceType(qry *Query) string {
+	if qry.DatasourceType != "" {
+		return qry.DatasourceType
+	}
+	switch qry.QueryType {
+	case QueryTypePrometheus:
+		return "prometheus"
+	default:
+		return string(qry.QueryType)
+	}
+}
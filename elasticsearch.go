@@ -8,11 +8,59 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"golang.org/x/exp/slog"
 )
 
+// maxElasticSearchIndices is the maximum number of indices a dated index pattern may expand to for a single query.
+const maxElasticSearchIndices = 400
+
+// elasticSearchURL returns the url of an elasticsearch api endpoint, such as _search, for the index of a
+// source. The index may be a comma separated list or a wildcard, which elasticsearch resolves itself, or a
+// dated pattern such as logs-{2006.01.02} in which the part in braces is a Go time layout. A dated pattern
+// is expanded to the comma separated list of the indices for each day in the time range, so that a window
+// spanning index rollover, such as a week of daily indices, sees every relevant document. Indices in a list
+// that do not exist are ignored.
+func elasticSearchURL(api string, index string, endpoint string, fromTime, toTime time.Time) (string, error) {
+	u, err := url.Parse(api)
+	if err != nil {
+		return "", fmt.Errorf("invalid api url: %w", err)
+	}
+
+	if open := strings.Index(index, "{"); open >= 0 {
+		end := strings.Index(index[open:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("invalid index pattern %q: missing closing brace", index)
+		}
+		end += open
+		layout := index[open+1 : end]
+
+		var indices []string
+		seen := make(map[string]bool)
+		day := fromTime.UTC().Truncate(24 * time.Hour)
+		for ; day.Before(toTime); day = day.Add(24 * time.Hour) {
+			name := index[:open] + day.Format(layout) + index[end+1:]
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			indices = append(indices, name)
+			if len(indices) > maxElasticSearchIndices {
+				return "", fmt.Errorf("index pattern %q covers more than %d indices", index, maxElasticSearchIndices)
+			}
+		}
+		index = strings.Join(indices, ",")
+	}
+
+	u.Path = fmt.Sprintf("/%s/%s", index, endpoint)
+	if strings.Contains(index, ",") {
+		u.RawQuery = "ignore_unavailable=true"
+	}
+	return u.String(), nil
+}
+
 // An ElasticSearchAggregateQuerier performs aggregate queries against an elasticsearch index
 // The query should be a metric aggregation in the format '"aggregate function": { params }'
 // The query should be unmarshable into the ElasticSearchAggregateQueryJSON type
@@ -22,50 +70,74 @@ import (
 //
 // See https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics.html
 type ElasticSearchAggregateQuerier struct {
-	api      string
-	index    string
-	username string
-	password string
+	api   string
+	index string
+	auth  HTTPAuth
+	opts  HTTPOptions
 }
 
 var _ Querier = (*ElasticSearchAggregateQuerier)(nil)
 
-func NewElasticSearchAggregateQuerier(api string, index string, username string, password string) (*ElasticSearchAggregateQuerier, error) {
+func NewElasticSearchAggregateQuerier(api string, index string, auth HTTPAuth, opts HTTPOptions) (*ElasticSearchAggregateQuerier, error) {
 	u, err := url.Parse(api)
 	if err != nil {
 		return nil, fmt.Errorf("invalid api url: %w", err)
 	}
 
-	u.Path = fmt.Sprintf("/%s/_search", index)
-
 	return &ElasticSearchAggregateQuerier{
-		api:      u.String(),
-		index:    index,
-		username: username,
-		password: password,
+		api:   u.String(),
+		index: index,
+		auth:  auth,
+		opts:  opts,
 	}, nil
 }
 
-func (e *ElasticSearchAggregateQuerier) Execute(ctx context.Context, query string, fromTime, toTime time.Time, interval QueryInterval) ([]DataPoint, error) {
-	var qry ElasticSearchAggregateQueryJSON
-	if err := json.Unmarshal([]byte(query), &qry); err != nil {
-		return nil, fmt.Errorf("invalid query %q: %w", query, err)
+func (e *ElasticSearchAggregateQuerier) Execute(ctx context.Context, query string, fromTime, toTime time.Time, interval QueryInterval, factor int) ([]DataPoint, error) {
+	qry, err := ParseElasticSearchAggregateQuery(query)
+	if err != nil {
+		return nil, err
 	}
 
-	var calendarInterval string
+	// calendar intervals only support a single unit so multiples use a fixed interval, which
+	// elasticsearch aligns to the epoch
+	var calendarInterval, fixedInterval string
 	switch interval {
 	case QueryIntervalWeekly:
 		calendarInterval = "week"
+		fixedInterval = fmt.Sprintf("%dd", 7*factor)
 	case QueryIntervalDaily:
 		calendarInterval = "day"
+		fixedInterval = fmt.Sprintf("%dd", factor)
 	case QueryIntervalHourly:
 		calendarInterval = "hour"
+		fixedInterval = fmt.Sprintf("%dh", factor)
+	case QueryIntervalMonthly:
+		// months vary in length so cannot be expressed as a fixed interval
+		if factor > 1 {
+			return nil, fmt.Errorf("multiples of monthly intervals are not supported")
+		}
+		calendarInterval = "month"
 	default:
 		return nil, fmt.Errorf("unsupported query interval: %q", interval)
 	}
+	if factor > 1 {
+		calendarInterval = ""
+	} else {
+		fixedInterval = ""
+	}
+
+	// at least one bucket is returned for each interval in the range
+	if d := interval.Duration() * time.Duration(factor); d > 0 {
+		if err := e.opts.checkMaxPoints(int(toTime.Sub(fromTime) / d)); err != nil {
+			return nil, err
+		}
+	}
+
+	// queries whose start is not aligned to the interval need buckets offset to match their windows
+	offset := histogramOffset(fromTime, interval.Duration()*time.Duration(factor), calendarInterval)
 
 	in := &ElasticSearchAggregateRequestJSON{
-		Size: 0,
+		Size: 0, // only the aggregation is needed, not the matching documents
 		Query: ElasticSearchAggregateQueryParamsJSON{
 			Range: ElasticSearchAggregateRangeJSON{
 				Timestamp: ElasticSearchAggregateRangeTimestampJSON{
@@ -79,6 +151,8 @@ func (e *ElasticSearchAggregateQuerier) Execute(ctx context.Context, query strin
 				DateHistogram: ElasticSearchAggregateDateHistogramJSON{
 					Field:            "@timestamp",
 					CalendarInterval: calendarInterval,
+					FixedInterval:    fixedInterval,
+					Offset:           offset,
 					Order: ElasticSearchAggregateDateHistogramOrderJSON{
 						Key: "desc",
 					},
@@ -96,22 +170,26 @@ func (e *ElasticSearchAggregateQuerier) Execute(ctx context.Context, query strin
 	}
 	slog.Debug("sending request", "body", buf.String())
 
-	hc := http.Client{}
-	req, err := http.NewRequest("POST", e.api, buf)
+	target, err := elasticSearchURL(e.api, e.index, "_search", fromTime, toTime)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new request: %w", err)
+		return nil, err
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req.SetBasicAuth(e.username, e.password)
 
-	resp, err := hc.Do(req)
+	reqBody := buf.Bytes()
+	resp, err := sendRequest(ctx, e.opts, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "application/json")
+		if err := e.auth.Apply(req); err != nil {
+			return nil, err
+		}
+		return req, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("request failed: %s", resp.Status)
-	}
-
 	defer resp.Body.Close()
 	// read body fully so we have it for diagnosis during development
 	body, err := io.ReadAll(resp.Body)
@@ -119,6 +197,10 @@ func (e *ElasticSearchAggregateQuerier) Execute(ctx context.Context, query strin
 		return nil, fmt.Errorf("failed to read body request: %w", err)
 	}
 	slog.Debug("received response", "body", string(body))
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, body)
+	}
+	recordResponse(ctx, body)
 
 	var out ElasticSearchAggregateResponseJSON
 	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&out); err != nil {
@@ -134,36 +216,93 @@ func (e *ElasticSearchAggregateQuerier) Execute(ctx context.Context, query strin
 		return nil, fmt.Errorf(`expected aggregation "A" not found`)
 	}
 
-	if len(agg.Buckets) != 1 {
-		return nil, fmt.Errorf("unexpected number of aggregation buckets found: %d", len(agg.Buckets))
+	if err := e.opts.checkMaxPoints(len(agg.Buckets)); err != nil {
+		return nil, err
 	}
 
-	bucket := agg.Buckets[0]
-
-	valueTime, err := time.Parse("2006-01-02T15:04:05.999Z", bucket.KeyAsString)
-	if err != nil {
-		return nil, fmt.Errorf("invalid time in response %q: %w", bucket.KeyAsString, err)
+	// no buckets are returned when no documents match the time range
+	if len(agg.Buckets) == 0 {
+		slog.Debug("no aggregation buckets found")
+		return []DataPoint{}, nil
 	}
 
-	if !valueTime.Equal(fromTime) {
-		return nil, fmt.Errorf("unexpected time in response %q (expected %q)", valueTime.Format("2006-01-02T15:04:05.999Z"), fromTime.Format("2006-01-02T15:04:05.999Z"))
+	// one point is returned for each bucket, leaving the caller to select the one it needs. Edge buckets may be
+	// returned that only partially overlap the time range.
+	points := []DataPoint{}
+	for _, bucket := range agg.Buckets {
+		// a bucket with no documents has no meaningful aggregate value, metric aggregations report null for it
+		if bucket.DocCount == 0 || bucket.Result.Value == nil {
+			slog.Debug("aggregation bucket contains no documents", "key", bucket.KeyAsString)
+			continue
+		}
+
+		bucketStart, err := bucket.StartTime()
+		if err != nil {
+			return nil, err
+		}
+
+		point := DataPoint{
+			// elasticsearch returns the start of the bucket as the key, but our convention is to use the end time
+			Time: bucketEndTime(bucketStart, interval, factor),
+		}
+
+		switch tv := bucket.Result.Value.(type) {
+		case float64:
+			point.Value = tv
+		case int64:
+			point.Value = float64(tv)
+		default:
+			return nil, fmt.Errorf("unexpected value type in aggregation: %T", bucket.Result.Value)
+		}
+
+		points = append(points, point)
 	}
 
-	point := DataPoint{
-		// elasticsearch returns the start of the range as the key, but our convention is to use the end time
-		Time: toTime,
+	return points, nil
+}
+
+// histogramOffset returns the offset of a date histogram whose buckets start at from, or an empty string when
+// the buckets are already aligned. Elasticsearch aligns fixed intervals to the epoch, calendar weeks to Mondays
+// and calendar months to the first day of the month.
+func histogramOffset(from time.Time, d time.Duration, calendarInterval string) string {
+	if calendarInterval == "month" {
+		if off := int64(from.Sub(TruncateInterval(from, QueryIntervalMonthly, 1)) / time.Second); off > 0 {
+			return fmt.Sprintf("+%ds", off)
+		}
+		return ""
+	}
+	secs := int64(d / time.Second)
+	if secs <= 0 {
+		return ""
+	}
+	t := from.Unix()
+	if calendarInterval == "week" {
+		t -= 4 * 24 * 60 * 60 // the epoch was a thursday
+	}
+	off := t % secs
+	if off < 0 {
+		off += secs
+	}
+	if off == 0 {
+		return ""
 	}
+	return fmt.Sprintf("+%ds", off)
+}
 
-	switch tv := bucket.Result.Value.(type) {
-	case float64:
-		point.Value = tv
-	case int64:
-		point.Value = float64(tv)
+// bucketEndTime returns the end of the date histogram bucket starting at start.
+func bucketEndTime(start time.Time, interval QueryInterval, factor int) time.Time {
+	switch interval {
+	case QueryIntervalHourly:
+		return start.Add(time.Duration(factor) * time.Hour)
+	case QueryIntervalDaily:
+		return start.AddDate(0, 0, factor)
+	case QueryIntervalWeekly:
+		return start.AddDate(0, 0, 7*factor)
+	case QueryIntervalMonthly:
+		return start.AddDate(0, factor, 0)
 	default:
-		return nil, fmt.Errorf("unexpected value type in aggregation: %T", bucket.Result.Value)
+		return start
 	}
-
-	return []DataPoint{point}, nil
 }
 
 type ElasticSearchAggregateRequestJSON struct {
@@ -192,7 +331,9 @@ type ElasticSearchAggregateAggJSON struct {
 
 type ElasticSearchAggregateDateHistogramJSON struct {
 	Field            string                                       `json:"field"`
-	CalendarInterval string                                       `json:"calendar_interval"`
+	CalendarInterval string                                       `json:"calendar_interval,omitempty"`
+	FixedInterval    string                                       `json:"fixed_interval,omitempty"`
+	Offset           string                                       `json:"offset,omitempty"`
 	Order            ElasticSearchAggregateDateHistogramOrderJSON `json:"order"`
 }
 
@@ -200,10 +341,37 @@ type ElasticSearchAggregateDateHistogramOrderJSON struct {
 	Key string `json:"_key"`
 }
 
+// ElasticSearchAggregateQueryJSON is the metric aggregation applied to the documents in each bucket. Exactly one
+// aggregation must be set, each of which reports its result in a single value field.
+// see https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics.html
 type ElasticSearchAggregateQueryJSON struct {
 	Cardinality map[string]any `json:"cardinality,omitempty"`
-	// TODO: support other aggregate query types such as max/min
-	// see https://www.elastic.co/guide/en/elasticsearch/reference/current/search-aggregations-metrics.html
+	Max         map[string]any `json:"max,omitempty"`
+	Min         map[string]any `json:"min,omitempty"`
+	Avg         map[string]any `json:"avg,omitempty"`
+	Sum         map[string]any `json:"sum,omitempty"`
+}
+
+// ParseElasticSearchAggregateQuery parses the metric aggregation of an elasticsearch aggregate query, such as
+// {"avg":{"field":"duration_ms"}}, checking that it contains exactly one supported aggregation.
+func ParseElasticSearchAggregateQuery(query string) (ElasticSearchAggregateQueryJSON, error) {
+	var qry ElasticSearchAggregateQueryJSON
+	dec := json.NewDecoder(strings.NewReader(query))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&qry); err != nil {
+		return qry, fmt.Errorf("invalid query %q: %w", query, err)
+	}
+
+	n := 0
+	for _, agg := range []map[string]any{qry.Cardinality, qry.Max, qry.Min, qry.Avg, qry.Sum} {
+		if len(agg) > 0 {
+			n++
+		}
+	}
+	if n != 1 {
+		return qry, fmt.Errorf("invalid query %q: must contain exactly one of 'cardinality','max','min','avg','sum'", query)
+	}
+	return qry, nil
 }
 
 type ElasticSearchAggregateResponseJSON struct {
@@ -225,3 +393,16 @@ type ElasticSearchAggregateBucketJSON struct {
 type ElasticSearchAggregateResultJSON struct {
 	Value any `json:"value"`
 }
+
+// StartTime returns the start of the time range covered by the bucket, preferring the numeric key in
+// milliseconds since the epoch over the formatted key.
+func (b ElasticSearchAggregateBucketJSON) StartTime() (time.Time, error) {
+	if ms, ok := b.Key.(float64); ok {
+		return time.UnixMilli(int64(ms)).UTC(), nil
+	}
+	t, err := time.Parse("2006-01-02T15:04:05.999Z", b.KeyAsString)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time in response %q: %w", b.KeyAsString, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// An ElasticSearchCountQuerier counts the documents in an elasticsearch index that fall within the time range
+// using the _count api, which avoids the cost of an aggregation when only the number of documents is needed.
+// The query is an optional elasticsearch query clause that documents must also match, for example:
+//
+//	{ "term": {"agent": "kubo"} }
+//
+// An empty query counts all documents in the time range. The count is returned as a single point at the end
+// of the time range.
+type ElasticSearchCountQuerier struct {
+	api   string
+	index string
+	auth  HTTPAuth
+	opts  HTTPOptions
+}
+
+var _ Querier = (*ElasticSearchCountQuerier)(nil)
+
+func NewElasticSearchCountQuerier(api string, index string, auth HTTPAuth, opts HTTPOptions) (*ElasticSearchCountQuerier, error) {
+	u, err := url.Parse(api)
+	if err != nil {
+		return nil, fmt.Errorf("invalid api url: %w", err)
+	}
+
+	return &ElasticSearchCountQuerier{
+		api:   u.String(),
+		index: index,
+		auth:  auth,
+		opts:  opts,
+	}, nil
+}
+
+func (e *ElasticSearchCountQuerier) Execute(ctx context.Context, query string, fromTime, toTime time.Time, interval QueryInterval, factor int) ([]DataPoint, error) {
+	filter := []any{
+		map[string]any{
+			"range": ElasticSearchAggregateRangeJSON{
+				Timestamp: ElasticSearchAggregateRangeTimestampJSON{
+					Gte: fromTime,
+					Lt:  toTime,
+				},
+			},
+		},
+	}
+	if query = strings.TrimSpace(query); query != "" {
+		var clause json.RawMessage
+		if err := json.Unmarshal([]byte(query), &clause); err != nil {
+			return nil, fmt.Errorf("invalid query %q: %w", query, err)
+		}
+		filter = append(filter, clause)
+	}
+
+	in := ElasticSearchCountRequestJSON{
+		Query: map[string]any{
+			"bool": map[string]any{
+				"filter": filter,
+			},
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(in); err != nil {
+		return nil, fmt.Errorf("failed to encode query request: %w", err)
+	}
+	slog.Debug("sending request", "body", buf.String())
+
+	target, err := elasticSearchURL(e.api, e.index, "_count", fromTime, toTime)
+	if err != nil {
+		return nil, err
+	}
+
+	reqBody := buf.Bytes()
+	resp, err := sendRequest(ctx, e.opts, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "application/json")
+		if err := e.auth.Apply(req); err != nil {
+			return nil, err
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, body)
+	}
+	slog.Debug("received response", "body", string(body))
+	recordResponse(ctx, body)
+
+	var out ElasticSearchCountResponseJSON
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to decode query response: %w", err)
+	}
+
+	if out.Shards.Failed > 0 {
+		return nil, fmt.Errorf("count failed on %d of %d shards", out.Shards.Failed, out.Shards.Total)
+	}
+
+	return []DataPoint{
+		{
+			Time:  toTime,
+			Value: float64(out.Count),
+		},
+	}, nil
+}
+
+type ElasticSearchCountRequestJSON struct {
+	Query map[string]any `json:"query"`
+}
+
+type ElasticSearchCountResponseJSON struct {
+	Count  int64                        `json:"count"`
+	Shards ElasticSearchCountShardsJSON `json:"_shards"`
+}
+
+type ElasticSearchCountShardsJSON struct {
+	Total  int `json:"total"`
+	Failed int `json:"failed"`
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestElasticSearchAggregateZeroDocuments(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"timed_out": false,
+			"aggregations": {
+				"A": {
+					"buckets": [
+						{"key_as_string": "2024-01-01T00:00:00.000Z", "key": 1704067200000, "doc_count": 0, "result": {"value": null}}
+					]
+				}
+			}
+		}`))
+	}))
+	defer srv.Close()
+
+	e, err := NewElasticSearchAggregateQuerier(srv.URL, "logs", HTTPAuth{AuthType: AuthTypeNone}, HTTPOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error creating querier: %v", err)
+	}
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	points, err := e.Execute(context.Background(), `{"cardinality": {"field": "peer"}}`, from, from.Add(24*time.Hour), QueryIntervalDaily, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if points == nil || len(points) != 0 {
+		t.Errorf("got points %v, wanted an empty slice", points)
+	}
+}
+
+func TestElasticSearchURL(t *testing.T) {
+	testCases := []struct {
+		name    string
+		index   string
+		from    time.Time
+		to      time.Time
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "plain index",
+			index: "logs",
+			from:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:    time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC),
+			want:  "http://es.example.com/logs/_search",
+		},
+		{
+			name:  "single day pattern",
+			index: "logs-{2006.01.02}",
+			from:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:    time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+			want:  "http://es.example.com/logs-2024.01.01/_search",
+		},
+		{
+			name:  "week spans daily indices",
+			index: "logs-{2006.01.02}",
+			from:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:    time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC),
+			want:  "http://es.example.com/logs-2024.01.01,logs-2024.01.02,logs-2024.01.03,logs-2024.01.04,logs-2024.01.05,logs-2024.01.06,logs-2024.01.07/_search?ignore_unavailable=true",
+		},
+		{
+			name:  "window spans two daily indices",
+			index: "logs-{2006.01.02}",
+			from:  time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+			to:    time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC),
+			want:  "http://es.example.com/logs-2024.01.01,logs-2024.01.02/_search?ignore_unavailable=true",
+		},
+		{
+			name:  "monthly pattern is not repeated",
+			index: "logs-{2006.01}",
+			from:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:    time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC),
+			want:  "http://es.example.com/logs-2024.01/_search",
+		},
+		{
+			name:  "comma separated list",
+			index: "logs-a,logs-b",
+			from:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:    time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+			want:  "http://es.example.com/logs-a,logs-b/_search?ignore_unavailable=true",
+		},
+		{
+			name:    "too many indices",
+			index:   "logs-{2006.01.02}",
+			from:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:      time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add((maxElasticSearchIndices + 1) * 24 * time.Hour),
+			wantErr: true,
+		},
+		{
+			name:  "indices up to the limit",
+			index: "logs-{2006.01.02}",
+			from:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(maxElasticSearchIndices * 24 * time.Hour),
+		},
+		{
+			name:    "unclosed pattern",
+			index:   "logs-{2006.01.02",
+			from:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:      time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := elasticSearchURL("http://es.example.com", tc.index, "_search", tc.from, tc.to)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got no error, wanted one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.want != "" && got != tc.want {
+				t.Errorf("got %q, wanted %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// ErrorReportJSON is the payload posted to the error reporting sink for each reported collection failure.
+type ErrorReportJSON struct {
+	QueryID    int       `json:"query_id"`
+	QueryName  string    `json:"query_name"`
+	Seq        int       `json:"seq"`
+	ProviderID int       `json:"provider_id"`
+	ApiType    ApiType   `json:"api_type"`
+	Error      string    `json:"error"`
+	Time       time.Time `json:"time"`
+}
+
+// An ErrorReporter posts collection failures as JSON to a webhook. Reports are rate limited per query
+// so that a persistently failing query reports at most once per interval.
+// A nil ErrorReporter discards all reports.
+type ErrorReporter struct {
+	url      string
+	interval time.Duration
+	hc       *http.Client
+
+	mu   sync.Mutex
+	last map[int]time.Time // time of last report, keyed by query id
+}
+
+func NewErrorReporter(url string, interval time.Duration) *ErrorReporter {
+	return &ErrorReporter{
+		url:      url,
+		interval: interval,
+		hc:       &http.Client{Timeout: 10 * time.Second},
+		last:     make(map[int]time.Time),
+	}
+}
+
+// Report sends a report of the failure to collect seq for the query unless the query has already been
+// reported within the rate limiting interval. Failures to deliver the report are logged.
+func (r *ErrorReporter) Report(ctx context.Context, qry *Query, seq int, reportErr error) {
+	if r == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	r.mu.Lock()
+	if last, ok := r.last[qry.ID]; ok && now.Sub(last) < r.interval {
+		r.mu.Unlock()
+		return
+	}
+	r.last[qry.ID] = now
+	r.mu.Unlock()
+
+	if err := r.send(ctx, ErrorReportJSON{
+		QueryID:    qry.ID,
+		QueryName:  qry.Name,
+		Seq:        seq,
+		ProviderID: qry.ProviderID,
+		ApiType:    qry.ApiType,
+		Error:      reportErr.Error(),
+		Time:       now,
+	}); err != nil {
+		slog.Error("failed to send error report", "query_id", qry.ID, "error", err)
+	}
+}
+
+func (r *ErrorReporter) send(ctx context.Context, report ErrorReportJSON) error {
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(report); err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", r.url, buf)
+	if err != nil {
+		return fmt.Errorf("failed to create new request: %w", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := r.hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("request failed: %s", resp.Status)
+	}
+
+	return nil
+}
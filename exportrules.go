@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultCollectionMetric is the name of the metric that collected values are assumed to be exported to
+// Prometheus as when generating recording rules.
+const defaultCollectionMetric = "caracol_collection_value"
+
+// RuleFileYAML is a Prometheus rule file.
+type RuleFileYAML struct {
+	Groups []RuleGroupYAML `yaml:"groups"`
+}
+
+type RuleGroupYAML struct {
+	Name  string     `yaml:"name"`
+	Rules []RuleYAML `yaml:"rules"`
+}
+
+type RuleYAML struct {
+	Record string            `yaml:"record"`
+	Expr   string            `yaml:"expr"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// invalidRuleNameChars matches the characters that may not appear in a Prometheus metric name.
+var invalidRuleNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// ruleName converts a query name or group to a form usable as part of a metric name.
+func ruleName(s string) string {
+	s = strings.Trim(invalidRuleNameChars.ReplaceAllString(strings.ToLower(s), "_"), "_")
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		s = "_" + s
+	}
+	return s
+}
+
+// QueryExportRules prints a recording rule for each query that records the values collected for it under a
+// name derived from its group and name, in the form caracol:<group>:<name>. Queries are grouped into a rule
+// group for each query group so alerting rules can be organised in the same way as the queries.
+func QueryExportRules(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	metric := strings.TrimSpace(cc.String("metric"))
+	if metric == "" {
+		return fmt.Errorf("metric must be supplied")
+	}
+
+	db := NewDB(dbConnStr())
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	var conds []string
+	var args []any
+	if !cc.Bool("all") {
+		conds = append(conds, "not archived")
+	}
+	if cc.IsSet("group") {
+		args = append(args, strings.TrimSpace(cc.String("group")))
+		conds = append(conds, fmt.Sprintf("group_name=$%d", len(args)))
+	}
+
+	sql := "select id, name, group_name, interval, interval_factor from queries"
+	if len(conds) > 0 {
+		sql += " where " + strings.Join(conds, " and ")
+	}
+	sql += " order by group_name, id"
+
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	var file RuleFileYAML
+	groups := make(map[string]int) // index of rule group in file, by query group
+	records := make(map[string]int)
+	for rows.Next() {
+		var (
+			id             int
+			name           string
+			group          string
+			interval       QueryInterval
+			intervalFactor int
+		)
+		if err := rows.Scan(&id, &name, &group, &interval, &intervalFactor); err != nil {
+			return fmt.Errorf("scan: %w", err)
+		}
+
+		gname := ruleName(group)
+		if group == "" {
+			gname = "ungrouped"
+		}
+		gi, ok := groups[gname]
+		if !ok {
+			gi = len(file.Groups)
+			groups[gname] = gi
+			file.Groups = append(file.Groups, RuleGroupYAML{Name: "caracol_" + gname})
+		}
+
+		// query names are only unique within a source so the id distinguishes queries that share a name
+		record := "caracol:" + gname + ":" + ruleName(name)
+		if records[record]++; records[record] > 1 {
+			record += "_" + strconv.Itoa(id)
+		}
+
+		labels := map[string]string{
+			"query":    name,
+			"interval": FormatInterval(interval, intervalFactor),
+		}
+		if group != "" {
+			labels["group"] = group
+		}
+
+		file.Groups[gi].Rules = append(file.Groups[gi].Rules, RuleYAML{
+			Record: record,
+			Expr:   fmt.Sprintf("%s{query_id=%q}", metric, strconv.Itoa(id)),
+			Labels: labels,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("rows: %w", err)
+	}
+
+	enc := yaml.NewEncoder(os.Stdout)
+	if err := enc.Encode(file); err != nil {
+		return fmt.Errorf("encode rules: %w", err)
+	}
+	return enc.Close()
+}
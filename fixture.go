@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A FixtureQuerier returns values read from a local file, allowing collection to be developed and
+// tested without access to a real provider. The source dataset is the path of the file.
+//
+// The file may be JSON holding an array of points or CSV with time and value columns, distinguished
+// by the file extension. Times are the end of the interval the value belongs to, using the same formats
+// accepted on the command line. For example:
+//
+//	[{"time": "2023-05-01T00:00:00Z", "value": 12}, {"time": "2023-05-02T00:00:00Z", "value": 14}]
+//
+// or
+//
+//	time,value
+//	2023-05-01T00:00:00Z,12
+//	2023-05-02T00:00:00Z,14
+//
+// The query is ignored.
+type FixtureQuerier struct {
+	path string
+}
+
+var _ Querier = (*FixtureQuerier)(nil)
+
+func NewFixtureQuerier(path string) (*FixtureQuerier, error) {
+	if path == "" {
+		return nil, fmt.Errorf("fixture file path must be supplied as the source dataset")
+	}
+	return &FixtureQuerier{path: path}, nil
+}
+
+type FixturePointJSON struct {
+	Time  string  `json:"time"`
+	Value float64 `json:"value"`
+}
+
+func (f *FixtureQuerier) Execute(ctx context.Context, query string, fromTime, toTime time.Time, interval QueryInterval, factor int) ([]DataPoint, error) {
+	all, err := f.readPoints()
+	if err != nil {
+		return nil, fmt.Errorf("read fixture %q: %w", f.path, err)
+	}
+
+	points := []DataPoint{}
+	for _, pt := range all {
+		if pt.Time.After(fromTime) && !pt.Time.After(toTime) {
+			points = append(points, pt)
+		}
+	}
+
+	return points, nil
+}
+
+func (f *FixtureQuerier) readPoints() ([]DataPoint, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(f.path), ".csv") {
+		return readFixtureCSV(file)
+	}
+	return readFixtureJSON(file)
+}
+
+func readFixtureJSON(r io.Reader) ([]DataPoint, error) {
+	var fps []FixturePointJSON
+	if err := json.NewDecoder(r).Decode(&fps); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+
+	points := make([]DataPoint, len(fps))
+	for i, fp := range fps {
+		t, err := parseTime(fp.Time)
+		if err != nil {
+			return nil, fmt.Errorf("point %d: time %w", i, err)
+		}
+		points[i] = DataPoint{Time: t.UTC(), Value: fp.Value}
+	}
+	return points, nil
+}
+
+func readFixtureCSV(r io.Reader) ([]DataPoint, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("read csv: %w", err)
+	}
+
+	var points []DataPoint
+	for i, rec := range records {
+		if len(rec) != 2 {
+			return nil, fmt.Errorf("line %d: expected 2 fields, found %d", i+1, len(rec))
+		}
+		if i == 0 && rec[0] == "time" {
+			continue // header
+		}
+		t, err := parseTime(strings.TrimSpace(rec[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: time %w", i+1, err)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(rec[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid value: %w", i+1, err)
+		}
+		points = append(points, DataPoint{Time: t.UTC(), Value: v})
+	}
+	return points, nil
+}
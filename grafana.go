@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/exp/slog"
@@ -33,7 +34,8 @@ type GrafanaPrometheusQueryJSON struct {
 }
 
 type GrafanaQueryDatasourceJSON struct {
-	UID string `json:"uid"`
+	UID  string `json:"uid"`
+	Type string `json:"type,omitempty"`
 }
 
 type GrafanaQueryRequestOutJSON struct {
@@ -42,28 +44,67 @@ type GrafanaQueryRequestOutJSON struct {
 
 type GrafanaResultJSON struct {
 	Status int                `json:"status"`
+	Error  string             `json:"error,omitempty"`
 	Frames []GrafanaFrameJSON `json:"frames"`
 }
 
 type GrafanaFrameJSON struct {
-	Schema any             `json:"schema"`
-	Data   GrafanaDataJSON `json:"data"`
+	Schema GrafanaFrameSchemaJSON `json:"schema"`
+	Data   GrafanaDataJSON        `json:"data"`
+}
+
+// Columns returns the indexes of the time and value columns of the frame's data, identified by the types of
+// the fields in its schema. Frames without a schema are assumed to hold the time in the first column.
+func (f GrafanaFrameJSON) Columns() (int, int, error) {
+	if len(f.Schema.Fields) == 0 {
+		return 0, 1, nil
+	}
+	if len(f.Schema.Fields) != 2 {
+		return 0, 0, fmt.Errorf("expected frame with 2 fields, found %d", len(f.Schema.Fields))
+	}
+	switch {
+	case f.Schema.Fields[0].Type == "time":
+		return 0, 1, nil
+	case f.Schema.Fields[1].Type == "time":
+		return 1, 0, nil
+	default:
+		return 0, 0, fmt.Errorf("no time field found in frame, field types are %q and %q", f.Schema.Fields[0].Type, f.Schema.Fields[1].Type)
+	}
+}
+
+type GrafanaFrameSchemaJSON struct {
+	Fields []GrafanaFieldJSON `json:"fields"`
+}
+
+type GrafanaFieldJSON struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type GrafanaDataJSON struct {
 	Values [2][]float64 `json:"values"`
 }
 
+// A GrafanaCloudQuerier executes queries using the Grafana datasource query api.
+//
+// The datasource may be a comma separated list of datasource UIDs, which has the same effect as a Grafana
+// mixed datasource. The query is sent to each datasource as a separate sub-query with its own refId in a
+// single request and the points returned by all of them are combined by summing the values that share a
+// time and series. This suits data that has been split across datasources, such as when migrating between
+// clusters, so that the combined result still maps to a single DataPoint for each interval and series.
 type GrafanaCloudQuerier struct {
 	api         string
-	dsuid       string
+	dsuids      []string
 	dstype      string
-	bearerToken string
+	auth        HTTPAuth
+	opts        HTTPOptions
+	multiSeries bool // when true each series returned by the query is reported as separate data points
 }
 
 var _ Querier = (*GrafanaCloudQuerier)(nil)
 
-func NewGrafanaCloudQuerier(api string, dsuid string, dstype QueryType, bearerToken string) (*GrafanaCloudQuerier, error) {
+func NewGrafanaCloudQuerier(api string, dsuid string, dstype string, auth HTTPAuth, opts HTTPOptions, multiSeries bool) (*GrafanaCloudQuerier, error) {
 	u, err := url.Parse(api)
 	if err != nil {
 		return nil, fmt.Errorf("invalid api url: %w", err)
@@ -71,46 +112,77 @@ func NewGrafanaCloudQuerier(api string, dsuid string, dstype QueryType, bearerTo
 
 	u.Path = "/api/ds/query"
 
+	var dsuids []string
+	for _, uid := range strings.Split(dsuid, ",") {
+		if uid = strings.TrimSpace(uid); uid != "" {
+			dsuids = append(dsuids, uid)
+		}
+	}
+	if len(dsuids) == 0 {
+		return nil, fmt.Errorf("datasource uid must be supplied")
+	}
+
 	return &GrafanaCloudQuerier{
 		api:         u.String(),
-		dsuid:       dsuid,
-		dstype:      string(dstype),
-		bearerToken: bearerToken,
+		dsuids:      dsuids,
+		dstype:      dstype,
+		auth:        auth,
+		opts:        opts,
+		multiSeries: multiSeries,
 	}, nil
 }
 
-func (g *GrafanaCloudQuerier) Execute(ctx context.Context, query string, fromTime, toTime time.Time, interval QueryInterval) ([]DataPoint, error) {
+func (g *GrafanaCloudQuerier) Execute(ctx context.Context, query string, fromTime, toTime time.Time, interval QueryInterval, factor int) ([]DataPoint, error) {
 	fromTime = fromTime.Add(1)
 	var intervalStr string
 	var maxPoints int
 	switch interval {
 	case QueryIntervalHourly:
-		intervalStr = "1h"
-		maxPoints = int(toTime.Sub(fromTime)/time.Hour) + 1
+		intervalStr = fmt.Sprintf("%dh", factor)
+		maxPoints = int(toTime.Sub(fromTime)/(time.Duration(factor)*time.Hour)) + 1
 	case QueryIntervalDaily:
-		intervalStr = "1d"
-		maxPoints = int(toTime.Sub(fromTime)/(24*time.Hour)) + 1
+		intervalStr = fmt.Sprintf("%dd", factor)
+		maxPoints = int(toTime.Sub(fromTime)/(time.Duration(factor)*24*time.Hour)) + 1
+	case QueryIntervalWeekly:
+		intervalStr = fmt.Sprintf("%dw", factor)
+		maxPoints = int(toTime.Sub(fromTime)/(time.Duration(factor)*7*24*time.Hour)) + 1
+	case QueryIntervalMonthly:
+		intervalStr = fmt.Sprintf("%dM", factor)
+		maxPoints = int(toTime.Sub(fromTime)/(time.Duration(factor)*averageMonth)) + 1
 	default:
 		return nil, fmt.Errorf("unsupported query interval: %q", interval)
 	}
 
-	slog.Debug("executing grafana query", "uid", g.dsuid, "type", g.dstype, "query", query, "from", fromTime, "to", toTime)
+	if err := g.opts.checkMaxPoints(maxPoints * len(g.dsuids)); err != nil {
+		return nil, err
+	}
+
+	// table format merges all series into a single frame, so request a frame per series
+	// when each series needs to be distinguished by its labels
+	format := "table"
+	if g.multiSeries {
+		format = "time_series"
+	}
+
+	slog.Debug("executing grafana query", "uids", g.dsuids, "type", g.dstype, "query", query, "from", fromTime, "to", toTime)
 
 	q := GrafanaQueryRequestInJSON{
-		Queries: []any{
-			GrafanaPrometheusQueryJSON{
-				RefID:         "A",
-				Expression:    query,
-				Instant:       true,
-				Format:        "table",
-				Datasource:    GrafanaQueryDatasourceJSON{UID: g.dsuid},
-				MaxDataPoints: maxPoints,
-				Interval:      intervalStr,
-			},
-		},
 		From: strconv.FormatInt(fromTime.Unix()*1000, 10), // milliseconds
 		To:   strconv.FormatInt(toTime.Unix()*1000, 10),   // milliseconds
 	}
+	refIDs := make([]string, len(g.dsuids))
+	for i, uid := range g.dsuids {
+		refIDs[i] = grafanaRefID(i)
+		q.Queries = append(q.Queries, GrafanaPrometheusQueryJSON{
+			RefID:         refIDs[i],
+			Expression:    query,
+			Instant:       true,
+			Format:        format,
+			Datasource:    GrafanaQueryDatasourceJSON{UID: uid, Type: g.dstype},
+			MaxDataPoints: maxPoints,
+			Interval:      intervalStr,
+		})
+	}
 
 	buf := new(bytes.Buffer)
 	if err := json.NewEncoder(buf).Encode(q); err != nil {
@@ -119,21 +191,21 @@ func (g *GrafanaCloudQuerier) Execute(ctx context.Context, query string, fromTim
 
 	slog.Debug("sending request", "body", buf.String())
 
-	hc := http.Client{}
-	req, err := http.NewRequest("POST", g.api, buf)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new request: %w", err)
-	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", g.bearerToken))
-
-	resp, err := hc.Do(req)
+	reqBody := buf.Bytes()
+	resp, err := sendRequest(ctx, g.opts, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", g.api, bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "application/json")
+		if err := g.auth.Apply(req); err != nil {
+			return nil, err
+		}
+		return req, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("request failed: %s", resp.Status)
-	}
 	defer resp.Body.Close()
 
 	// read body fully so we have it for diagnosis during development
@@ -142,22 +214,138 @@ func (g *GrafanaCloudQuerier) Execute(ctx context.Context, query string, fromTim
 		return nil, fmt.Errorf("failed to read body request: %w", err)
 	}
 	slog.Debug("received response", "body", string(body))
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, body)
+	}
+	recordResponse(ctx, body)
 
 	var out GrafanaQueryRequestOutJSON
 	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&out); err != nil {
 		return nil, fmt.Errorf("failed to decode query response: %w", err)
 	}
 
-	values := out.Results["A"].Frames[0].Data.Values
+	var points []DataPoint
+	for i, refID := range refIDs {
+		result, ok := out.Results[refID]
+		if !ok {
+			return nil, fmt.Errorf("expected result %q not found", refID)
+		}
+
+		// grafana reports errors for individual queries within a successful response
+		if result.Error != "" || (result.Status != 0 && (result.Status < 200 || result.Status > 299)) {
+			return nil, fmt.Errorf("query of datasource %q failed with status %d: %s", g.dsuids[i], result.Status, result.Error)
+		}
+
+		for _, frame := range result.Frames {
+			timeCol, valueCol, err := frame.Columns()
+			if err != nil {
+				return nil, err
+			}
 
-	points := make([]DataPoint, len(values[0]))
+			var series string
+			if g.multiSeries && len(frame.Schema.Fields) > valueCol {
+				series = FormatSeriesLabels(frame.Schema.Fields[valueCol].Labels)
+			}
 
-	for i := range values[0] {
-		points[i] = DataPoint{
-			Time:  time.Unix(0, int64(values[0][i])*1e6).UTC(),
-			Value: values[1][i],
+			values := frame.Data.Values
+			for i := range values[timeCol] {
+				if i >= len(values[valueCol]) {
+					break
+				}
+				points = append(points, DataPoint{
+					Time:   time.Unix(0, int64(values[timeCol][i])*1e6).UTC(),
+					Value:  values[valueCol][i],
+					Series: series,
+				})
+			}
 		}
 	}
 
+	if len(refIDs) > 1 {
+		points = sumPoints(points)
+	}
+	if err := g.opts.checkMaxPoints(len(points)); err != nil {
+		return nil, err
+	}
+
 	return points, nil
 }
+
+// grafanaRefID returns the refId of the i'th sub-query of a request: A to Z, then AA, AB and so on.
+func grafanaRefID(i int) string {
+	id := string(rune('A' + i%26))
+	for i /= 26; i > 0; i /= 26 {
+		i--
+		id = string(rune('A'+i%26)) + id
+	}
+	return id
+}
+
+// sumPoints combines points with the same time and series by summing their values, keeping the order in
+// which each time and series first appears.
+func sumPoints(points []DataPoint) []DataPoint {
+	type key struct {
+		time   time.Time
+		series string
+	}
+	index := make(map[key]int)
+	var combined []DataPoint
+	for _, pt := range points {
+		k := key{time: pt.Time, series: pt.Series}
+		if i, ok := index[k]; ok {
+			combined[i].Value += pt.Value
+			continue
+		}
+		index[k] = len(combined)
+		combined = append(combined, pt)
+	}
+	return combined
+}
+
+// GrafanaDatasourceJSON describes a datasource as listed by the Grafana datasources api.
+type GrafanaDatasourceJSON struct {
+	ID   int    `json:"id"`
+	UID  string `json:"uid"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// ListGrafanaDatasources returns the datasources of the Grafana instance at the given url that are visible to
+// the credentials in auth.
+func ListGrafanaDatasources(ctx context.Context, api string, auth HTTPAuth, opts HTTPOptions) ([]GrafanaDatasourceJSON, error) {
+	u, err := url.Parse(api)
+	if err != nil {
+		return nil, fmt.Errorf("invalid api url: %w", err)
+	}
+	u.Path = "/api/datasources"
+
+	resp, err := sendRequest(ctx, opts, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := auth.Apply(req); err != nil {
+			return nil, err
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body request: %w", err)
+	}
+	slog.Debug("received response", "body", string(body))
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, body)
+	}
+
+	var dss []GrafanaDatasourceJSON
+	if err := json.Unmarshal(body, &dss); err != nil {
+		return nil, fmt.Errorf("failed to decode datasources: %w", err)
+	}
+	return dss, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGrafanaReversedFrameColumns(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"results": {
+				"A": {
+					"status": 200,
+					"frames": [
+						{
+							"schema": {"fields": [{"name": "Value", "type": "number"}, {"name": "Time", "type": "time"}]},
+							"data": {"values": [[42.5], [1704153600000]]}
+						}
+					]
+				}
+			}
+		}`))
+	}))
+	defer srv.Close()
+
+	g, err := NewGrafanaCloudQuerier(srv.URL, "uid", "prometheus", HTTPAuth{AuthType: AuthTypeNone}, HTTPOptions{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating querier: %v", err)
+	}
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+	points, err := g.Execute(context.Background(), "up", from, to, QueryIntervalDaily, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(points) != 1 {
+		t.Fatalf("got %d points, wanted 1", len(points))
+	}
+	if !points[0].Time.Equal(to) {
+		t.Errorf("got time %s, wanted %s", points[0].Time, to)
+	}
+	if points[0].Value != 42.5 {
+		t.Errorf("got value %v, wanted 42.5", points[0].Value)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"golang.org/x/exp/slog"
+)
+
+// A HealthServer serves the liveness and readiness endpoints used by orchestrators. /healthz reports the
+// process is running and /readyz reports whether the daemon is ready, as decided by the ready function.
+// Further handlers, such as for administration, may be added with Handle before the server is run.
+type HealthServer struct {
+	addr     string
+	ready    func() bool
+	handlers map[string]http.Handler
+}
+
+func NewHealthServer(addr string, ready func() bool) *HealthServer {
+	return &HealthServer{
+		addr:     addr,
+		ready:    ready,
+		handlers: make(map[string]http.Handler),
+	}
+}
+
+// Handle registers the handler for the given pattern.
+func (h *HealthServer) Handle(pattern string, handler http.Handler) {
+	h.handlers[pattern] = handler
+}
+
+func (h *HealthServer) Run(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !h.ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not ready\n"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+	for pattern, handler := range h.handlers {
+		mux.Handle(pattern, handler)
+	}
+
+	server := &http.Server{Addr: h.addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			slog.Error("failed to shut down health server", "error", err)
+		}
+	}()
+
+	slog.Info("starting health server", "addr", h.addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return ctx.Err()
+}
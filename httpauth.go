@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+)
+
+// HTTPAuth holds the credentials used to authenticate requests made by the HTTP queriers.
+type HTTPAuth struct {
+	AuthType AuthType
+	Secrets  ProviderSecrets
+}
+
+// Apply adds the authentication headers required by the auth type to the request.
+//
+// For AuthTypeBearerTokenBasicAuth the basic auth credentials are intended for a gateway in front of
+// the provider so they are sent in the Proxy-Authorization header, leaving the Authorization header
+// to carry the bearer token for the upstream api.
+func (a HTTPAuth) Apply(req *http.Request) error {
+	switch a.AuthType {
+	case AuthTypeBearerToken:
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", a.Secrets[SecretTypeBearerToken]))
+	case AuthTypeBasicAuth:
+		req.SetBasicAuth(a.Secrets[SecretTypeUsername], a.Secrets[SecretTypePassword])
+	case AuthTypeBearerTokenBasicAuth:
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", a.Secrets[SecretTypeBearerToken]))
+		req.Header.Set("Proxy-Authorization", "Basic "+basicAuthCredentials(a.Secrets[SecretTypeUsername], a.Secrets[SecretTypePassword]))
+	case AuthTypeNone:
+	default:
+		return fmt.Errorf("unsupported auth type for http requests: %q", a.AuthType)
+	}
+	return nil
+}
+
+func basicAuthCredentials(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/exp/slog"
+)
+
+var httpFlags = []cli.Flag{
+	&cli.DurationFlag{
+		Name:        "request-timeout",
+		Usage:       "Maximum time allowed for each request made to a provider, including reading its response, zero for no limit. Overridden by the provider's own setting.",
+		Value:       30 * time.Second,
+		EnvVars:     []string{envPrefix + "REQUEST_TIMEOUT"},
+		Destination: &httpOpts.requestTimeout,
+	},
+	&cli.IntFlag{
+		Name:        "max-retries",
+		Usage:       "Number of times a request to a provider that fails with a network or server error is retried, waiting twice as long before each retry. Overridden by the provider's own setting.",
+		Value:       2,
+		EnvVars:     []string{envPrefix + "MAX_RETRIES"},
+		Destination: &httpOpts.maxRetries,
+	},
+	&cli.IntFlag{
+		Name:        "max-points",
+		Usage:       "Maximum number of points a single query may return, protecting against requests for very long ranges. Zero for no limit.",
+		Value:       100000,
+		EnvVars:     []string{envPrefix + "MAX_POINTS"},
+		Destination: &httpOpts.maxPoints,
+	},
+}
+
+var httpOpts struct {
+	requestTimeout time.Duration
+	maxRetries     int
+	maxPoints      int
+}
+
+// HTTPOptions controls how the HTTP queriers make requests
+type HTTPOptions struct {
+	Timeout    time.Duration     // maximum time allowed for each request attempt, zero for no limit
+	MaxRetries int               // number of times a failed request is retried
+	Headers    map[string]string // headers added to each request unless already set by the querier
+	MaxPoints  int               // maximum number of points a query may return, zero for no limit
+}
+
+// checkMaxPoints returns an error if n points exceeds the limit set by the options.
+func (o HTTPOptions) checkMaxPoints(n int) error {
+	if o.MaxPoints > 0 && n > o.MaxPoints {
+		return fmt.Errorf("query returns %d points, more than the limit of %d", n, o.MaxPoints)
+	}
+	return nil
+}
+
+// ExpandHeaders returns the header values with references to environment variables in the form ${NAME}
+// replaced by their values, so that secrets need not be stored with the provider. It is an error to refer to
+// an environment variable that is not set.
+func ExpandHeaders(headers map[string]string) (map[string]string, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	expanded := make(map[string]string, len(headers))
+	for name, value := range headers {
+		var missing []string
+		expanded[name] = os.Expand(value, func(v string) string {
+			val, ok := os.LookupEnv(v)
+			if !ok {
+				missing = append(missing, v)
+			}
+			return val
+		})
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("header %s: missing environment variable: %q", name, missing[0])
+		}
+	}
+	return expanded, nil
+}
+
+// ErrCredentialsRejected is returned when a provider rejects the credentials sent with a request.
+var ErrCredentialsRejected = errors.New("credentials rejected")
+
+// Delays between retries of a failed request, which grow exponentially from retryBackoff up to retryMaxBackoff.
+const (
+	retryBackoff    = time.Second
+	retryMaxBackoff = 30 * time.Second
+)
+
+// sendRequest sends the request created by newReq, retrying on network errors and server errors
+// up to the configured number of times with exponential backoff. Authentication failures are not
+// retried and return an error wrapping ErrCredentialsRejected. Other client errors are not retried
+// since they show a problem with the request. A server error on the final attempt is returned as an
+// error including its status. Each attempt, including reading the response body, is bounded by the
+// timeout in opts through a context derived from ctx, which is released when the body is closed. The
+// headers in opts are added to each request. newReq is called for each attempt so that the request
+// body can be recreated.
+func sendRequest(ctx context.Context, opts HTTPOptions, newReq func() (*http.Request, error)) (*http.Response, error) {
+	var hc http.Client
+
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new request: %w", err)
+		}
+
+		for name, value := range opts.Headers {
+			if req.Header.Get(name) == "" {
+				req.Header.Set(name, value)
+			}
+		}
+
+		var (
+			actx   context.Context
+			cancel context.CancelFunc
+		)
+		if opts.Timeout > 0 {
+			actx, cancel = context.WithTimeout(req.Context(), opts.Timeout)
+		} else {
+			actx, cancel = context.WithCancel(req.Context())
+		}
+		req = req.WithContext(actx)
+
+		resp, err := hc.Do(req)
+		if err != nil {
+			cancel()
+		} else {
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		}
+		if err == nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			// retrying with the same credentials will not succeed
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, errorSnippetLength+1))
+			resp.Body.Close()
+			if snippet := errorSnippet(body); snippet != "" {
+				return nil, fmt.Errorf("%w: %s: %s", ErrCredentialsRejected, resp.Status, snippet)
+			}
+			return nil, fmt.Errorf("%w: %s", ErrCredentialsRejected, resp.Status)
+		}
+		if err != nil && ctx.Err() != nil {
+			return nil, err
+		}
+		if attempt >= opts.MaxRetries {
+			if err != nil || resp.StatusCode < 500 {
+				return resp, err
+			}
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, errorSnippetLength+1))
+			resp.Body.Close()
+			if attempt > 0 {
+				return nil, fmt.Errorf("giving up after %d attempts: %w", attempt+1, responseError(resp, body))
+			}
+			return nil, responseError(resp, body)
+		}
+
+		if err == nil {
+			if resp.StatusCode < 500 {
+				return resp, nil
+			}
+			resp.Body.Close()
+			slog.Debug("retrying request", "url", req.URL.String(), "attempt", attempt+1, "status", resp.Status, "backoff", backoff)
+		} else {
+			slog.Debug("retrying request", "url", req.URL.String(), "attempt", attempt+1, "error", err, "backoff", backoff)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// cancelOnClose releases the context of a request once its response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// errorSnippetLength is the maximum number of bytes of a response body included in an error.
+const errorSnippetLength = 512
+
+// responseError returns an error for a failed request that includes the start of the response body, which
+// usually explains why the provider rejected the request.
+func responseError(resp *http.Response, body []byte) error {
+	if snippet := errorSnippet(body); snippet != "" {
+		return fmt.Errorf("request failed: %s: %s", resp.Status, snippet)
+	}
+	return fmt.Errorf("request failed: %s", resp.Status)
+}
+
+// errorSnippet returns the body with runs of whitespace collapsed, truncated to errorSnippetLength bytes.
+func errorSnippet(body []byte) string {
+	snippet := strings.Join(strings.Fields(string(body)), " ")
+	if len(snippet) > errorSnippetLength {
+		snippet = strings.ToValidUTF8(snippet[:errorSnippetLength], "") + "..."
+	}
+	return snippet
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSendRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	opts := HTTPOptions{Timeout: 50 * time.Millisecond}
+	ctx := context.Background()
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := sendRequest(ctx, opts, func() (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+		})
+		if resp != nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got error %v, wanted %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request did not time out")
+	}
+}
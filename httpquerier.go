@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// An HTTPQuerier executes queries against bespoke HTTP apis that return a single value in a JSON response.
+// The query is a JSON HTTPQuerySpecJSON describing the request to make and where to find the value in the
+// response, for example:
+//
+//	{
+//	  "method": "POST",
+//	  "path": "/api/v1/metrics",
+//	  "body": "{\"metric\": \"{metric}\", \"from\": {from_unix}, \"to\": {to_unix}}",
+//	  "vars": {"metric": "active_peers"},
+//	  "value": "$.data.total"
+//	}
+//
+// The path and body are templates in which {from} and {to} are replaced by the start and end of the time
+// range formatted as '2006-01-02T15:04:05Z', {from_unix} and {to_unix} by the same times in seconds since the
+// epoch, {interval} by the query interval and any other {name} by the variable of that name in vars.
+type HTTPQuerier struct {
+	api  string
+	auth HTTPAuth
+	opts HTTPOptions
+}
+
+var _ Querier = (*HTTPQuerier)(nil)
+
+func NewHTTPQuerier(api string, auth HTTPAuth, opts HTTPOptions) (*HTTPQuerier, error) {
+	if _, err := url.Parse(api); err != nil {
+		return nil, fmt.Errorf("invalid api url: %w", err)
+	}
+
+	return &HTTPQuerier{
+		api:  strings.TrimSuffix(api, "/"),
+		auth: auth,
+		opts: opts,
+	}, nil
+}
+
+// HTTPQuerySpecJSON describes the request made by an HTTPQuerier and how the value is extracted from its response.
+type HTTPQuerySpecJSON struct {
+	Method      string            `json:"method"`       // http method, defaults to GET
+	Path        string            `json:"path"`         // template for the path and query string, appended to the provider's url
+	Body        string            `json:"body"`         // template for the request body, if any
+	ContentType string            `json:"content_type"` // content type of the body, defaults to application/json
+	Vars        map[string]string `json:"vars"`         // variables substituted into the templates
+	Value       string            `json:"value"`        // JSONPath of the value in the response
+	Time        string            `json:"time"`         // optional JSONPath of the time of the value, defaults to the end of the time range
+}
+
+// ParseHTTPQuerySpec parses and validates the query of an http query.
+func ParseHTTPQuerySpec(query string) (*HTTPQuerySpecJSON, error) {
+	var spec HTTPQuerySpecJSON
+	if err := json.Unmarshal([]byte(query), &spec); err != nil {
+		return nil, fmt.Errorf("invalid http query %q: %w", query, err)
+	}
+	if spec.Value == "" {
+		return nil, fmt.Errorf("http query must specify the path of the value in the response")
+	}
+	switch strings.ToUpper(spec.Method) {
+	case "", http.MethodGet, http.MethodPost, http.MethodPut:
+	default:
+		return nil, fmt.Errorf("unsupported http method: %q", spec.Method)
+	}
+	return &spec, nil
+}
+
+func (h *HTTPQuerier) Execute(ctx context.Context, query string, fromTime, toTime time.Time, interval QueryInterval, factor int) ([]DataPoint, error) {
+	spec, err := ParseHTTPQuerySpec(query)
+	if err != nil {
+		return nil, err
+	}
+
+	method := strings.ToUpper(spec.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	contentType := spec.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	vars := map[string]string{
+		"from":      fromTime.UTC().Format("2006-01-02T15:04:05Z"),
+		"to":        toTime.UTC().Format("2006-01-02T15:04:05Z"),
+		"from_unix": strconv.FormatInt(fromTime.Unix(), 10),
+		"to_unix":   strconv.FormatInt(toTime.Unix(), 10),
+		"interval":  FormatInterval(interval, factor),
+	}
+	for k, v := range spec.Vars {
+		if _, builtin := vars[k]; builtin {
+			return nil, fmt.Errorf("variable %q cannot be overridden", k)
+		}
+		vars[k] = v
+	}
+
+	path, err := expandTemplate(spec.Path, vars)
+	if err != nil {
+		return nil, fmt.Errorf("path: %w", err)
+	}
+	reqBody, err := expandTemplate(spec.Body, vars)
+	if err != nil {
+		return nil, fmt.Errorf("body: %w", err)
+	}
+
+	u := h.api + path
+	slog.Debug("sending request", "method", method, "url", u, "body", reqBody)
+
+	resp, err := sendRequest(ctx, h.opts, func() (*http.Request, error) {
+		var body io.Reader
+		if reqBody != "" {
+			body = strings.NewReader(reqBody)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, body)
+		if err != nil {
+			return nil, err
+		}
+		if reqBody != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if err := h.auth.Apply(req); err != nil {
+			return nil, err
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body request: %w", err)
+	}
+	slog.Debug("received response", "body", string(body))
+	recordResponse(ctx, body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, body)
+	}
+
+	var doc any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	v, err := jsonPathLookup(doc, spec.Value)
+	if err != nil {
+		return nil, fmt.Errorf("value: %w", err)
+	}
+	if v == nil {
+		// the api has no value for the time range
+		return []DataPoint{}, nil
+	}
+	value, err := jsonNumber(v)
+	if err != nil {
+		return nil, fmt.Errorf("value: %w", err)
+	}
+
+	pt := DataPoint{Time: toTime, Value: value}
+	if spec.Time != "" {
+		tv, err := jsonPathLookup(doc, spec.Time)
+		if err != nil {
+			return nil, fmt.Errorf("time: %w", err)
+		}
+		pt.Time, err = jsonTime(tv)
+		if err != nil {
+			return nil, fmt.Errorf("time: %w", err)
+		}
+	}
+
+	return []DataPoint{pt}, nil
+}
+
+var templateVarRegexp = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// expandTemplate replaces each {name} in the template with the value of the named variable. It is an error
+// to refer to a variable that is not defined.
+func expandTemplate(tmpl string, vars map[string]string) (string, error) {
+	var missing string
+	out := templateVarRegexp.ReplaceAllStringFunc(tmpl, func(m string) string {
+		name := m[1 : len(m)-1]
+		v, ok := vars[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		return v
+	})
+	if missing != "" {
+		return "", fmt.Errorf("undefined variable %q", missing)
+	}
+	return out, nil
+}
+
+// jsonPathLookup returns the element of a decoded JSON document at a simple JSONPath consisting of object keys
+// and array indexes, such as $.data.results[0].value. A path that leads to a missing element returns nil.
+func jsonPathLookup(doc any, path string) (any, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return doc, nil
+	}
+
+	cur := doc
+	for _, part := range strings.Split(strings.ReplaceAll(path, "[", ".["), ".") {
+		if part == "" {
+			continue
+		}
+		if strings.HasPrefix(part, "[") {
+			idx, err := strconv.Atoi(strings.TrimSuffix(part[1:], "]"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid index %q in path %q", part, path)
+			}
+			arr, ok := cur.([]any)
+			if !ok {
+				return nil, fmt.Errorf("expected array at %q in path %q", part, path)
+			}
+			if idx < 0 || idx >= len(arr) {
+				return nil, nil
+			}
+			cur = arr[idx]
+			continue
+		}
+		obj, ok := cur.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("expected object at %q in path %q", part, path)
+		}
+		cur, ok = obj[part]
+		if !ok {
+			return nil, nil
+		}
+	}
+	return cur, nil
+}
+
+// jsonNumber converts a decoded JSON number, or a string holding one, to a float.
+func jsonNumber(v any) (float64, error) {
+	switch tv := v.(type) {
+	case json.Number:
+		return tv.Float64()
+	case string:
+		return strconv.ParseFloat(tv, 64)
+	default:
+		return 0, fmt.Errorf("expected number, found %T", v)
+	}
+}
+
+// jsonTime converts a decoded JSON time, either seconds since the epoch or an RFC 3339 string, to a time.
+func jsonTime(v any) (time.Time, error) {
+	switch tv := v.(type) {
+	case json.Number:
+		secs, err := tv.Float64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(secs*1e9)).UTC(), nil
+	case string:
+		return time.Parse(time.RFC3339, tv)
+	default:
+		return time.Time{}, fmt.Errorf("expected time, found %T", v)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+var listFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:  "limit",
+		Usage: "Maximum number of rows to list.",
+	},
+	&cli.StringFlag{
+		Name:  "sort",
+		Usage: "Name of column to sort the list by.",
+	},
+	&cli.BoolFlag{
+		Name:  "desc",
+		Usage: "Sort the list in descending order.",
+	},
+}
+
+// listOrderLimit returns the order by and limit clauses for a list command. The columns map holds the
+// names that may be passed to the sort flag and the sql expression each sorts by. The defaultOrder
+// expression is used when no sort column is specified and to break ties otherwise.
+func listOrderLimit(cc *cli.Context, columns map[string]string, defaultOrder string) (string, error) {
+	dir := ""
+	if cc.Bool("desc") {
+		dir = " desc"
+	}
+
+	terms := strings.Split(defaultOrder, ",")
+	for i := range terms {
+		terms[i] = strings.TrimSpace(terms[i]) + dir
+	}
+	order := strings.Join(terms, ", ")
+	if name := strings.TrimSpace(cc.String("sort")); name != "" {
+		expr, ok := columns[name]
+		if !ok {
+			names := make([]string, 0, len(columns))
+			for n := range columns {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return "", fmt.Errorf("unsupported sort column: must be one of '%s'", strings.Join(names, "','"))
+		}
+		order = expr + dir + ", " + defaultOrder
+	}
+
+	clause := " order by " + order
+	if cc.IsSet("limit") {
+		limit := cc.Int("limit")
+		if limit <= 0 {
+			return "", fmt.Errorf("limit must be greater than zero")
+		}
+		clause += fmt.Sprintf(" limit %d", limit)
+	}
+
+	return clause, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 
 	"github.com/iand/pontium/hlog"
@@ -28,6 +29,14 @@ var loggingFlags = []cli.Flag{
 		Destination: &loggingOpts.VeryVerbose,
 	},
 
+	&cli.BoolFlag{
+		Name:        "quiet",
+		Aliases:     []string{"q"},
+		EnvVars:     []string{envPrefix + "QUIET"},
+		Usage:       "Only log errors and suppress informational messages, for scripted use. Overrides --verbose and --veryverbose",
+		Destination: &loggingOpts.Quiet,
+	},
+
 	&cli.BoolFlag{
 		Name:        "dbtrace",
 		EnvVars:     []string{envPrefix + "DBTRACE"},
@@ -61,6 +70,7 @@ var loggingOpts struct {
 	VeryVerbose bool
 	Hlog        bool
 	DBTrace     bool
+	Quiet       bool
 }
 
 var dbLogger tracelog.LoggerFunc
@@ -74,6 +84,9 @@ func setupLogging() {
 	if loggingOpts.VeryVerbose {
 		logLevel.Set(slog.LevelDebug)
 	}
+	if loggingOpts.Quiet {
+		logLevel.Set(slog.LevelError)
+	}
 
 	var h slog.Handler
 	if loggingOpts.Hlog {
@@ -100,3 +113,11 @@ func setupLogging() {
 		})
 	}
 }
+
+// printStatus prints an informational message about the outcome of a command unless --quiet was given.
+func printStatus(format string, args ...any) {
+	if loggingOpts.Quiet {
+		return
+	}
+	fmt.Printf(format+"\n", args...)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -12,22 +13,45 @@ const (
 	envPrefix = "CARACOL_"
 )
 
+// Exit codes reported by commands, so that wrappers such as cron jobs can tell a run worth retrying later from
+// one that needs attention.
+const (
+	exitCodeFatal   = 1 // the command was aborted by an error
+	exitCodePartial = 2 // the command completed but some sequences could not be collected
+)
+
+// A PartialFailureError reports that a command completed its work except for some sequences that could not be
+// collected. It causes the process to exit with exitCodePartial.
+type PartialFailureError struct {
+	Err error
+}
+
+func (e *PartialFailureError) Error() string { return e.Err.Error() }
+func (e *PartialFailureError) Unwrap() error { return e.Err }
+
 func main() {
 	app := &cli.App{
 		Name:     appName,
 		HelpName: appName,
+		Flags:    []cli.Flag{configFlag, secretsDirFlag},
+		Before:   loadConfigFile,
 		Commands: []*cli.Command{
 			daemonCommand,
 			providerCommand,
 			sourceCommand,
 			queryCommand,
 			collectionCommand,
+			configCommand,
 		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
-		os.Exit(1)
+		var pfe *PartialFailureError
+		if errors.As(err, &pfe) {
+			os.Exit(exitCodePartial)
+		}
+		os.Exit(exitCodeFatal)
 	}
 }
 
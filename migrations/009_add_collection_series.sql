@@ -0,0 +1,20 @@
+-- Queries can opt in to storing each series they return as a separate collection stream.
+alter table queries add column multi_series boolean not null default false;
+
+-- The series is the label set of the series the value was collected from, it is
+-- empty for queries that only return a single series.
+alter table collections add column series varchar not null default '';
+
+alter table collections drop constraint collections_pkey;
+alter table collections add primary key (query_id,series,seq);
+
+---- create above / drop below ----
+
+delete from collections where series <> '';
+
+alter table collections drop constraint collections_pkey;
+alter table collections add primary key (query_id,seq);
+
+alter table collections drop column if exists series;
+
+alter table queries drop column if exists multi_series;
@@ -0,0 +1,6 @@
+-- Archived queries are no longer collected and are hidden from listings but keep their collected data.
+alter table queries add column archived boolean not null default false;
+
+---- create above / drop below ----
+
+alter table queries drop column if exists archived;
@@ -0,0 +1,14 @@
+-- Queries can opt in to collecting a provisional value for the current, incomplete, interval.
+alter table queries add column allow_partial boolean not null default false;
+
+-- Provisional values were collected before their interval closed and will be replaced by
+-- the final value once it has.
+alter table collections add column provisional boolean not null default false;
+
+---- create above / drop below ----
+
+delete from collections where provisional;
+
+alter table collections drop column if exists provisional;
+
+alter table queries drop column if exists allow_partial;
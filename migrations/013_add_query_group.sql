@@ -0,0 +1,6 @@
+-- The group is an optional name used to organise related queries, such as by service or team.
+alter table queries add column group_name varchar not null default '';
+
+---- create above / drop below ----
+
+alter table queries drop column if exists group_name;
@@ -0,0 +1,9 @@
+-- Optional per provider overrides of the request timeout and retry settings, the command line
+-- options are used when these are null.
+alter table providers add column request_timeout_secs integer;
+alter table providers add column max_retries integer;
+
+---- create above / drop below ----
+
+alter table providers drop column if exists max_retries;
+alter table providers drop column if exists request_timeout_secs;
@@ -0,0 +1,35 @@
+BEGIN;
+
+CREATE TYPE api_type_new AS ENUM (
+    'grafanacloud',
+    'elasticsearch',
+    'cloudwatch',
+    'fixture'
+);
+
+ALTER TABLE providers
+    ALTER COLUMN api_type TYPE api_type_new
+        USING api_type::text::api_type_new;
+
+DROP TYPE api_type;
+
+ALTER TYPE api_type_new RENAME TO api_type;
+
+CREATE TYPE auth_type_new AS ENUM (
+    'bearer_token',
+    'basic_auth',
+    'aws_access_key',
+    'bearer_token_basic_auth',
+    'aws_profile',
+    'none'
+);
+
+ALTER TABLE providers
+    ALTER COLUMN auth_type TYPE auth_type_new
+        USING auth_type::text::auth_type_new;
+
+DROP TYPE auth_type;
+
+ALTER TYPE auth_type_new RENAME TO auth_type;
+
+COMMIT;
@@ -0,0 +1,20 @@
+-- Raw responses received from providers when collecting, kept for auditing collected values.
+create table collection_responses
+(
+  query_id     integer not null,
+  seq          integer not null,
+  collected_at timestamptz not null default now(),
+  body         text not null,
+
+  -- The query_id should reference the queries table.
+  constraint fk_collection_responses_query_id foreign key (query_id) references queries (id) on delete cascade,
+
+  primary key (query_id,seq)
+
+);
+
+create index idx_collection_responses_collected_at on collection_responses (collected_at);
+
+---- create above / drop below ----
+
+drop table if exists collection_responses;
@@ -0,0 +1,29 @@
+-- Queries can opt in to having a daily rollup of their collected values maintained by the daemon.
+alter table queries add column rollup boolean not null default false;
+
+-- Daily summaries of the final values collected for each series of a query, keyed by the UTC day
+-- in which each collected interval begins.
+create table collection_rollups
+(
+  query_id    integer not null,
+  series      varchar not null default '',
+  day         date not null,
+  min_value   double precision not null,
+  max_value   double precision not null,
+  avg_value   double precision not null,
+  last_value  double precision not null,
+  count       integer not null,
+  updated_at  timestamptz not null default now(),
+
+  -- The query_id should reference the queries table.
+  constraint fk_collection_rollups_query_id foreign key (query_id) references queries (id) on delete cascade,
+
+  primary key (query_id,series,day)
+
+);
+
+---- create above / drop below ----
+
+drop table if exists collection_rollups;
+
+alter table queries drop column if exists rollup;
@@ -0,0 +1,7 @@
+-- The type of the Grafana datasource identified by a source's dataset, such as prometheus or loki.
+-- Empty means the type is derived from the query type.
+alter table sources add column datasource_type varchar not null default '';
+
+---- create above / drop below ----
+
+alter table sources drop column if exists datasource_type;
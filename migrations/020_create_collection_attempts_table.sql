@@ -0,0 +1,19 @@
+-- Records sequences for which the provider returned no data, so that sequences that repeatedly
+-- return nothing can be treated as permanently empty rather than queried on every fill.
+create table collection_attempts
+(
+  query_id        integer not null,
+  seq             integer not null,
+  attempts        integer not null default 0,
+  last_attempt_at timestamptz not null default now(),
+
+  -- The query_id should reference the queries table.
+  constraint fk_collection_attempts_query_id foreign key (query_id) references queries (id) on delete cascade,
+
+  primary key (query_id,seq)
+
+);
+
+---- create above / drop below ----
+
+drop table if exists collection_attempts;
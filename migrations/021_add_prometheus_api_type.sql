@@ -0,0 +1,23 @@
+BEGIN;
+
+CREATE TYPE api_type_new AS ENUM (
+    'grafanacloud',
+    'elasticsearch',
+    'cloudwatch',
+    'fixture',
+    'prometheus'
+);
+
+ALTER TABLE providers
+    ALTER COLUMN api_type TYPE api_type_new
+        USING api_type::text::api_type_new;
+
+DROP TYPE api_type;
+
+ALTER TYPE api_type_new RENAME TO api_type;
+
+-- Static headers sent with every request made to the provider, such as those required by gateways
+-- or multi-tenant backends.
+ALTER TABLE providers ADD COLUMN extra_headers jsonb NOT NULL DEFAULT '{}';
+
+COMMIT;
@@ -0,0 +1,10 @@
+-- How to handle a query that is expected to return a single point for an interval but returns more.
+alter table queries add column multipoint_policy varchar not null default 'error';
+
+alter table queries add constraint ck_queries_multipoint_policy check (multipoint_policy in ('error','first','last','max'));
+
+---- create above / drop below ----
+
+alter table queries drop constraint if exists ck_queries_multipoint_policy;
+
+alter table queries drop column if exists multipoint_policy;
@@ -0,0 +1,11 @@
+-- Number of most recent sequences the daemon re-collects and overwrites on each cycle, for providers whose data
+-- settles after a delay. Zero disables overwriting.
+alter table queries add column overwrite_lookback integer not null default 0;
+
+alter table queries add constraint ck_queries_overwrite_lookback check (overwrite_lookback >= 0);
+
+---- create above / drop below ----
+
+alter table queries drop constraint if exists ck_queries_overwrite_lookback;
+
+alter table queries drop column if exists overwrite_lookback;
@@ -0,0 +1,8 @@
+-- The most recent error encountered by the daemon when collecting for a query, cleared when a collection succeeds.
+alter table queries add column last_error text;
+alter table queries add column last_error_at timestamptz;
+
+---- create above / drop below ----
+
+alter table queries drop column if exists last_error_at;
+alter table queries drop column if exists last_error;
@@ -0,0 +1,22 @@
+-- Queries can opt in to having the values collected by the daemon held for review before they are promoted
+-- into the collections table.
+alter table queries add column staged boolean not null default false;
+
+create table collections_staging
+(
+  query_id     integer not null,
+  seq          integer not null,
+  series       varchar not null default '',
+  value        float not null,
+  collected_at timestamptz not null default now(),
+
+  constraint fk_collections_staging_query_id foreign key (query_id) references queries (id) on delete cascade,
+
+  primary key (query_id,series,seq)
+);
+
+---- create above / drop below ----
+
+drop table if exists collections_staging;
+
+alter table queries drop column if exists staged;
@@ -0,0 +1,7 @@
+-- Sources may override the api url of their provider, so one provider and its credentials can front several
+-- clusters or endpoints.
+alter table sources add column api_url varchar;
+
+---- create above / drop below ----
+
+alter table sources drop column if exists api_url;
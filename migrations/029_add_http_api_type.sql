@@ -0,0 +1,37 @@
+BEGIN;
+
+CREATE TYPE api_type_new AS ENUM (
+    'grafanacloud',
+    'elasticsearch',
+    'cloudwatch',
+    'fixture',
+    'prometheus',
+    'http'
+);
+
+ALTER TABLE providers
+    ALTER COLUMN api_type TYPE api_type_new
+        USING api_type::text::api_type_new;
+
+DROP TYPE api_type;
+
+ALTER TYPE api_type_new RENAME TO api_type;
+
+create type query_type_new as enum
+    (
+        'prometheus',
+        'elasticsearch_aggregate',
+        'cloudwatch',
+        'elasticsearch_count',
+        'http'
+    );
+
+ALTER TABLE queries
+    ALTER COLUMN query_type TYPE query_type_new
+        USING query_type::text::query_type_new;
+
+DROP TYPE query_type;
+
+ALTER TYPE query_type_new RENAME TO query_type;
+
+COMMIT;
@@ -0,0 +1,9 @@
+-- Linear transform applied to each value collected for a query before it is stored, as value*scale + offset,
+-- for converting the units reported by a provider without changing the query expression.
+alter table queries add column value_scale double precision not null default 1;
+alter table queries add column value_offset double precision not null default 0;
+
+---- create above / drop below ----
+
+alter table queries drop column if exists value_offset;
+alter table queries drop column if exists value_scale;
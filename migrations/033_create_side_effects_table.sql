@@ -0,0 +1,18 @@
+-- Records the side effects of collection, such as error reports and collection log entries, that have been
+-- emitted so that retries and overlapping daemons emit each of them only once.
+create table side_effects
+(
+  idempotency_key varchar not null primary key,
+  query_id        integer not null,
+  seq             integer not null,
+  kind            varchar not null,
+  created_at      timestamptz not null default now(),
+
+  constraint fk_side_effects_query_id foreign key (query_id) references queries (id) on delete cascade
+);
+
+create index idx_side_effects_created_at on side_effects (created_at);
+
+---- create above / drop below ----
+
+drop table if exists side_effects;
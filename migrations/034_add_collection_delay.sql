@@ -0,0 +1,6 @@
+-- The time a query waits after an interval closes before collecting it, for providers whose data arrives late.
+alter table queries add column collection_delay_secs integer not null default 0;
+
+---- create above / drop below ----
+
+alter table queries drop column if exists collection_delay_secs;
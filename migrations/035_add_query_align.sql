@@ -0,0 +1,7 @@
+-- Whether the start of a query is expected to fall on a boundary of its interval. Queries that are deliberately
+-- offset, such as days that begin at 06:00, are not aligned.
+alter table queries add column align boolean not null default true;
+
+---- create above / drop below ----
+
+alter table queries drop column if exists align;
@@ -0,0 +1,6 @@
+-- Queries that only need their most recent value are collected by the daemon without filling older gaps.
+alter table queries add column latest_only boolean not null default false;
+
+---- create above / drop below ----
+
+alter table queries drop column if exists latest_only;
@@ -0,0 +1,8 @@
+-- The time at which the final value of a sequence was collected, used to compare the cadence at which a query
+-- is actually collected with its interval. Null for values collected before it was recorded.
+alter table collections add column collected_at timestamptz;
+alter table collections alter column collected_at set default now();
+
+---- create above / drop below ----
+
+alter table collections drop column if exists collected_at;
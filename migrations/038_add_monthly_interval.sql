@@ -0,0 +1,52 @@
+BEGIN;
+
+CREATE TYPE interval_type_new AS ENUM (
+    'hourly',
+    'daily',
+    'weekly',
+    'monthly'
+);
+
+ALTER TABLE queries
+    ALTER COLUMN interval TYPE interval_type_new
+        USING interval::text::interval_type_new;
+
+DROP TYPE interval_type;
+
+ALTER TYPE interval_type_new RENAME TO interval_type;
+
+-- months vary in length so the step is a calendar interval, multiplied by the number of intervals covered by
+-- each sequence
+create or replace function get_collected_values (
+   qid integer,        -- id of query
+   lower timestamptz,  -- start time of sequence to return, all returned values will on or after this time
+   upper timestamptz   -- end time of collected values, all returned values will be before this time
+)
+returns table (
+	seq integer,
+	date timestamptz,
+	value float
+)
+language plpgsql
+as $$
+declare
+-- variable declaration
+begin
+	return query
+	with q as (
+	  select id, start, case
+	    when interval='hourly'  then '1 hour'::interval
+	    when interval='daily'   then '1 day'::interval
+	    when interval='weekly'  then '1 week'::interval
+	    when interval='monthly' then '1 month'::interval
+	  end * interval_factor as step
+	  from queries where id=qid
+	)
+	select c.seq, q.start+c.seq*q.step as date, c.value as value
+	from q left join collections c on c.query_id = q.id
+	where q.start+c.seq*q.step >= lower
+	  and q.start+c.seq*q.step < upper
+	order by seq;
+end; $$ ;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Offset of the start of a query from the boundary of its interval, for windows that begin after the boundary
+-- such as days that start at 06:00. The start of an aligned query falls on a boundary plus this offset.
+alter table queries add column start_offset_secs integer not null default 0;
+
+---- create above / drop below ----
+
+alter table queries drop column if exists start_offset_secs;
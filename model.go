@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,56 +19,270 @@ type QueryInterval string
 func (q QueryInterval) String() string { return string(q) }
 
 const (
-	QueryIntervalHourly QueryInterval = "hourly" // query represents an hour of data
-	QueryIntervalDaily  QueryInterval = "daily"  // query represents a day of data
-	QueryIntervalWeekly QueryInterval = "weekly" // query represents a week of data
+	QueryIntervalHourly  QueryInterval = "hourly"  // query represents an hour of data
+	QueryIntervalDaily   QueryInterval = "daily"   // query represents a day of data
+	QueryIntervalWeekly  QueryInterval = "weekly"  // query represents a week of data
+	QueryIntervalMonthly QueryInterval = "monthly" // query represents a calendar month of data, starting on the first day of the month
 )
 
+// averageMonth is the average length of a calendar month, used where an approximate duration of a monthly
+// interval is sufficient.
+const averageMonth = 730*time.Hour + 30*time.Minute
+
 // WARNING: don't change field order since it is used when populating from database
 type Query struct {
-	ID         int
-	Name       string
-	Query      string
-	Interval   QueryInterval
-	Start      time.Time
-	Finish     *time.Time
-	QueryType  QueryType
-	Dataset    string
-	ProviderID int
-	ApiType    ApiType
-	ApiURL     string
-	AuthType   AuthType
+	ID                  int
+	Name                string
+	Query               string
+	Interval            QueryInterval
+	IntervalFactor      int // number of intervals covered by each sequence
+	Start               time.Time
+	Finish              *time.Time
+	QueryType           QueryType
+	Dataset             string
+	DatasourceType      string // type of Grafana datasource, empty to derive from QueryType
+	ProviderID          int
+	ApiType             ApiType
+	ApiURL              string // source's api url if set, otherwise the provider's
+	AuthType            AuthType
+	MultiSeries         bool
+	AllowPartial        bool
+	Group               string
+	Rollup              bool
+	MultipointPolicy    MultipointPolicy // how to handle more than one point for an interval when not collecting multiple series
+	OverwriteLookback   int              // number of most recent sequences to re-collect and overwrite, zero to never overwrite
+	Staged              bool             // when true the daemon writes values to staging to be promoted after review
+	ValueScale          float64          // multiplier applied to each collected value before it is stored
+	ValueOffset         float64          // added to each collected value after scaling, before it is stored
+	CollectionDelaySecs int              // time to wait after an interval closes before it is collected
+	Align               bool             // false when the start is kept as given rather than aligned to the interval boundary
+	LatestOnly          bool             // when true the daemon only collects the most recent sequence, never filling older gaps
+	StartOffsetSecs     int              // offset of the start from the interval boundary it is aligned to
+
+	RequestTimeoutSecs *int              // provider's request timeout, nil to use the default
+	MaxRetries         *int              // provider's maximum retries, nil to use the default
+	ExtraHeaders       map[string]string // provider's static headers to add to each request
 }
 
+// querySelectSQL selects the columns needed to populate a Query, in field order
+const querySelectSQL = "select q.id, q.name, q.query, q.interval, q.interval_factor, q.start, q.finish, q.query_type, s.dataset, s.datasource_type, p.id, p.api_type, coalesce(s.api_url, p.api_url), p.auth_type, q.multi_series, q.allow_partial, q.group_name, q.rollup, q.multipoint_policy, q.overwrite_lookback, q.staged, q.value_scale, q.value_offset, q.collection_delay_secs, q.align, q.latest_only, q.start_offset_secs, p.request_timeout_secs, p.max_retries, p.extra_headers from queries q join sources s on s.id=q.source_id join providers p on p.id=s.provider_id"
+
+// IntervalDuration returns the length of time covered by each sequence of the query. Since months vary in length
+// it is only approximate for monthly intervals, see SeqTime for calendar-aware sequence times.
+func (q *Query) IntervalDuration() time.Duration {
+	factor := q.IntervalFactor
+	if factor < 1 {
+		factor = 1
+	}
+	return q.Interval.Duration() * time.Duration(factor)
+}
+
+// SettledTime returns the time before which the query's provider is expected to have complete data, which
+// is now less the query's collection delay. Intervals that close after the settled time are not yet collected.
+func (q *Query) SettledTime(now time.Time) time.Time {
+	return now.Add(-time.Duration(q.CollectionDelaySecs) * time.Second)
+}
+
+// TransformValue applies the query's scale and offset to a value returned by its provider.
+func (q *Query) TransformValue(v float64) float64 {
+	return v*q.ValueScale + q.ValueOffset
+}
+
+// IntervalString returns the interval of the query in the form accepted by ParseInterval.
+func (q *Query) IntervalString() string {
+	return FormatInterval(q.Interval, q.IntervalFactor)
+}
+
+// SeqTime returns the end of the interval covered by seq, which is the start of the interval covered by seq+1.
 func (q *Query) SeqTime(seq int) time.Time {
-	switch q.Interval {
-	case QueryIntervalHourly:
-		return q.Start.Add(time.Duration(seq) * time.Hour).UTC()
-	case QueryIntervalDaily:
-		return q.Start.Add(time.Duration(seq) * time.Hour * 24).UTC()
-	case QueryIntervalWeekly:
-		return q.Start.Add(time.Duration(seq) * time.Hour * 24 * 7).UTC()
-	default:
+	if q.Interval == QueryIntervalMonthly {
+		return q.Start.UTC().AddDate(0, seq*q.intervalFactor(), 0)
+	}
+	d := q.IntervalDuration()
+	if d == 0 {
 		return time.Time{}.UTC()
 	}
+	return q.Start.Add(time.Duration(seq) * d).UTC()
+}
+
+// intervalFactor returns the number of base intervals covered by each sequence of the query.
+func (q *Query) intervalFactor() int {
+	if q.IntervalFactor < 1 {
+		return 1
+	}
+	return q.IntervalFactor
+}
+
+// StartAligned reports whether the start of the query, less its start offset, falls on a boundary of its
+// interval, as required for the windows it queries to line up with the data points returned by providers.
+func (q *Query) StartAligned() bool {
+	start := q.Start.UTC().Add(-time.Duration(q.StartOffsetSecs) * time.Second)
+	if q.Interval == QueryIntervalMonthly {
+		return start.Equal(TruncateInterval(start, q.Interval, q.IntervalFactor))
+	}
+	d := q.IntervalDuration()
+	if d == 0 {
+		return false
+	}
+	return start.Equal(start.Truncate(d))
+}
+
+// SeqDay returns the UTC day in which the interval covered by seq begins.
+func (q *Query) SeqDay(seq int) time.Time {
+	return q.SeqTime(seq - 1).Truncate(24 * time.Hour)
+}
+
+// DaySeqs returns the first and last sequence numbers of the query whose intervals begin within
+// the UTC day starting at day.
+func (q *Query) DaySeqs(day time.Time) (int, int) {
+	d := q.IntervalDuration()
+	first := ceilDiv(day.Sub(q.Start), d) + 1
+	last := ceilDiv(day.Add(24*time.Hour).Sub(q.Start), d)
+	return first, last
+}
+
+// ceilDiv returns the number of whole units in d, rounded up.
+func ceilDiv(d time.Duration, unit time.Duration) int {
+	n := int(d / unit)
+	if time.Duration(n)*unit < d {
+		n++
+	}
+	return n
 }
 
 // SeqAfter returns the next sequence number after the specified time
 // t must not be before the start of the query
 func (q *Query) SeqAfter(t time.Time) int {
-	sinceStart := t.Sub(q.Start)
-	switch q.Interval {
+	if q.Interval == QueryIntervalMonthly {
+		start, t := q.Start.UTC(), t.UTC()
+		months := (t.Year()-start.Year())*12 + int(t.Month()-start.Month())
+		if start.AddDate(0, months, 0).After(t) {
+			months--
+		}
+		return 1 + months/q.intervalFactor()
+	}
+	d := q.IntervalDuration()
+	if d == 0 {
+		return -1
+	}
+	return 1 + int(t.Sub(q.Start)/d)
+}
+
+// Duration returns the length of the interval, or zero if it is not known. Monthly intervals are given the
+// average length of a month.
+func (q QueryInterval) Duration() time.Duration {
+	switch q {
 	case QueryIntervalHourly:
-		return 1 + int(sinceStart/time.Hour)
+		return time.Hour
 	case QueryIntervalDaily:
-		return 1 + int(sinceStart/(24*time.Hour))
+		return 24 * time.Hour
 	case QueryIntervalWeekly:
-		return 1 + int(sinceStart/(7*24*time.Hour))
+		return 7 * 24 * time.Hour
+	case QueryIntervalMonthly:
+		return averageMonth
 	default:
-		return -1
+		return 0
+	}
+}
+
+// TruncateInterval returns t rounded down to a boundary of the interval. Monthly intervals are truncated to the
+// first day of the month in UTC.
+func TruncateInterval(t time.Time, interval QueryInterval, factor int) time.Time {
+	if interval == QueryIntervalMonthly {
+		t = t.UTC()
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
 	}
+	if factor < 1 {
+		factor = 1
+	}
+	return t.Truncate(interval.Duration() * time.Duration(factor))
+}
+
+// ParseInterval parses an interval given either as one of hourly, daily, weekly and monthly or as a whole
+// number of hours, days, weeks or months such as 6h, 3d, 2w or 3mo. It returns the base interval and the
+// number of base intervals covered by each sequence.
+func ParseInterval(s string) (QueryInterval, int, error) {
+	switch QueryInterval(s) {
+	case QueryIntervalHourly, QueryIntervalDaily, QueryIntervalWeekly, QueryIntervalMonthly:
+		return QueryInterval(s), 1, nil
+	}
+
+	var interval QueryInterval
+	var multiple string
+	if n, ok := strings.CutSuffix(s, "mo"); ok {
+		interval, multiple = QueryIntervalMonthly, n
+	} else if len(s) > 1 {
+		multiple = s[:len(s)-1]
+		switch s[len(s)-1] {
+		case 'h':
+			interval = QueryIntervalHourly
+		case 'd':
+			interval = QueryIntervalDaily
+		case 'w':
+			interval = QueryIntervalWeekly
+		}
+	}
+	if interval == "" || multiple == "" {
+		return "", 0, fmt.Errorf("unsupported interval %q: must be one of 'hourly','daily','weekly','monthly' or a multiple such as '6h','3d','2w','3mo'", s)
+	}
+
+	factor, err := strconv.Atoi(multiple)
+	if err != nil || factor < 1 {
+		return "", 0, fmt.Errorf("unsupported interval %q: multiple must be a positive integer", s)
+	}
+
+	return interval, factor, nil
 }
 
+// FormatInterval formats an interval and factor in the form accepted by ParseInterval.
+func FormatInterval(interval QueryInterval, factor int) string {
+	if factor <= 1 {
+		return string(interval)
+	}
+	switch interval {
+	case QueryIntervalHourly:
+		return fmt.Sprintf("%dh", factor)
+	case QueryIntervalDaily:
+		return fmt.Sprintf("%dd", factor)
+	case QueryIntervalWeekly:
+		return fmt.Sprintf("%dw", factor)
+	case QueryIntervalMonthly:
+		return fmt.Sprintf("%dmo", factor)
+	default:
+		return fmt.Sprintf("%d*%s", factor, interval)
+	}
+}
+
+// seqIntervalSQL returns a sql expression for the length of the interval covered by each sequence of a
+// query, with the columns of the queries table qualified by prefix.
+func seqIntervalSQL(prefix string) string {
+	return fmt.Sprintf("(case %[1]sinterval when 'hourly' then '1 hour'::interval when 'daily' then '1 day'::interval when 'weekly' then '1 week'::interval when 'monthly' then '1 month'::interval end * %[1]sinterval_factor)", prefix)
+}
+
+// settledTimeSQL returns sql for the settled time of a query at time t, see Query.SettledTime.
+func settledTimeSQL(t string) string {
+	return fmt.Sprintf("(%s::timestamptz-make_interval(secs => collection_delay_secs))", t)
+}
+
+// lastSeqSQL returns a sql expression for the last sequence of a query whose interval ends at or before the
+// time given by the sql expression t, for use where the columns of the queries table are unqualified. Monthly
+// intervals count the whole calendar months in UTC between the start and t.
+func lastSeqSQL(t string) string {
+	age := fmt.Sprintf("age(%s at time zone 'UTC', start at time zone 'UTC')", t)
+	return fmt.Sprintf("(case when interval='monthly' then floor((date_part('year', %[1]s)*12 + date_part('month', %[1]s)) / interval_factor) else floor(extract(epoch from %[2]s-start) / extract(epoch from %[3]s)) end)::integer", age, t, seqIntervalSQL(""))
+}
+
+// A MultipointPolicy determines how a query that is expected to collect a single point for an interval
+// handles a result containing more than one.
+type MultipointPolicy string
+
+const (
+	MultipointPolicyError MultipointPolicy = "error" // fail the collection
+	MultipointPolicyFirst MultipointPolicy = "first" // use the first point returned
+	MultipointPolicyLast  MultipointPolicy = "last"  // use the last point returned
+	MultipointPolicyMax   MultipointPolicy = "max"   // use the point with the largest value
+)
+
 type ApiType string
 
 func (t ApiType) String() string { return string(t) }
@@ -73,6 +291,10 @@ const (
 	ApiTypeGrafanaCloud  ApiType = "grafanacloud"
 	ApiTypeElasticSearch ApiType = "elasticsearch"
 	ApiTypeCloudWatch    ApiType = "cloudwatch"
+	ApiTypeFixture       ApiType = "fixture" // local file of values, for development and testing
+	ApiTypePrometheus    ApiType = "prometheus"
+	ApiTypeHTTP          ApiType = "http"          // bespoke json api described by the query, see HTTPQuerier
+	ApiTypeGrafanaProxy  ApiType = "grafana_proxy" // prometheus datasource behind a grafana datasource proxy
 )
 
 type AuthType string
@@ -80,9 +302,12 @@ type AuthType string
 func (t AuthType) String() string { return string(t) }
 
 const (
-	AuthTypeBearerToken  AuthType = "bearer_token"
-	AuthTypeBasicAuth    AuthType = "basic_auth"
-	AuthTypeAWSAccessKey AuthType = "aws_access_key"
+	AuthTypeBearerToken          AuthType = "bearer_token"
+	AuthTypeBasicAuth            AuthType = "basic_auth"
+	AuthTypeAWSAccessKey         AuthType = "aws_access_key"
+	AuthTypeBearerTokenBasicAuth AuthType = "bearer_token_basic_auth" // basic auth for a gateway plus a bearer token for the upstream api
+	AuthTypeAWSProfile           AuthType = "aws_profile"             // named profile from the shared aws config files
+	AuthTypeNone                 AuthType = "none"                    // no authentication required
 )
 
 type QueryType string
@@ -93,17 +318,25 @@ const (
 	QueryTypePrometheus             QueryType = "prometheus"
 	QueryTypeElasticSearchAggregate QueryType = "elasticsearch_aggregate"
 	QueryTypeCloudWatch             QueryType = "cloudwatch"
+	QueryTypeElasticSearchCount     QueryType = "elasticsearch_count"
+	QueryTypeHTTP                   QueryType = "http"
+	QueryTypeCloudWatchLogs         QueryType = "cloudwatch_logs" // cloudwatch logs insights query
 )
 
 // WARNING: don't change field order since it is used when populating from database
 type Source struct {
-	ID         int
-	Name       string
-	Dataset    string
-	ProviderID int
-	ApiType    ApiType
-	ApiURL     string
-	AuthType   AuthType
+	ID             int
+	Name           string
+	Dataset        string
+	DatasourceType string
+	ProviderID     int
+	ApiType        ApiType
+	ApiURL         string
+	AuthType       AuthType
+
+	RequestTimeoutSecs *int
+	MaxRetries         *int
+	ExtraHeaders       map[string]string
 }
 
 type SecretType string
@@ -117,22 +350,46 @@ const (
 	SecretTypeAccessKeyID     SecretType = "access_key_id"
 	SecretTypeSecretAccessKey SecretType = "secret_access_key"
 	SecretTypeRegion          SecretType = "region"
+	SecretTypeProfile         SecretType = "profile"
+	SecretTypeTenantID        SecretType = "tenant_id" // optional for any auth type
 )
 
 type DataPoint struct {
-	Seq   int
-	Time  time.Time
-	Value float64
+	Seq         int
+	Time        time.Time
+	Value       float64
+	Series      string // label set identifying the series the value belongs to, empty for single series queries
+	Provisional bool   // true if the value was collected before the end of its interval
+}
+
+// FormatSeriesLabels formats a label set in the conventional prometheus form, with labels
+// sorted by name, for use as a series discriminator.
+func FormatSeriesLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%q", name, labels[name])
+	}
+	return "{" + strings.Join(parts, ",") + "}"
 }
 
 type CollectionValue struct {
-	Seq   int
-	Time  time.Time
-	Value *float64
+	Seq         int
+	Time        time.Time
+	Value       *float64
+	Provisional bool
 }
 
 type Querier interface {
-	Execute(ctx context.Context, query string, fromTime, toTime time.Time, interval QueryInterval) ([]DataPoint, error)
+	Execute(ctx context.Context, query string, fromTime, toTime time.Time, interval QueryInterval, factor int) ([]DataPoint, error)
 }
 
 func GetQuery(ctx context.Context, db *DB, queryID int) (*Query, error) {
@@ -142,7 +399,7 @@ func GetQuery(ctx context.Context, db *DB, queryID int) (*Query, error) {
 	}
 	defer conn.Release()
 
-	rows, err := conn.Query(ctx, "select q.id, q.name, q.query, q.interval, q.start, q.finish, q.query_type, s.dataset, p.id, p.api_type, p.api_url, p.auth_type from queries q join sources s on s.id=q.source_id join providers p on p.id=s.provider_id where q.id=$1", queryID)
+	rows, err := conn.Query(ctx, querySelectSQL+" where q.id=$1", queryID)
 	if err != nil {
 		return nil, fmt.Errorf("select query: %w", err)
 	}
@@ -159,6 +416,54 @@ func GetQuery(ctx context.Context, db *DB, queryID int) (*Query, error) {
 	return qry, nil
 }
 
+// SetQueryLastError records the most recent error encountered when collecting for a query.
+func SetQueryLastError(ctx context.Context, db *DB, queryID int, msg string) error {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "update queries set last_error=$2, last_error_at=now() where id=$1", queryID, msg); err != nil {
+		return fmt.Errorf("exec: %w", err)
+	}
+	return nil
+}
+
+// ClearQueryLastError removes any error recorded for a query.
+func ClearQueryLastError(ctx context.Context, db *DB, queryID int) error {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "update queries set last_error=null, last_error_at=null where id=$1 and last_error is not null", queryID); err != nil {
+		return fmt.Errorf("exec: %w", err)
+	}
+	return nil
+}
+
+// GetQueryLastError returns the most recent error recorded for a query and when it occurred, or nils if
+// the last collection succeeded.
+func GetQueryLastError(ctx context.Context, db *DB, queryID int) (*string, *time.Time, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	var msg *string
+	var at *time.Time
+	if err := conn.QueryRow(ctx, "select last_error, last_error_at from queries where id=$1", queryID).Scan(&msg, &at); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("query: %w", err)
+	}
+	return msg, at, nil
+}
+
 func GetSource(ctx context.Context, db *DB, sourceID int) (*Source, error) {
 	conn, err := db.NewConn(ctx)
 	if err != nil {
@@ -166,7 +471,7 @@ func GetSource(ctx context.Context, db *DB, sourceID int) (*Source, error) {
 	}
 	defer conn.Release()
 
-	rows, err := conn.Query(ctx, "select s.id, s.name, s.dataset, p.id, p.api_type, p.api_url, p.auth_type from sources s join providers p on p.id=s.provider_id where s.id=$1", sourceID)
+	rows, err := conn.Query(ctx, "select s.id, s.name, s.dataset, s.datasource_type, p.id, p.api_type, coalesce(s.api_url, p.api_url), p.auth_type, p.request_timeout_secs, p.max_retries, p.extra_headers from sources s join providers p on p.id=s.provider_id where s.id=$1", sourceID)
 	if err != nil {
 		return nil, fmt.Errorf("select source: %w", err)
 	}
@@ -190,7 +495,7 @@ func FetchActiveQueries(ctx context.Context, db *DB) ([]*Query, error) {
 	}
 	defer conn.Release()
 
-	rows, err := conn.Query(ctx, "select q.id, q.name, q.query, q.interval, q.start, NULL, q.query_type, s.dataset, p.id, p.api_type, p.api_url, p.auth_type from queries q join sources s on s.id=q.source_id join providers p on p.id=s.provider_id where (q.finish is null or q.finish > now())")
+	rows, err := conn.Query(ctx, querySelectSQL+" where (q.finish is null or q.finish > now()) and not q.archived")
 	if err != nil {
 		return nil, fmt.Errorf("query: %w", err)
 	}
@@ -204,7 +509,70 @@ func FetchActiveQueries(ctx context.Context, db *DB) ([]*Query, error) {
 	return qs, nil
 }
 
-func FindCollectionGaps(ctx context.Context, db *DB, queryID int) ([]int, error) {
+// FindOrphanedQueries returns the ids of active queries whose source or its provider no longer exists, which
+// are omitted by FetchActiveQueries and so are not collected.
+func FindOrphanedQueries(ctx context.Context, db *DB) ([]int, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "select q.id from queries q left join sources s on s.id=q.source_id left join providers p on p.id=s.provider_id where (s.id is null or p.id is null) and (q.finish is null or q.finish > now()) and not q.archived order by q.id")
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, fmt.Errorf("collect rows: %w", err)
+	}
+
+	return ids, nil
+}
+
+// FetchActiveProviderQueries returns the active queries of sources belonging to the provider, ordered by id.
+func FetchActiveProviderQueries(ctx context.Context, db *DB, providerID int) ([]*Query, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, querySelectSQL+" where p.id=$1 and (q.finish is null or q.finish > now()) and not q.archived order by q.id", providerID)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	qs, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByPos[Query])
+	if err != nil {
+		return nil, fmt.Errorf("collect rows: %w", err)
+	}
+
+	return qs, nil
+}
+
+// defaultMaxEmptyAttempts is the default number of times the provider may return no data for a sequence before
+// it is treated as permanently empty.
+const defaultMaxEmptyAttempts = 3
+
+// collectionGapSQL returns a condition that is true when seq of the query has no final value in either the
+// collection or staging and has not been treated as permanently empty after maxEmptyAttempts attempts that
+// returned no data, or at all if maxEmptyAttempts is zero. It is shared by FindCollectionGaps and
+// CountCollectionGaps so that they agree on what is a gap.
+func collectionGapSQL(queryID, seq, maxEmptyAttempts string) string {
+	return `not exists (select 1 from collections c where c.query_id=` + queryID + ` and c.seq=` + seq + ` and not c.provisional)
+			and not exists (select 1 from collections_staging st where st.query_id=` + queryID + ` and st.seq=` + seq + `)
+			and (` + maxEmptyAttempts + ` <= 0 or coalesce((select a.attempts from collection_attempts a where a.query_id=` + queryID + ` and a.seq=` + seq + `),0) < ` + maxEmptyAttempts + `)`
+}
+
+// FindCollectionGaps returns the sequences that have not been collected for the query, excluding those
+// awaiting promotion from staging. Sequences for which the
+// provider has returned no data on at least maxEmptyAttempts attempts are treated as permanently empty and are
+// excluded, unless maxEmptyAttempts is zero.
+func FindCollectionGaps(ctx context.Context, db *DB, queryID int, maxEmptyAttempts int) ([]int, error) {
 	conn, err := db.NewConn(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("connect: %w", err)
@@ -212,20 +580,15 @@ func FindCollectionGaps(ctx context.Context, db *DB, queryID int) ([]int, error)
 	defer conn.Release()
 
 	sql := `with q as (
-			  select start, case
-			    when interval='hourly' then extract('hour' from least($2,coalesce(finish,$2))-start)::integer
-			    when interval='daily'  then extract('day' from least($2,coalesce(finish,$2))-start)::integer
-			    when interval='weekly' then extract('day' from least($2,coalesce(finish,$2))-start)::integer/7
-			    else 0
-			  end as last
+			  select start, ` + lastSeqSQL("least("+settledTimeSQL("$2")+",coalesce(finish,$2))") + ` as last
 			  from queries where id=$1
 			)
 			select expected as seq
 			from q, generate_series(0, q.last, 1) expected
-			left join collections c on expected = c.seq and c.query_id=$1
-			where c.seq is null;`
+			where ` + collectionGapSQL("$1", "expected", "$3") + `
+			order by expected;`
 
-	rows, err := conn.Query(ctx, sql, queryID, time.Now().UTC())
+	rows, err := conn.Query(ctx, sql, queryID, time.Now().UTC(), maxEmptyAttempts)
 	if err != nil {
 		return nil, fmt.Errorf("query: %w", err)
 	}
@@ -239,7 +602,336 @@ func FindCollectionGaps(ctx context.Context, db *DB, queryID int) ([]int, error)
 	return seqs, nil
 }
 
-func GetCollectionValues(ctx context.Context, db *DB, queryID int, from *int, to *int) ([]CollectionValue, error) {
+// Rollup is a summary of the final values collected for a series of a query during a single UTC day.
+// WARNING: don't change field order since it is used when populating from database
+type Rollup struct {
+	Day    time.Time
+	Series string
+	Min    float64
+	Max    float64
+	Avg    float64
+	Last   float64
+	Count  int
+}
+
+// UpdateCollectionRollup recomputes the daily rollup of every series of the query for the day
+// in which the interval of seq begins.
+func UpdateCollectionRollup(ctx context.Context, db *DB, q *Query, seq int) error {
+	if q.IntervalDuration() == 0 || q.IntervalDuration() > 24*time.Hour {
+		return fmt.Errorf("rollups are only supported for queries with intervals of a day or less")
+	}
+
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	day := q.SeqDay(seq)
+	first, last := q.DaySeqs(day)
+
+	sql := `insert into collection_rollups(query_id,series,day,min_value,max_value,avg_value,last_value,count)
+			select query_id, series, $2::date, min(value), max(value), avg(value), (array_agg(value order by seq desc))[1], count(*)
+			from collections
+			where query_id=$1 and seq between $3 and $4 and not provisional
+			group by query_id, series
+			on conflict(query_id,series,day) do update set
+			  min_value=excluded.min_value, max_value=excluded.max_value, avg_value=excluded.avg_value,
+			  last_value=excluded.last_value, count=excluded.count, updated_at=now();`
+
+	if _, err := conn.Exec(ctx, sql, q.ID, day, first, last); err != nil {
+		return fmt.Errorf("exec: %w", err)
+	}
+
+	return nil
+}
+
+// GetCollectionRollups returns the daily rollups of a series of a query between the from and to days inclusive.
+// A nil from or to leaves the range open at that end.
+func GetCollectionRollups(ctx context.Context, db *DB, queryID int, series string, from, to *time.Time) ([]*Rollup, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	args := []any{queryID, series}
+	sql := "select day, series, min_value, max_value, avg_value, last_value, count from collection_rollups where query_id=$1 and series=$2"
+	if from != nil {
+		args = append(args, *from)
+		sql += fmt.Sprintf(" and day >= $%d::date", len(args))
+	}
+	if to != nil {
+		args = append(args, *to)
+		sql += fmt.Sprintf(" and day <= $%d::date", len(args))
+	}
+	sql += " order by day"
+
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+
+	rs, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByPos[Rollup])
+	if err != nil {
+		return nil, fmt.Errorf("collect: %w", err)
+	}
+
+	return rs, nil
+}
+
+// RecordEmptyCollection records an attempt to collect a sequence for which the provider returned no data
+// and returns the number of such attempts made for the sequence.
+func RecordEmptyCollection(ctx context.Context, db *DB, queryID int, seq int) (int, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	var attempts int
+	err = conn.QueryRow(ctx, "insert into collection_attempts(query_id,seq,attempts) values ($1,$2,1) on conflict(query_id,seq) do update set attempts=collection_attempts.attempts+1, last_attempt_at=now() returning attempts", queryID, seq).Scan(&attempts)
+	if err != nil {
+		return 0, fmt.Errorf("exec: %w", err)
+	}
+
+	return attempts, nil
+}
+
+// CountCollectionGaps returns the number of gaps up to now in the collection of every active query, keyed by
+// query ID, applying the same rules as FindCollectionGaps. Queries with no gaps are not included.
+func CountCollectionGaps(ctx context.Context, db *DB, maxEmptyAttempts int) (map[int]int, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	sql := `with q as (
+			  select id, ` + lastSeqSQL("least("+settledTimeSQL("$1")+",coalesce(finish,$1))") + ` as last
+			  from queries
+			  where (finish is null or finish > $1) and not archived
+			)
+			select q.id, count(*)
+			from q cross join lateral generate_series(0, q.last, 1) expected
+			where ` + collectionGapSQL("q.id", "expected", "$2") + `
+			group by q.id;`
+
+	rows, err := conn.Query(ctx, sql, time.Now().UTC(), maxEmptyAttempts)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	gaps := make(map[int]int)
+	for rows.Next() {
+		var queryID, count int
+		if err := rows.Scan(&queryID, &count); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		gaps[queryID] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows: %w", err)
+	}
+
+	return gaps, nil
+}
+
+// LatestSeq returns the most recent sequence of the query whose interval has closed and settled, see
+// SettledTime, or zero if there is none.
+func (q *Query) LatestSeq(now time.Time) int {
+	t := q.SettledTime(now)
+	if q.Finish != nil && q.Finish.Before(t) {
+		t = *q.Finish
+	}
+	if !t.After(q.Start) {
+		return 0
+	}
+	return q.SeqAfter(t) - 1
+}
+
+// IsCollectionGap reports whether the sequence has no final value in either the collection or staging of the query.
+func IsCollectionGap(ctx context.Context, db *DB, queryID int, seq int) (bool, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	var gap bool
+	err = conn.QueryRow(ctx, `select not exists (select 1 from collections where query_id=$1 and seq=$2 and not provisional)
+		and not exists (select 1 from collections_staging where query_id=$1 and seq=$2)`, queryID, seq).Scan(&gap)
+	if err != nil {
+		return false, fmt.Errorf("query: %w", err)
+	}
+	return gap, nil
+}
+
+// A CollectionCadence summarises when the final values of a query's sequences were actually collected.
+type CollectionCadence struct {
+	Seqs  int       // number of sequences collected
+	First time.Time // when the earliest of the sequences was collected
+	Last  time.Time // when the latest of the sequences was collected
+}
+
+// MeanGap returns the mean time between the collection of successive sequences, or zero if fewer than two
+// sequences were collected.
+func (c *CollectionCadence) MeanGap() time.Duration {
+	if c.Seqs < 2 {
+		return 0
+	}
+	return c.Last.Sub(c.First) / time.Duration(c.Seqs-1)
+}
+
+// Ratio returns the mean gap between collections relative to the interval of the query, which is close to one
+// for a query that is collected as each interval closes and larger when collection has fallen behind. It is
+// zero if the mean gap is not known.
+func (c *CollectionCadence) Ratio(q *Query) float64 {
+	d := q.IntervalDuration()
+	if d == 0 {
+		return 0
+	}
+	return float64(c.MeanGap()) / float64(d)
+}
+
+// GetCollectionCadence returns the cadence at which sequences of the query were collected since the given time.
+// Sequences collected more than once, such as for multiple series, count from their first collection.
+func GetCollectionCadence(ctx context.Context, db *DB, queryID int, since time.Time) (*CollectionCadence, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	var (
+		c           CollectionCadence
+		first, last *time.Time
+	)
+	err = conn.QueryRow(ctx, `with s as (
+		  select seq, min(collected_at) as collected_at
+		  from collections where query_id=$1 and not provisional and collected_at >= $2
+		  group by seq
+		)
+		select count(*), min(collected_at), max(collected_at) from s`, queryID, since).Scan(&c.Seqs, &first, &last)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	if first != nil {
+		c.First = *first
+	}
+	if last != nil {
+		c.Last = *last
+	}
+	return &c, nil
+}
+
+// GetLastCollectionSeq returns the highest sequence number that has a final value collected for the query
+// or nil if nothing has been collected yet.
+func GetLastCollectionSeq(ctx context.Context, db *DB, queryID int) (*int, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	var seq *int
+	if err := conn.QueryRow(ctx, "select max(seq) from collections where query_id=$1 and not provisional", queryID).Scan(&seq); err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+
+	return seq, nil
+}
+
+// A CollectionAggregate is the result of applying an aggregate function to the values collected for a query
+// within a bucket of time.
+type CollectionAggregate struct {
+	Start time.Time // start of the bucket
+	Value float64
+	Count int // number of collected values in the bucket
+}
+
+// aggregateFuncs maps the supported aggregate functions to their sql equivalents
+var aggregateFuncs = map[string]string{
+	"avg":   "avg",
+	"sum":   "sum",
+	"min":   "min",
+	"max":   "max",
+	"count": "count",
+}
+
+// GetCollectionAggregates groups the values collected for a query into buckets of the given interval, aligned
+// to the start of the query, and applies the aggregate function fn to the values in each. Buckets without any
+// collected values are omitted. from and to optionally limit the sequences included.
+func GetCollectionAggregates(ctx context.Context, db *DB, queryID int, series string, fn string, bucket QueryInterval, from, to *int) ([]CollectionAggregate, error) {
+	sqlFn, ok := aggregateFuncs[fn]
+	if !ok {
+		return nil, fmt.Errorf("unsupported aggregate function: %q", fn)
+	}
+	if bucket.Duration() == 0 {
+		return nil, fmt.Errorf("unsupported bucket interval: %q", bucket)
+	}
+
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	sql := `with q as (
+	  select start, ` + seqIntervalSQL("") + ` as intrval
+	  from queries where id=$1
+	), b as (
+	  select q.start + floor(extract(epoch from (c.seq-1)*q.intrval) / $2) * make_interval(secs => $2) as bucket, c.value
+	  from q, collections c
+	  where c.query_id=$1 and c.series=$3 and ($4::integer is null or c.seq >= $4) and ($5::integer is null or c.seq <= $5)
+	)
+	select bucket, ` + sqlFn + `(value)::double precision, count(value)::integer from b group by bucket order by bucket`
+
+	rows, err := conn.Query(ctx, sql, queryID, bucket.Duration().Seconds(), series, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+
+	aggs, err := pgx.CollectRows(rows, pgx.RowToStructByPos[CollectionAggregate])
+	if err != nil {
+		return nil, fmt.Errorf("collect rows: %w", err)
+	}
+	return aggs, nil
+}
+
+// GetCollectionPoints returns every final value collected for a query across all of its series, ordered by series
+// and sequence. Provisional values are omitted.
+func GetCollectionPoints(ctx context.Context, db *DB, q *Query) ([]DataPoint, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "select seq, series, value from collections where query_id=$1 and not provisional order by series, seq", q.ID)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	var points []DataPoint
+	for rows.Next() {
+		pt := DataPoint{}
+		if err := rows.Scan(&pt.Seq, &pt.Series, &pt.Value); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		pt.Time = q.SeqTime(pt.Seq)
+		points = append(points, pt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows: %w", err)
+	}
+
+	return points, nil
+}
+
+func GetCollectionValues(ctx context.Context, db *DB, queryID int, series string, from *int, to *int) ([]CollectionValue, error) {
 	conn, err := db.NewConn(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("connect: %w", err)
@@ -250,72 +942,46 @@ func GetCollectionValues(ctx context.Context, db *DB, queryID int, from *int, to
 	if from == nil {
 		if to == nil {
 			sql := `with q as (
-			  select start, case
-			    when interval='hourly' then '1 hour'::interval
-			    when interval='daily'  then '1 day'::interval
-			    when interval='weekly' then '1 week'::interval
-			  end as intrval, case
-			    when interval='hourly' then extract('hour' from $2-start)::integer
-			    when interval='daily'  then extract('day' from $2-start)::integer
-			    when interval='weekly' then extract('day' from $2-start)::integer/7
-			    else 0
-			  end as last
+			  select start, ` + seqIntervalSQL("") + ` as intrval, ` + lastSeqSQL("$2") + ` as last
 			  from queries where id=$1
 			)
-			select expected as seq, q.start+expected*q.intrval as date,c.value as value
+			select expected as seq, q.start+expected*q.intrval as date,c.value as value,coalesce(c.provisional,false) as provisional
 			from q, generate_series(1, q.last, 1) expected
-			left join collections c on expected = c.seq and c.query_id=$1;
+			left join collections c on expected = c.seq and c.query_id=$1 and c.series=$3;
 			`
-			rows, err = conn.Query(ctx, sql, queryID, time.Now().UTC())
+			rows, err = conn.Query(ctx, sql, queryID, time.Now().UTC(), series)
 		} else {
 			sql := `with q as (
-			  select start, case
-			    when interval='hourly' then '1 hour'::interval
-			    when interval='daily'  then '1 day'::interval
-			    when interval='weekly' then '1 week'::interval
-			  end as intrval
+			  select start, ` + seqIntervalSQL("") + ` as intrval
 			  from queries where id=$1
 			)
-			select expected as seq, q.start+expected*q.intrval as date,c.value as value
+			select expected as seq, q.start+expected*q.intrval as date,c.value as value,coalesce(c.provisional,false) as provisional
 			from q, generate_series(1, $2, 1) expected
-			left join collections c on expected = c.seq and c.query_id=$1;
+			left join collections c on expected = c.seq and c.query_id=$1 and c.series=$3;
 			`
-			rows, err = conn.Query(ctx, sql, queryID, *to)
+			rows, err = conn.Query(ctx, sql, queryID, *to, series)
 		}
 	} else {
 		if to == nil {
 			sql := `with q as (
-			  select start, case
-			    when interval='hourly' then '1 hour'::interval
-			    when interval='daily'  then '1 day'::interval
-			    when interval='weekly' then '1 week'::interval
-			  end as intrval, case
-			    when interval='hourly' then extract('hour' from $3-start)::integer
-			    when interval='daily'  then extract('day' from $3-start)::integer
-			    when interval='weekly' then extract('day' from $3-start)::integer/7
-			    else 0
-			  end as last
+			  select start, ` + seqIntervalSQL("") + ` as intrval, ` + lastSeqSQL("$3") + ` as last
 			  from queries where id=$1
 			)
-			select expected as seq, q.start+expected*q.intrval as date,c.value as value
+			select expected as seq, q.start+expected*q.intrval as date,c.value as value,coalesce(c.provisional,false) as provisional
 			from q, generate_series($2, q.last, 1) expected
-			left join collections c on expected = c.seq and c.query_id=$1;
+			left join collections c on expected = c.seq and c.query_id=$1 and c.series=$4;
 			`
-			rows, err = conn.Query(ctx, sql, queryID, *from, time.Now().UTC())
+			rows, err = conn.Query(ctx, sql, queryID, *from, time.Now().UTC(), series)
 		} else {
 			sql := `with q as (
-			  select start, case
-			    when interval='hourly' then '1 hour'::interval
-			    when interval='daily'  then '1 day'::interval
-			    when interval='weekly' then '1 week'::interval
-			  end as intrval
+			  select start, ` + seqIntervalSQL("") + ` as intrval
 			  from queries where id=$1
 			)
-			select expected as seq, q.start+expected*q.intrval as date,c.value as value
+			select expected as seq, q.start+expected*q.intrval as date,c.value as value,coalesce(c.provisional,false) as provisional
 			from q, generate_series($2, $3, 1) expected
-			left join collections c on expected = c.seq and c.query_id=$1;
+			left join collections c on expected = c.seq and c.query_id=$1 and c.series=$4;
 			`
-			rows, err = conn.Query(ctx, sql, queryID, *from, *to)
+			rows, err = conn.Query(ctx, sql, queryID, *from, *to, series)
 		}
 	}
 
@@ -332,7 +998,11 @@ func GetCollectionValues(ctx context.Context, db *DB, queryID int, from *int, to
 	return points, nil
 }
 
-func WriteCollectionSeq(ctx context.Context, db *DB, queryID int, seq int, value float64, force bool) error {
+// insertCollectionSQL inserts a collected value. A provisional value that is already stored for
+// the sequence is replaced but a final value is left in place, in which case no row is affected.
+const insertCollectionSQL = "insert into collections(query_id,seq,series,value,provisional) values ($1,$2,$3,$4,$5) on conflict(query_id,series,seq) do update set value=excluded.value, provisional=excluded.provisional, collected_at=now() where collections.provisional"
+
+func WriteCollectionSeq(ctx context.Context, db *DB, queryID int, pt DataPoint, force bool) error {
 	conn, err := db.NewConn(ctx)
 	if err != nil {
 		return fmt.Errorf("connect: %w", err)
@@ -345,15 +1015,19 @@ func WriteCollectionSeq(ctx context.Context, db *DB, queryID int, seq int, value
 	}
 	defer tx.Rollback(ctx)
 
-	sql := "insert into collections(query_id,seq,value) values ($1,$2,$3)"
+	sql := insertCollectionSQL
 	if force {
-		sql += " on conflict(query_id,seq) do update set value=excluded.value"
+		// overwriting a final value keeps the time it was first collected
+		sql = "insert into collections(query_id,seq,series,value,provisional) values ($1,$2,$3,$4,$5) on conflict(query_id,series,seq) do update set value=excluded.value, provisional=excluded.provisional, collected_at=case when collections.provisional then now() else collections.collected_at end"
 	}
 
-	_, err = tx.Exec(ctx, sql, queryID, seq, value)
+	tag, err := tx.Exec(ctx, sql, queryID, pt.Seq, pt.Series, pt.Value, pt.Provisional)
 	if err != nil {
 		return fmt.Errorf("exec: %w", err)
 	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("sequence %d has already been collected", pt.Seq)
+	}
 
 	err = tx.Commit(ctx)
 	if err != nil {
@@ -363,6 +1037,187 @@ func WriteCollectionSeq(ctx context.Context, db *DB, queryID int, seq int, value
 	return nil
 }
 
+// insertStagedCollectionSQL writes a collected value to staging, replacing any value already staged for the
+// sequence.
+const insertStagedCollectionSQL = "insert into collections_staging(query_id,seq,series,value) values ($1,$2,$3,$4) on conflict(query_id,series,seq) do update set value=excluded.value, collected_at=now()"
+
+// WriteStagedCollectionSeq writes a collected value to staging, replacing any value already staged for the
+// sequence, where it is held until promoted into the collection.
+func WriteStagedCollectionSeq(ctx context.Context, db *DB, queryID int, pt DataPoint) error {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, insertStagedCollectionSQL, queryID, pt.Seq, pt.Series, pt.Value)
+	if err != nil {
+		return fmt.Errorf("exec: %w", err)
+	}
+	return nil
+}
+
+// GetStagedCollectionValues returns the values staged for a series of a query, keyed by sequence. from and to
+// optionally limit the sequences returned.
+func GetStagedCollectionValues(ctx context.Context, db *DB, queryID int, series string, from, to *int) (map[int]float64, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "select seq, value from collections_staging where query_id=$1 and series=$2 and ($3::integer is null or seq >= $3) and ($4::integer is null or seq <= $4)", queryID, series, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	values := make(map[int]float64)
+	for rows.Next() {
+		var seq int
+		var value float64
+		if err := rows.Scan(&seq, &value); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		values[seq] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows: %w", err)
+	}
+	return values, nil
+}
+
+// PromoteStagedCollections moves the values staged for a query into its collection, replacing any existing
+// values, and returns the sequences promoted. from and to optionally limit the sequences promoted.
+func PromoteStagedCollections(ctx context.Context, db *DB, queryID int, from, to *int) ([]int, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `with promoted as (
+		  delete from collections_staging
+		  where query_id=$1 and ($2::integer is null or seq >= $2) and ($3::integer is null or seq <= $3)
+		  returning query_id, seq, series, value, collected_at
+		), inserted as (
+		  insert into collections(query_id,seq,series,value,provisional,collected_at)
+		  select query_id, seq, series, value, false, collected_at from promoted
+		  on conflict(query_id,series,seq) do update set value=excluded.value, provisional=false, collected_at=excluded.collected_at
+		  returning seq
+		)
+		select distinct seq from inserted order by seq`, queryID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+
+	seqs, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, fmt.Errorf("collect rows: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	return seqs, nil
+}
+
+// WriteCollectionResponse stores the raw provider response received when collecting seq, replacing
+// any previously stored response.
+func WriteCollectionResponse(ctx context.Context, db *DB, queryID int, seq int, body []byte) error {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "insert into collection_responses(query_id,seq,body) values ($1,$2,$3) on conflict(query_id,seq) do update set body=excluded.body, collected_at=now()", queryID, seq, string(body))
+	if err != nil {
+		return fmt.Errorf("exec: %w", err)
+	}
+
+	return nil
+}
+
+// Kinds of side effect of a collection that are emitted at most once.
+const (
+	SideEffectErrorReport   = "error_report"
+	SideEffectCollectionLog = "collection_log"
+)
+
+// SideEffectKey returns the idempotency key identifying a side effect of the attempt to collect a sequence of
+// the query. The key covers the window queried for the sequence, so a change to the query's start or interval
+// is treated as a new attempt, and any details that distinguish separate effects of the same attempt, such
+// as the series and value written.
+func SideEffectKey(kind string, qry *Query, seq int, details ...string) (string, error) {
+	w, err := SeqWindow(qry, seq)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%d|%d|%d|%d", kind, qry.ID, seq, w.From.Unix(), w.To.Unix())
+	for _, d := range details {
+		fmt.Fprintf(h, "|%s", d)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ClaimSideEffect records that the side effect identified by key is about to be emitted, reporting whether
+// it has not been claimed before. Only the caller that successfully claims a key should emit the side effect.
+func ClaimSideEffect(ctx context.Context, db *DB, key string, kind string, queryID int, seq int) (bool, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, "insert into side_effects(idempotency_key,query_id,seq,kind) values ($1,$2,$3,$4) on conflict(idempotency_key) do nothing", key, queryID, seq, kind)
+	if err != nil {
+		return false, fmt.Errorf("exec: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// PruneSideEffects deletes the records of side effects emitted before the given time and returns the number
+// deleted.
+func PruneSideEffects(ctx context.Context, db *DB, before time.Time) (int64, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, "delete from side_effects where created_at < $1", before)
+	if err != nil {
+		return 0, fmt.Errorf("exec: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// PruneCollectionResponses deletes raw provider responses collected before the given time and
+// returns the number deleted.
+func PruneCollectionResponses(ctx context.Context, db *DB, before time.Time) (int64, error) {
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, "delete from collection_responses where collected_at < $1", before)
+	if err != nil {
+		return 0, fmt.Errorf("exec: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
 func GetEnumValues(ctx context.Context, db *DB, name string) ([]string, error) {
 	conn, err := db.NewConn(ctx)
 	if err != nil {
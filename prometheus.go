@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// tenantHeader is the header used by multi-tenant Prometheus backends such as Mimir, Cortex and Thanos
+// to identify the tenant being queried.
+const tenantHeader = "X-Scope-OrgID"
+
+type PrometheusResponseJSON struct {
+	Status    string                 `json:"status"`
+	ErrorType string                 `json:"errorType,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	Data      PrometheusResponseData `json:"data"`
+}
+
+type PrometheusResponseData struct {
+	ResultType string                 `json:"resultType"`
+	Result     []PrometheusSampleJSON `json:"result"`
+}
+
+type PrometheusSampleJSON struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]any            `json:"value"` // unix time in seconds and value as a string
+}
+
+// PrometheusQuerier executes instant queries using the Prometheus HTTP api, as also provided by
+// Mimir, Cortex and Thanos.
+type PrometheusQuerier struct {
+	api         string
+	tenant      string
+	auth        HTTPAuth
+	opts        HTTPOptions
+	multiSeries bool // when true each series returned by the query is reported as separate data points
+}
+
+var _ Querier = (*PrometheusQuerier)(nil)
+
+// NewPrometheusQuerier returns a querier for the Prometheus api at the given url. When tenant is not empty
+// it is sent in the X-Scope-OrgID header.
+func NewPrometheusQuerier(api string, tenant string, auth HTTPAuth, opts HTTPOptions, multiSeries bool) (*PrometheusQuerier, error) {
+	return newPrometheusQuerier(api, "/api/v1/query", tenant, auth, opts, multiSeries)
+}
+
+// NewGrafanaProxyQuerier returns a querier for a Prometheus datasource reached through the datasource proxy of
+// the Grafana instance at the given url, for older Grafana versions that lack the unified /api/ds/query api.
+// The datasource is identified by its numeric id.
+func NewGrafanaProxyQuerier(api string, dsid string, auth HTTPAuth, opts HTTPOptions, multiSeries bool) (*PrometheusQuerier, error) {
+	dsid = strings.TrimSpace(dsid)
+	if _, err := strconv.Atoi(dsid); err != nil {
+		return nil, fmt.Errorf("datasource id must be numeric: %q", dsid)
+	}
+	return newPrometheusQuerier(api, "/api/datasources/proxy/"+dsid+"/api/v1/query", "", auth, opts, multiSeries)
+}
+
+func newPrometheusQuerier(api string, path string, tenant string, auth HTTPAuth, opts HTTPOptions, multiSeries bool) (*PrometheusQuerier, error) {
+	u, err := url.Parse(api)
+	if err != nil {
+		return nil, fmt.Errorf("invalid api url: %w", err)
+	}
+
+	u.Path = path
+
+	return &PrometheusQuerier{
+		api:         u.String(),
+		tenant:      tenant,
+		auth:        auth,
+		opts:        opts,
+		multiSeries: multiSeries,
+	}, nil
+}
+
+func (p *PrometheusQuerier) Execute(ctx context.Context, query string, fromTime, toTime time.Time, interval QueryInterval, factor int) ([]DataPoint, error) {
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("time", strconv.FormatInt(toTime.Unix(), 10))
+
+	slog.Debug("executing prometheus query", "query", query, "time", toTime, "tenant", p.tenant)
+
+	resp, err := sendRequest(ctx, p.opts, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", p.api+"?"+params.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if p.tenant != "" {
+			req.Header.Set(tenantHeader, p.tenant)
+		}
+		if err := p.auth.Apply(req); err != nil {
+			return nil, err
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body request: %w", err)
+	}
+	slog.Debug("received response", "body", string(body))
+	recordResponse(ctx, body)
+
+	var out PrometheusResponseJSON
+	if err := json.Unmarshal(body, &out); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, responseError(resp, body)
+		}
+		return nil, fmt.Errorf("failed to decode query response: %w", err)
+	}
+
+	if out.Status != "success" {
+		return nil, fmt.Errorf("query failed with status %s: %s: %s", resp.Status, out.ErrorType, out.Error)
+	}
+
+	if out.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("unsupported result type: %q", out.Data.ResultType)
+	}
+
+	// an empty vector means there was no data for the window
+	points := []DataPoint{}
+	for _, sample := range out.Data.Result {
+		pt, err := parsePrometheusSample(sample)
+		if err != nil {
+			return nil, err
+		}
+		if p.multiSeries {
+			pt.Series = FormatSeriesLabels(sample.Metric)
+		}
+		points = append(points, pt)
+	}
+
+	return points, nil
+}
+
+func parsePrometheusSample(sample PrometheusSampleJSON) (DataPoint, error) {
+	ts, ok := sample.Value[0].(float64)
+	if !ok {
+		return DataPoint{}, fmt.Errorf("unexpected sample time: %v", sample.Value[0])
+	}
+	vs, ok := sample.Value[1].(string)
+	if !ok {
+		return DataPoint{}, fmt.Errorf("unexpected sample value: %v", sample.Value[1])
+	}
+	v, err := strconv.ParseFloat(vs, 64)
+	if err != nil {
+		return DataPoint{}, fmt.Errorf("invalid sample value: %w", err)
+	}
+
+	return DataPoint{
+		Time:  time.Unix(0, int64(ts*1e9)).UTC().Truncate(time.Second),
+		Value: v,
+	}, nil
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"text/tabwriter"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/jackc/pgx/v5"
 	"github.com/urfave/cli/v2"
 )
@@ -18,7 +24,19 @@ var providerCommand = &cli.Command{
 			Name:   "list",
 			Usage:  "List known providers",
 			Action: ProviderList,
-			Flags:  union([]cli.Flag{}, dbFlags, loggingFlags, hlogDefaultTrue),
+			Flags:  union([]cli.Flag{}, listFlags, dbFlags, loggingFlags, hlogDefaultTrue),
+		},
+		{
+			Name:   "show",
+			Usage:  "Show the details of a provider, the status of its secrets and the number of sources and queries using it",
+			Action: ProviderShow,
+			Flags: union([]cli.Flag{
+				&cli.IntFlag{
+					Name:     "id",
+					Required: true,
+					Usage:    "ID of provider.",
+				},
+			}, dbFlags, loggingFlags),
 		},
 		{
 			Name:   "add",
@@ -42,8 +60,45 @@ var providerCommand = &cli.Command{
 				},
 				&cli.StringFlag{
 					Name:     "auth-type",
+					Required: false,
+					Usage:    "Type of authentication used by provider, such as bearer_token or basic_auth. Defaults to bearer_token for grafanacloud and grafana_proxy providers.",
+				},
+				&cli.DurationFlag{
+					Name:     "request-timeout",
+					Required: false,
+					Usage:    "Maximum time allowed for each request made to the provider, overriding the default.",
+				},
+				&cli.IntFlag{
+					Name:     "max-retries",
+					Required: false,
+					Usage:    "Number of times a failed request to the provider is retried, overriding the default.",
+				},
+				&cli.StringSliceFlag{
+					Name:     "header",
+					Required: false,
+					Usage:    "Header to add to every request made to the provider, in the form `NAME=VALUE`. References to environment variables in the form ${NAME} in the value are replaced when the request is made. May be repeated.",
+				},
+			}, dbFlags, loggingFlags),
+		},
+		{
+			Name:   "cloudwatch-metrics",
+			Usage:  "List the CloudWatch metrics and their dimensions that are available to a cloudwatch provider",
+			Action: ProviderCloudWatchMetrics,
+			Flags: union([]cli.Flag{
+				&cli.IntFlag{
+					Name:     "id",
 					Required: true,
-					Usage:    "URL of api supported by provider.",
+					Usage:    "ID of provider.",
+				},
+				&cli.StringFlag{
+					Name:     "namespace",
+					Required: false,
+					Usage:    "Only list metrics in this namespace, such as AWS/EC2.",
+				},
+				&cli.StringFlag{
+					Name:     "region",
+					Required: false,
+					Usage:    "Region to list metrics for, overriding the region of the provider's credentials.",
 				},
 			}, dbFlags, loggingFlags),
 		},
@@ -55,7 +110,7 @@ var providerCommand = &cli.Command{
 		},
 		{
 			Name:   "check-env",
-			Usage:  "List expected environment variables for provider secrets.",
+			Usage:  "List expected environment variables for provider secrets and where each was found, including secret files.",
 			Action: ProviderCheckEnv,
 			Flags:  union([]cli.Flag{}, dbFlags, loggingFlags),
 		},
@@ -66,13 +121,24 @@ func ProviderList(cc *cli.Context) error {
 	ctx := cc.Context
 	setupLogging()
 
+	orderLimit, err := listOrderLimit(cc, map[string]string{
+		"id":        "id",
+		"name":      "name",
+		"api-type":  "api_type",
+		"api-url":   "api_url",
+		"auth-type": "auth_type",
+	}, "id")
+	if err != nil {
+		return err
+	}
+
 	db := NewDB(dbConnStr())
 	conn, err := db.NewConn(ctx)
 	if err != nil {
 		return fmt.Errorf("connect: %w", err)
 	}
 
-	rows, err := conn.Query(ctx, "select id, name, api_type, api_url, auth_type from providers;")
+	rows, err := conn.Query(ctx, "select id, name, api_type, api_url, auth_type from providers"+orderLimit)
 	if err != nil {
 		return fmt.Errorf("query: %w", err)
 	}
@@ -125,7 +191,48 @@ func ProviderAdd(cc *cli.Context) error {
 	}
 
 	if authType == "" {
-		return fmt.Errorf("auth type must be supplied")
+		switch ApiType(apiType) {
+		case ApiTypeGrafanaCloud, ApiTypeGrafanaProxy:
+			authType = string(AuthTypeBearerToken)
+		default:
+			return fmt.Errorf("auth type must be supplied")
+		}
+	}
+
+	// queriers other than cloudwatch authenticate their requests with HTTPAuth, see HTTPAuth.Apply
+	if ApiType(apiType) != ApiTypeCloudWatch {
+		switch AuthType(authType) {
+		case AuthTypeAWSAccessKey, AuthTypeAWSProfile:
+			return fmt.Errorf("auth type %s is only supported by cloudwatch providers", authType)
+		}
+	}
+
+	var requestTimeoutSecs *int
+	if cc.IsSet("request-timeout") {
+		secs := int(cc.Duration("request-timeout").Seconds())
+		if secs < 0 {
+			return fmt.Errorf("request timeout must not be negative")
+		}
+		requestTimeoutSecs = &secs
+	}
+
+	var maxRetries *int
+	if cc.IsSet("max-retries") {
+		n := cc.Int("max-retries")
+		if n < 0 {
+			return fmt.Errorf("max retries must not be negative")
+		}
+		maxRetries = &n
+	}
+
+	headers := make(map[string]string)
+	for _, h := range cc.StringSlice("header") {
+		name, value, ok := strings.Cut(h, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return fmt.Errorf("header must be in the form NAME=VALUE: %q", h)
+		}
+		headers[http.CanonicalHeaderKey(name)] = value
 	}
 
 	db := NewDB(dbConnStr())
@@ -148,7 +255,7 @@ func ProviderAdd(cc *cli.Context) error {
 	}
 	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(ctx, "insert into providers(name,api_type,api_url,auth_type) values ($1,$2,$3,$4)", name, apiType, apiURL, authType)
+	_, err = tx.Exec(ctx, "insert into providers(name,api_type,api_url,auth_type,request_timeout_secs,max_retries,extra_headers) values ($1,$2,$3,$4,$5,$6,$7)", name, apiType, apiURL, authType, requestTimeoutSecs, maxRetries, headers)
 	if err != nil {
 		return fmt.Errorf("exec (%T): %w", err, err)
 	}
@@ -203,6 +310,10 @@ func ProviderExpectedEnv(cc *cli.Context) error {
 		for _, name := range vars {
 			providerVars[dp.ID] = append(providerVars[dp.ID], name)
 		}
+		if dp.AuthType == AuthTypeAWSAccessKey {
+			// sources may name their own region instead
+			providerVars[dp.ID] = append(providerVars[dp.ID], OptionalSecretEnvVarNames(dp.ID, dp.AuthType)[SecretTypeRegion]+" (optional)")
+		}
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
@@ -253,21 +364,26 @@ func ProviderCheckEnv(cc *cli.Context) error {
 
 	var anyMissing bool
 	statuses := make([]ProviderEnvStatus, 0)
+	ss := new(SecretStore)
 	for _, dp := range dps {
 		vars, err := SecretEnvVarNames(dp.ID, dp.AuthType)
 		if err != nil {
 			continue
 		}
 
-		for _, name := range vars {
-			_, ok := os.LookupEnv(name)
+		for ty, name := range vars {
+			// report where the secret was found, which may be the json secrets variable or a secret file
+			_, source, ok, err := ss.Lookup(dp.ID, ty, name)
+			if err != nil {
+				return err
+			}
 			if !ok {
 				anyMissing = true
 			}
 			statuses = append(statuses, ProviderEnvStatus{
 				ID:    dp.ID,
 				Name:  dp.Name,
-				Var:   name,
+				Var:   source,
 				Found: ok,
 			})
 		}
@@ -275,7 +391,7 @@ func ProviderCheckEnv(cc *cli.Context) error {
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
-	fmt.Fprintln(w, "ID\t| Name\t| Variable\t| Exists")
+	fmt.Fprintln(w, "ID\t| Name\t| Source\t| Exists")
 	for _, st := range statuses {
 		fmt.Fprintf(w, "%d\t| %s\t| %s\t| %v\n", st.ID, st.Name, st.Var, st.Found)
 	}
@@ -283,7 +399,205 @@ func ProviderCheckEnv(cc *cli.Context) error {
 		return err
 	}
 	if anyMissing {
-		return fmt.Errorf("some expected environment variables were missing")
+		return fmt.Errorf("some expected secrets were missing")
 	}
 	return nil
 }
+
+func ProviderShow(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	providerID := cc.Int("id")
+	if providerID < 0 {
+		return fmt.Errorf("ID must be a positive integer")
+	}
+
+	db := NewDB(dbConnStr())
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "select id, name, api_type, api_url, auth_type, request_timeout_secs, max_retries, extra_headers from providers where id=$1", providerID)
+	if err != nil {
+		return fmt.Errorf("query: %w", err)
+	}
+
+	type ProviderInfoRow struct {
+		ID                 int
+		Name               string
+		ApiType            ApiType
+		ApiURL             string
+		AuthType           AuthType
+		RequestTimeoutSecs *int
+		MaxRetries         *int
+		ExtraHeaders       map[string]string
+	}
+
+	dp, err := pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByPos[ProviderInfoRow])
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("provider %d not found", providerID)
+		}
+		return fmt.Errorf("collect: %w", err)
+	}
+
+	var sources, queries, active int
+	if err := conn.QueryRow(ctx, `select (select count(*) from sources where provider_id=$1),
+		count(q.id), count(q.id) filter (where (q.finish is null or q.finish > now()) and not q.archived)
+		from queries q join sources s on s.id=q.source_id where s.provider_id=$1`, providerID).Scan(&sources, &queries, &active); err != nil {
+		return fmt.Errorf("count usage: %w", err)
+	}
+
+	vars, err := SecretEnvVarNames(dp.ID, dp.AuthType)
+	if err != nil {
+		return fmt.Errorf("secret env var names: %w", err)
+	}
+
+	requestTimeout := "(default)"
+	if dp.RequestTimeoutSecs != nil {
+		requestTimeout = (time.Duration(*dp.RequestTimeoutSecs) * time.Second).String()
+	}
+	maxRetries := "(default)"
+	if dp.MaxRetries != nil {
+		maxRetries = strconv.Itoa(*dp.MaxRetries)
+	}
+	// header values may hold secrets so only their names are shown
+	headers := make([]string, 0, len(dp.ExtraHeaders))
+	for name := range dp.ExtraHeaders {
+		headers = append(headers, name)
+	}
+	sort.Strings(headers)
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
+	fmt.Fprintf(w, "ID\t| %d\n", dp.ID)
+	fmt.Fprintf(w, "Name\t| %s\n", dp.Name)
+	fmt.Fprintf(w, "API Type\t| %s\n", dp.ApiType)
+	fmt.Fprintf(w, "API URL\t| %s\n", dp.ApiURL)
+	fmt.Fprintf(w, "Auth Type\t| %s\n", dp.AuthType)
+	fmt.Fprintf(w, "Request Timeout\t| %s\n", requestTimeout)
+	fmt.Fprintf(w, "Max Retries\t| %s\n", maxRetries)
+	fmt.Fprintf(w, "Headers\t| %s\n", strings.Join(headers, ", "))
+	fmt.Fprintf(w, "Sources\t| %d\n", sources)
+	fmt.Fprintf(w, "Queries\t| %d (%d active)\n", queries, active)
+
+	ss := new(SecretStore)
+	printSecret := func(ty SecretType, name string, optional bool) error {
+		_, source, ok, err := ss.Lookup(dp.ID, ty, name)
+		if err != nil {
+			return err
+		}
+		status := "missing"
+		switch {
+		case ok:
+			status = "found in " + source
+		case optional:
+			status = "not set (optional)"
+		}
+		fmt.Fprintf(w, "Secret %s\t| %s: %s\n", ty, name, status)
+		return nil
+	}
+
+	types := make([]string, 0, len(vars))
+	for ty := range vars {
+		types = append(types, string(ty))
+	}
+	sort.Strings(types)
+	for _, ty := range types {
+		if err := printSecret(SecretType(ty), vars[SecretType(ty)], false); err != nil {
+			return err
+		}
+	}
+	optional := OptionalSecretEnvVarNames(dp.ID, dp.AuthType)
+	types = types[:0]
+	for ty := range optional {
+		types = append(types, string(ty))
+	}
+	sort.Strings(types)
+	for _, ty := range types {
+		if err := printSecret(SecretType(ty), optional[SecretType(ty)], true); err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+func ProviderCloudWatchMetrics(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	providerID := cc.Int("id")
+	if providerID < 0 {
+		return fmt.Errorf("ID must be a positive integer")
+	}
+
+	db := NewDB(dbConnStr())
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	var (
+		apiType  ApiType
+		authType AuthType
+	)
+	if err := conn.QueryRow(ctx, "select api_type, auth_type from providers where id=$1", providerID).Scan(&apiType, &authType); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("provider %d not found", providerID)
+		}
+		return fmt.Errorf("get provider: %w", err)
+	}
+	if apiType != ApiTypeCloudWatch {
+		return fmt.Errorf("metrics can only be listed for cloudwatch providers, not %s", apiType)
+	}
+
+	secrets, err := new(SecretStore).Secrets(providerID, authType)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets for provider: %w", err)
+	}
+
+	metrics, err := ListCloudWatchMetrics(ctx, authType, secrets, strings.TrimSpace(cc.String("region")), strings.TrimSpace(cc.String("namespace")))
+	if err != nil {
+		return err
+	}
+
+	type metricRow struct {
+		namespace  string
+		name       string
+		dimensions string
+	}
+	rows := make([]metricRow, 0, len(metrics))
+	for _, m := range metrics {
+		// dimensions are shown as Name=Value, the form needed in the Dimensions of a CloudWatchQuery
+		dims := make([]string, 0, len(m.Dimensions))
+		for _, d := range m.Dimensions {
+			dims = append(dims, aws.ToString(d.Name)+"="+aws.ToString(d.Value))
+		}
+		sort.Strings(dims)
+		rows = append(rows, metricRow{
+			namespace:  aws.ToString(m.Namespace),
+			name:       aws.ToString(m.MetricName),
+			dimensions: strings.Join(dims, ", "),
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].namespace != rows[j].namespace {
+			return rows[i].namespace < rows[j].namespace
+		}
+		if rows[i].name != rows[j].name {
+			return rows[i].name < rows[j].name
+		}
+		return rows[i].dimensions < rows[j].dimensions
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
+	fmt.Fprintln(w, "Namespace\t| Metric\t| Dimensions")
+	for _, r := range rows {
+		fmt.Fprintf(w, "%s\t| %s\t| %s\n", r.namespace, r.name, r.dimensions)
+	}
+	return w.Flush()
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"text/tabwriter"
@@ -21,65 +26,140 @@ var queryCommand = &cli.Command{
 			Name:   "list",
 			Usage:  "List known queries.",
 			Action: QueryList,
-			Flags:  union([]cli.Flag{}, dbFlags, loggingFlags, hlogDefaultTrue),
+			Flags: union([]cli.Flag{
+				&cli.BoolFlag{
+					Name:  "all",
+					Usage: "Include archived queries.",
+				},
+				&cli.StringFlag{
+					Name:  "group",
+					Usage: "Only list queries in this group.",
+				},
+			}, listFlags, dbFlags, loggingFlags, hlogDefaultTrue),
+		},
+		{
+			Name:   "export-rules",
+			Usage:  "Print Prometheus recording rules in YAML for the values collected by queries, for deriving alerting config from the query inventory.",
+			Action: QueryExportRules,
+			Flags: union([]cli.Flag{
+				&cli.BoolFlag{
+					Name:  "all",
+					Usage: "Include archived queries.",
+				},
+				&cli.StringFlag{
+					Name:  "group",
+					Usage: "Only export rules for queries in this group.",
+				},
+				&cli.StringFlag{
+					Name:  "metric",
+					Usage: "Name of the metric that collected values are exported to Prometheus as, with the query id in the query_id label.",
+					Value: defaultCollectionMetric,
+				},
+			}, dbFlags, loggingFlags),
+		},
+		{
+			Name:   "show",
+			Usage:  "Show the details of a query, including the last error encountered when collecting it.",
+			Action: QueryShow,
+			Flags: union([]cli.Flag{
+				&cli.IntFlag{
+					Name:     "id",
+					Required: true,
+					Usage:    "ID of query.",
+				},
+			}, dbFlags, loggingFlags),
 		},
 		{
 			Name:   "add",
 			Usage:  "Add a query.",
 			Action: QueryAdd,
+			Flags:  union(queryDefinitionFlags, dbFlags, loggingFlags),
+		},
+		{
+			Name:   "ensure",
+			Usage:  "Add a query unless one with the same name and source already exists. An existing query must match the definition unless --update is passed.",
+			Action: QueryEnsure,
 			Flags: union([]cli.Flag{
+				&cli.BoolFlag{
+					Name:  "update",
+					Usage: "Update an existing query that differs from the definition instead of failing. The start and interval cannot be changed.",
+				},
+			}, queryDefinitionFlags, dbFlags, loggingFlags),
+		},
+		{
+			Name:   "finish",
+			Usage:  "Finish a query.",
+			Action: QueryFinish,
+			Flags: union([]cli.Flag{
+				&cli.IntFlag{
+					Name:     "id",
+					Required: true,
+					Usage:    "ID of query.",
+				},
 				&cli.StringFlag{
-					Name:     "name",
+					Name:     "finish",
 					Required: true,
-					Usage:    "Name of query.",
+					Usage:    "The time at which the query's collected data should finish, a valid RFC3339 timestamp, the keyword 'now' or a time relative to the query's start or now such as 'start+90d' or 'now+30d'.",
+					Value:    "now",
 				},
+			}, dbFlags, loggingFlags),
+		},
+		{
+			Name:   "update",
+			Usage:  "Update the name, query or query type of a query, keeping its collected sequences.",
+			Action: QueryUpdate,
+			Flags: union([]cli.Flag{
 				&cli.IntFlag{
-					Name:     "source-id",
+					Name:     "id",
 					Required: true,
-					Usage:    "ID of source.",
+					Usage:    "ID of query.",
 				},
 				&cli.StringFlag{
-					Name:     "query",
-					Required: true,
-					Usage:    "Query to be executed.",
+					Name:  "name",
+					Usage: "New name of query.",
 				},
 				&cli.StringFlag{
-					Name:     "query-type",
-					Required: true,
-					Usage:    "Type of query syntax.",
+					Name:  "query",
+					Usage: "New query to execute.",
 				},
 				&cli.StringFlag{
-					Name:     "interval",
-					Required: true,
-					Usage:    "Interval at which query should be executed.",
+					Name:  "query-type",
+					Usage: "New type of query.",
 				},
 				&cli.StringFlag{
-					Name:     "start",
-					Required: true,
-					Usage:    "The time at which the query's collected data should start.",
+					Name:   "interval",
+					Usage:  "Not supported, the interval of a query cannot be changed without invalidating its collected sequences.",
+					Hidden: true,
 				},
 				&cli.StringFlag{
-					Name:     "finish",
-					Required: false,
-					Usage:    "The time at which the query's collected data should finish.",
+					Name:   "start",
+					Usage:  "Not supported, use query reseq to change the start of a query.",
+					Hidden: true,
 				},
+				queryPolicyFlag,
 			}, dbFlags, loggingFlags),
 		},
 		{
-			Name:   "finish",
-			Usage:  "Finish a query.",
-			Action: QueryFinish,
+			Name:   "archive",
+			Usage:  "Archive a query, stopping collection and hiding it from listings while retaining its collected data.",
+			Action: QueryArchive,
 			Flags: union([]cli.Flag{
 				&cli.IntFlag{
 					Name:     "id",
 					Required: true,
 					Usage:    "ID of query.",
 				},
-				&cli.StringFlag{
-					Name:     "finish",
+			}, dbFlags, loggingFlags),
+		},
+		{
+			Name:   "unarchive",
+			Usage:  "Unarchive a query, resuming collection.",
+			Action: QueryUnarchive,
+			Flags: union([]cli.Flag{
+				&cli.IntFlag{
+					Name:     "id",
 					Required: true,
-					Usage:    "The time at which the query's collected data should finish, a valid RFC3339 timestamp or the keyword 'now'.",
-					Value:    "now",
+					Usage:    "ID of query.",
 				},
 			}, dbFlags, loggingFlags),
 		},
@@ -97,7 +177,12 @@ var queryCommand = &cli.Command{
 					Name:  "seq",
 					Usage: "Sequence number of query series to execute.",
 				},
-			}, dbFlags, loggingFlags),
+				&cli.StringFlag{
+					Name:  "output",
+					Usage: "Format of output, one of 'table' or 'json'.",
+					Value: "table",
+				},
+			}, httpFlags, dbFlags, loggingFlags),
 		},
 		{
 			Name:   "nextseq",
@@ -109,6 +194,33 @@ var queryCommand = &cli.Command{
 					Required: true,
 					Usage:    "ID of query.",
 				},
+				&cli.StringFlag{
+					Name:     "time",
+					Required: false,
+					Usage:    "Show the sequence number that would be next at this time instead of the current time.",
+				},
+			}, dbFlags, loggingFlags),
+		},
+		{
+			Name:   "reseq",
+			Usage:  "Change the start of a query, renumbering collected sequences so their values keep their original times.",
+			Action: QueryReseq,
+			Flags: union([]cli.Flag{
+				&cli.IntFlag{
+					Name:     "id",
+					Required: true,
+					Usage:    "ID of query.",
+				},
+				&cli.StringFlag{
+					Name:     "old-start",
+					Required: true,
+					Usage:    "Start time the collected sequences were numbered from, which must match the query's current start.",
+				},
+				&cli.StringFlag{
+					Name:     "new-start",
+					Required: true,
+					Usage:    "New start time of the query. Must differ from the old start by a whole number of intervals.",
+				},
 			}, dbFlags, loggingFlags),
 		},
 		{
@@ -134,7 +246,7 @@ var queryCommand = &cli.Command{
 				&cli.StringFlag{
 					Name:     "interval",
 					Required: true,
-					Usage:    "Interval at which query should be executed.",
+					Usage:    "Interval at which query should be executed, one of hourly, daily, weekly or monthly or a multiple such as 6h, 3d, 2w or 3mo. Monthly intervals follow calendar months and start on the first day of the month in UTC.",
 				},
 				&cli.StringFlag{
 					Name:     "start",
@@ -145,35 +257,243 @@ var queryCommand = &cli.Command{
 					Name:  "seq",
 					Usage: "Sequence number of query series to execute.",
 				},
+				&cli.StringFlag{
+					Name:  "output",
+					Usage: "Format of output, one of 'table' or 'json'.",
+					Value: "table",
+				},
+				queryPolicyFlag,
+			}, httpFlags, dbFlags, loggingFlags),
+		},
+		{
+			Name:   "preflight",
+			Usage:  "Show the provider, auth type and secrets each query resolves to, and whether the secrets are set, without making any requests to providers.",
+			Action: QueryPreflight,
+			Flags: union([]cli.Flag{
+				&cli.IntFlag{
+					Name:  "id",
+					Usage: "ID of query.",
+				},
+				&cli.BoolFlag{
+					Name:  "all",
+					Usage: "Check all active queries.",
+				},
+			}, dbFlags, loggingFlags),
+		},
+		{
+			Name:   "cadence",
+			Usage:  "Compare the cadence at which queries have recently been collected with their intervals, flagging those that are falling behind.",
+			Action: QueryCadence,
+			Flags: union([]cli.Flag{
+				&cli.IntFlag{
+					Name:  "id",
+					Usage: "ID of query.",
+				},
+				&cli.BoolFlag{
+					Name:  "all",
+					Usage: "Check all active queries.",
+				},
+				&cli.IntFlag{
+					Name:  "window",
+					Usage: "Number of intervals of each query over which to measure its cadence.",
+					Value: cadenceWindow,
+				},
+				&cli.Float64Flag{
+					Name:  "threshold",
+					Usage: "Ratio of the mean time between collections to the interval above which a query is flagged.",
+					Value: 1.5,
+				},
 			}, dbFlags, loggingFlags),
 		},
+		{
+			Name:   "inspect",
+			Usage:  "Show the time window queried for a sequence and every point the provider returns for it.",
+			Action: QueryInspect,
+			Flags: union([]cli.Flag{
+				&cli.IntFlag{
+					Name:     "id",
+					Required: true,
+					Usage:    "ID of query.",
+				},
+				&cli.IntFlag{
+					Name:     "seq",
+					Required: true,
+					Usage:    "Sequence number to inspect.",
+				},
+			}, httpFlags, dbFlags, loggingFlags),
+		},
+	},
+}
+
+// queryDefinitionFlags are the flags that define a query, shared by the add and ensure commands.
+var queryDefinitionFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:     "name",
+		Required: true,
+		Usage:    "Name of query.",
+	},
+	&cli.IntFlag{
+		Name:     "source-id",
+		Required: true,
+		Usage:    "ID of source.",
+	},
+	&cli.StringFlag{
+		Name:     "query",
+		Required: true,
+		Usage:    "Query to be executed.",
+	},
+	&cli.StringFlag{
+		Name:     "query-type",
+		Required: true,
+		Usage:    "Type of query syntax.",
 	},
+	&cli.StringFlag{
+		Name:     "interval",
+		Required: true,
+		Usage:    "Interval at which query should be executed, one of hourly, daily, weekly or monthly or a multiple such as 6h, 3d, 2w or 3mo. Monthly intervals follow calendar months and start on the first day of the month in UTC.",
+	},
+	&cli.StringFlag{
+		Name:     "start",
+		Required: true,
+		Usage:    "The time at which the query's collected data should start.",
+	},
+	&cli.StringFlag{
+		Name:     "finish",
+		Required: false,
+		Usage:    "The time at which the query's collected data should finish, a valid RFC3339 timestamp, the keyword 'now' or a time relative to the start or now such as 'start+90d' or 'now+30d'.",
+	},
+	&cli.BoolFlag{
+		Name:     "multi-series",
+		Required: false,
+		Usage:    "Store each series returned by the query as a separate collection, keyed by its label set.",
+	},
+	&cli.StringFlag{
+		Name:     "group",
+		Required: false,
+		Usage:    "Name of the group the query belongs to.",
+	},
+	&cli.BoolFlag{
+		Name:     "allow-partial",
+		Required: false,
+		Usage:    "Collect a provisional value for the current interval before it has closed, replaced by the final value once it has.",
+	},
+	&cli.StringFlag{
+		Name:     "multipoint-policy",
+		Required: false,
+		Value:    string(MultipointPolicyError),
+		Usage:    "How to handle more than one point returned for an interval when not collecting multiple series, one of error, first, last or max.",
+	},
+	&cli.BoolFlag{
+		Name:     "rollup",
+		Required: false,
+		Usage:    "Maintain a daily rollup of the values collected for a query with an interval of a day or less.",
+	},
+	&cli.BoolFlag{
+		Name:     "staged",
+		Required: false,
+		Usage:    "Hold the values collected by the daemon in staging until they are promoted with collection promote.",
+	},
+	&cli.IntFlag{
+		Name:     "overwrite-lookback",
+		Required: false,
+		Usage:    "Number of most recent sequences the daemon re-collects and overwrites on each cycle, for providers whose data settles after a delay.",
+	},
+	&cli.Float64Flag{
+		Name:     "scale",
+		Required: false,
+		Usage:    "Multiplier applied to each collected value before it is stored, for converting the units reported by the provider.",
+		Value:    1,
+	},
+	&cli.Float64Flag{
+		Name:     "offset",
+		Required: false,
+		Usage:    "Amount added to each collected value after scaling and before it is stored.",
+	},
+	&cli.BoolFlag{
+		Name:     "align",
+		Required: false,
+		Usage:    "Truncate the start to a boundary of the interval. Set --align=false to keep the start as given so that each window begins at the same offset from the boundary.",
+		Value:    true,
+	},
+	&cli.DurationFlag{
+		Name:     "start-offset",
+		Required: false,
+		Usage:    "Offset added to the start after truncating it to the interval, for windows that begin after the boundary, such as 6h for days that start at 06:00.",
+	},
+	&cli.BoolFlag{
+		Name:     "latest-only",
+		Required: false,
+		Usage:    "Only collect the most recent sequence in the daemon, without filling older gaps, for queries whose history is not needed.",
+	},
+	&cli.DurationFlag{
+		Name:     "collection-delay",
+		Required: false,
+		Usage:    "Time to wait after an interval closes before collecting it, for providers whose data arrives late.",
+	},
+	queryPolicyFlag,
 }
 
 func QueryList(cc *cli.Context) error {
 	ctx := cc.Context
 	setupLogging()
 
+	orderLimit, err := listOrderLimit(cc, map[string]string{
+		"id":              "q.id",
+		"name":            "q.name",
+		"group":           "q.group_name",
+		"source":          "s.name",
+		"provider":        "p.name",
+		"start":           "q.start",
+		"interval":        "q.interval",
+		"type":            "q.query_type",
+		"last-collection": "last_collection",
+	}, "q.group_name, q.id")
+	if err != nil {
+		return err
+	}
+
 	db := NewDB(dbConnStr())
 	conn, err := db.NewConn(ctx)
 	if err != nil {
 		return fmt.Errorf("connect: %w", err)
 	}
 
-	rows, err := conn.Query(ctx, "select q.id, q.name, s.name, p.name, q.query, q.query_type, q.interval, q.start from queries q join sources s on s.id=q.source_id join providers p on p.id=s.provider_id")
+	var conds []string
+	var args []any
+	if !cc.Bool("all") {
+		conds = append(conds, "not q.archived")
+	}
+	if cc.IsSet("group") {
+		args = append(args, strings.TrimSpace(cc.String("group")))
+		conds = append(conds, fmt.Sprintf("q.group_name=$%d", len(args)))
+	}
+
+	sql := `select q.id, q.name, q.group_name, s.name, p.name, q.query, q.query_type, q.interval, q.interval_factor, q.start,
+		q.start + c.last_seq * ` + seqIntervalSQL("q.") + ` as last_collection
+		from queries q join sources s on s.id=q.source_id join providers p on p.id=s.provider_id
+		left join (select query_id, max(seq) as last_seq from collections where not provisional group by query_id) c on c.query_id=q.id`
+	if len(conds) > 0 {
+		sql += " where " + strings.Join(conds, " and ")
+	}
+	sql += orderLimit
+
+	rows, err := conn.Query(ctx, sql, args...)
 	if err != nil {
 		return fmt.Errorf("query: %w", err)
 	}
 
 	type QueryInfoRow struct {
-		ID           int
-		Name         string
-		SourceName   string
-		ProviderName string
-		Query        string
-		QueryType    QueryType
-		Interval     string
-		Start        time.Time
+		ID             int
+		Name           string
+		Group          string
+		SourceName     string
+		ProviderName   string
+		Query          string
+		QueryType      QueryType
+		Interval       QueryInterval
+		IntervalFactor int
+		Start          time.Time
+		LastCollection *time.Time
 	}
 
 	qis, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByPos[QueryInfoRow])
@@ -187,16 +507,48 @@ func QueryList(cc *cli.Context) error {
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
-	fmt.Fprintln(w, "ID\t| Name\t| Source\t| Provider\t| Start\t| Interval\t| Type\t| Query")
+	fmt.Fprintln(w, "ID\t| Name\t| Group\t| Source\t| Provider\t| Start\t| Interval\t| Type\t| Last Collection\t| Query")
 	for _, qi := range qis {
-		fmt.Fprintf(w, "%d\t| %s\t| %s\t| %s\t| %s\t| %s\t| %s\t| %s\n", qi.ID, qi.Name, qi.SourceName, qi.ProviderName, qi.Start.Format("2006-01-02T15:04:05Z"), qi.Interval, qi.QueryType, qi.Query)
+		last := "--"
+		if qi.LastCollection != nil {
+			last = qi.LastCollection.UTC().Format("2006-01-02T15:04:05Z")
+		}
+		fmt.Fprintf(w, "%d\t| %s\t| %s\t| %s\t| %s\t| %s\t| %s\t| %s\t| %s\t| %s\n", qi.ID, qi.Name, qi.Group, qi.SourceName, qi.ProviderName, qi.Start.Format("2006-01-02T15:04:05Z"), FormatInterval(qi.Interval, qi.IntervalFactor), qi.QueryType, last, qi.Query)
 	}
 	return w.Flush()
 }
 
-func QueryAdd(cc *cli.Context) error {
+// queryDefinition holds the definition of a query as supplied by queryDefinitionFlags.
+type queryDefinition struct {
+	Name              string
+	SourceID          int
+	Query             string
+	QueryType         string
+	Interval          QueryInterval
+	IntervalFactor    int
+	Start             time.Time
+	Finish            *time.Time
+	MultiSeries       bool
+	AllowPartial      bool
+	Group             string
+	Rollup            bool
+	MultipointPolicy  MultipointPolicy
+	OverwriteLookback int
+	Staged            bool
+	Scale             float64
+	Offset            float64
+	CollectionDelay   int // seconds
+	Align             bool
+	LatestOnly        bool
+	StartOffset       int // seconds
+}
+
+// queryDefinitionSelectSQL selects the columns of a stored query that correspond to a queryDefinition, in field order
+const queryDefinitionSelectSQL = "select name, source_id, query, query_type, interval, interval_factor, start, finish, multi_series, allow_partial, group_name, rollup, multipoint_policy, overwrite_lookback, staged, value_scale, value_offset, collection_delay_secs, align, latest_only, start_offset_secs from queries"
+
+// parseQueryDefinition reads and validates the definition of a query from the flags in queryDefinitionFlags.
+func parseQueryDefinition(cc *cli.Context, db *DB) (*queryDefinition, error) {
 	ctx := cc.Context
-	setupLogging()
 
 	name := strings.TrimSpace(cc.String("name"))
 	sourceID := cc.Int("source-id")
@@ -205,81 +557,203 @@ func QueryAdd(cc *cli.Context) error {
 	interval := strings.TrimSpace(cc.String("interval"))
 	startStr := strings.TrimSpace(cc.String("start"))
 	finishStr := strings.TrimSpace(cc.String("finish"))
+	multiSeries := cc.Bool("multi-series")
+	allowPartial := cc.Bool("allow-partial")
+	rollup := cc.Bool("rollup")
+	overwriteLookback := cc.Int("overwrite-lookback")
+	staged := cc.Bool("staged")
+	scale := cc.Float64("scale")
+	offset := cc.Float64("offset")
+	collectionDelay := cc.Duration("collection-delay")
+	align := cc.Bool("align")
+	latestOnly := cc.Bool("latest-only")
+	startOffset := cc.Duration("start-offset")
+	multipointPolicy := MultipointPolicy(strings.TrimSpace(cc.String("multipoint-policy")))
+	group := strings.TrimSpace(cc.String("group"))
 
 	if name == "" {
-		return fmt.Errorf("name must be supplied")
+		return nil, fmt.Errorf("name must be supplied")
 	}
 
 	if query == "" {
-		return fmt.Errorf("query must be supplied")
+		return nil, fmt.Errorf("query must be supplied")
 	}
 
 	if queryType == "" {
-		return fmt.Errorf("query-type must be supplied")
+		return nil, fmt.Errorf("query-type must be supplied")
 	}
 
 	if interval == "" {
-		return fmt.Errorf("interval must be supplied")
+		return nil, fmt.Errorf("interval must be supplied")
 	}
 
 	if startStr == "" {
-		return fmt.Errorf("start must be supplied")
+		return nil, fmt.Errorf("start must be supplied")
 	}
 
 	if sourceID < 0 {
-		return fmt.Errorf("source ID must be a positive integer")
+		return nil, fmt.Errorf("source ID must be a positive integer")
 	}
 
-	start, err := time.Parse("2006-01-02T15:04:05Z", startStr)
+	start, err := parseTime(startStr)
 	if err != nil {
-		// attempt to parse as unix timestamp (seconds since epoch)
-		ts, err := strconv.ParseInt(startStr, 10, 32)
-		if err != nil {
-			return fmt.Errorf("start must be a time formatted as '2006-01-02T15:04:05Z' or a unix timestamp")
+		return nil, fmt.Errorf("start %w", err)
+	}
+
+	baseInterval, intervalFactor, err := ParseInterval(interval)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateEnumValue(ctx, db, "interval_type", string(baseInterval)); err != nil {
+		return nil, fmt.Errorf("unsupported interval type %q: %w", baseInterval, err)
+	}
+	if err := validateQuery(cc, db, queryType, query); err != nil {
+		return nil, err
+	}
+
+	step := baseInterval.Duration() * time.Duration(intervalFactor)
+	if baseInterval == QueryIntervalMonthly {
+		step = 28 * 24 * time.Hour // the shortest month
+	}
+	if startOffset != 0 {
+		if !align {
+			return nil, fmt.Errorf("start-offset cannot be used with --align=false")
 		}
-		start = time.Unix(ts, 0)
+		if startOffset < 0 || startOffset >= step {
+			return nil, fmt.Errorf("start-offset must be at least zero and less than the interval")
+		}
+	}
+
+	startOrig := start
+	if align {
+		start = TruncateInterval(start, baseInterval, intervalFactor).Add(startOffset)
 	}
 
+	// a finish relative to the start is resolved against the aligned start, as stored and used by query finish
 	var finish *time.Time
 	if finishStr != "" {
-		f, err := time.Parse("2006-01-02T15:04:05Z", finishStr)
+		f, err := parseRelativeTime(finishStr, start, time.Now().UTC())
 		if err != nil {
-			// attempt to parse as unix timestamp (seconds since epoch)
-			ts, err := strconv.ParseInt(finishStr, 10, 32)
-			if err != nil {
-				return fmt.Errorf("start must be a time formatted as '2006-01-02T15:04:05Z' or a unix timestamp")
-			}
-			f = time.Unix(ts, 0)
+			return nil, fmt.Errorf("finish %w", err)
 		}
 
 		finish = &f
 	}
 
-	db := NewDB(dbConnStr())
-	if err := ValidateEnumValue(ctx, db, "interval_type", interval); err != nil {
-		return fmt.Errorf("unsupported interval type: %w", err)
+	switch multipointPolicy {
+	case MultipointPolicyError, MultipointPolicyFirst, MultipointPolicyLast, MultipointPolicyMax:
+	default:
+		return nil, fmt.Errorf("unsupported multipoint policy: must be one of 'error','first','last','max'")
 	}
-	if err := ValidateEnumValue(ctx, db, "query_type", queryType); err != nil {
-		return fmt.Errorf("unsupported query type: %w", err)
+
+	if overwriteLookback < 0 {
+		return nil, fmt.Errorf("overwrite lookback must not be negative")
 	}
 
-	startOrig := start
-	switch interval {
-	case "hourly":
-		start = start.Truncate(time.Hour)
-	case "daily":
-		start = start.Truncate(24 * time.Hour)
-	case "weekly":
-		start = start.Truncate(7 * 24 * time.Hour)
-	default:
-		return fmt.Errorf("unsupported interval: must be one of 'hourly','daily','weekly'")
+	if scale == 0 {
+		return nil, fmt.Errorf("scale must not be zero")
+	}
+
+	if collectionDelay < 0 {
+		return nil, fmt.Errorf("collection delay must not be negative")
+	}
 
+	if rollup && baseInterval.Duration()*time.Duration(intervalFactor) > 24*time.Hour {
+		return nil, fmt.Errorf("rollup is only supported for intervals of a day or less")
 	}
 
 	if !startOrig.Equal(start) {
 		slog.Info("truncated start to " + start.Format("2006-01-02T15:04:05Z"))
 	}
 
+	return &queryDefinition{
+		Name:              name,
+		SourceID:          sourceID,
+		Query:             query,
+		QueryType:         queryType,
+		Interval:          baseInterval,
+		IntervalFactor:    intervalFactor,
+		Start:             start,
+		Finish:            finish,
+		MultiSeries:       multiSeries,
+		AllowPartial:      allowPartial,
+		Group:             group,
+		Rollup:            rollup,
+		MultipointPolicy:  multipointPolicy,
+		OverwriteLookback: overwriteLookback,
+		Staged:            staged,
+		Scale:             scale,
+		Offset:            offset,
+		CollectionDelay:   int(collectionDelay / time.Second),
+		Align:             align,
+		LatestOnly:        latestOnly,
+		StartOffset:       int(startOffset / time.Second),
+	}, nil
+}
+
+// validateQuery checks that the query type is supported and that the query is valid for its type and permitted
+// by the query policy.
+func validateQuery(cc *cli.Context, db *DB, queryType string, query string) error {
+	if err := ValidateEnumValue(cc.Context, db, "query_type", queryType); err != nil {
+		return fmt.Errorf("unsupported query type: %w", err)
+	}
+	switch QueryType(queryType) {
+	case QueryTypeElasticSearchAggregate:
+		if _, err := ParseElasticSearchAggregateQuery(query); err != nil {
+			return err
+		}
+	case QueryTypeHTTP:
+		if _, err := ParseHTTPQuerySpec(query); err != nil {
+			return err
+		}
+	}
+
+	policy, err := LoadQueryPolicy(cc)
+	if err != nil {
+		return err
+	}
+	return policy.Check(QueryType(queryType), query)
+}
+
+// Diff returns the names of the fields of the definition that differ from other.
+func (d *queryDefinition) Diff(other *queryDefinition) []string {
+	var diffs []string
+	check := func(name string, same bool) {
+		if !same {
+			diffs = append(diffs, name)
+		}
+	}
+	check("query", d.Query == other.Query)
+	check("query-type", d.QueryType == other.QueryType)
+	check("interval", d.Interval == other.Interval && d.IntervalFactor == other.IntervalFactor)
+	check("start", d.Start.Equal(other.Start))
+	check("finish", (d.Finish == nil && other.Finish == nil) || (d.Finish != nil && other.Finish != nil && d.Finish.Equal(*other.Finish)))
+	check("multi-series", d.MultiSeries == other.MultiSeries)
+	check("allow-partial", d.AllowPartial == other.AllowPartial)
+	check("group", d.Group == other.Group)
+	check("rollup", d.Rollup == other.Rollup)
+	check("multipoint-policy", d.MultipointPolicy == other.MultipointPolicy)
+	check("overwrite-lookback", d.OverwriteLookback == other.OverwriteLookback)
+	check("staged", d.Staged == other.Staged)
+	check("scale", d.Scale == other.Scale)
+	check("offset", d.Offset == other.Offset)
+	check("collection-delay", d.CollectionDelay == other.CollectionDelay)
+	check("align", d.Align == other.Align)
+	check("latest-only", d.LatestOnly == other.LatestOnly)
+	check("start-offset", d.StartOffset == other.StartOffset)
+	return diffs
+}
+
+func QueryAdd(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	db := NewDB(dbConnStr())
+	def, err := parseQueryDefinition(cc, db)
+	if err != nil {
+		return err
+	}
+
 	conn, err := db.NewConn(ctx)
 	if err != nil {
 		return fmt.Errorf("connect: %w", err)
@@ -292,9 +766,8 @@ func QueryAdd(cc *cli.Context) error {
 	}
 	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(ctx, "insert into queries(name,source_id,query,query_type,interval,start,finish) values ($1,$2,$3,$4,$5,$6,$7)", name, sourceID, query, queryType, interval, start, finish)
-	if err != nil {
-		return fmt.Errorf("insert: %w", err)
+	if err := insertQuery(ctx, tx, def); err != nil {
+		return err
 	}
 
 	err = tx.Commit(ctx)
@@ -305,49 +778,134 @@ func QueryAdd(cc *cli.Context) error {
 	return nil
 }
 
-func QueryExec(cc *cli.Context) error {
+func insertQuery(ctx context.Context, tx pgx.Tx, def *queryDefinition) error {
+	_, err := tx.Exec(ctx, "insert into queries(name,source_id,query,query_type,interval,interval_factor,start,finish,multi_series,allow_partial,group_name,rollup,multipoint_policy,overwrite_lookback,staged,value_scale,value_offset,collection_delay_secs,align,latest_only,start_offset_secs) values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21)",
+		def.Name, def.SourceID, def.Query, def.QueryType, def.Interval, def.IntervalFactor, def.Start, def.Finish, def.MultiSeries, def.AllowPartial, def.Group, def.Rollup, def.MultipointPolicy, def.OverwriteLookback, def.Staged, def.Scale, def.Offset, def.CollectionDelay, def.Align, def.LatestOnly, def.StartOffset)
+	if err != nil {
+		return fmt.Errorf("insert: %w", err)
+	}
+	return nil
+}
+
+// QueryEnsure adds a query unless one with the same name and source already exists, so that query definitions
+// can be re-applied safely by provisioning tools.
+func QueryEnsure(cc *cli.Context) error {
 	ctx := cc.Context
 	setupLogging()
 
-	queryID := cc.Int("id")
-	seq := cc.Int("seq")
-
-	if queryID < 0 {
-		return fmt.Errorf("ID must be a positive integer")
+	db := NewDB(dbConnStr())
+	def, err := parseQueryDefinition(cc, db)
+	if err != nil {
+		return err
 	}
 
-	if seq <= 0 {
-		return fmt.Errorf("sequence must be greater than zero")
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
 	}
+	defer conn.Release()
 
-	db := NewDB(dbConnStr())
-
-	qry, err := GetQuery(ctx, db, queryID)
+	tx, err := conn.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("get query: %w", err)
+		return fmt.Errorf("begin transaction: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
-	ss := new(SecretStore)
-	secrets, err := ss.Secrets(qry.ProviderID, qry.AuthType)
-	if err != nil {
-		return fmt.Errorf("failed to get secrets for provider: %w", err)
+	var queryID int
+	if err := tx.QueryRow(ctx, "select id from queries where name=$1 and source_id=$2 for update", def.Name, def.SourceID).Scan(&queryID); err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("find query: %w", err)
+		}
+		if err := insertQuery(ctx, tx, def); err != nil {
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		slog.Info("added query", "name", def.Name, "source_id", def.SourceID)
+		return nil
 	}
 
-	points, err := DispatchQuery(ctx, qry, seq, secrets)
+	rows, err := tx.Query(ctx, queryDefinitionSelectSQL+" where id=$1", queryID)
 	if err != nil {
-		return fmt.Errorf("failed to execute query: %w", err)
+		return fmt.Errorf("select query: %w", err)
 	}
-
-	if len(points) == 0 {
-		return fmt.Errorf("no points found")
+	existing, err := pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByPos[queryDefinition])
+	if err != nil {
+		return fmt.Errorf("collect: %w", err)
 	}
 
-	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
-	fmt.Fprintln(w, "Seq\t| Time\t| Value")
-	for _, pt := range points {
-		fmt.Fprintf(w, "%d\t| %s\t| %v\t\n", pt.Seq, pt.Time.Format("2006-01-02T15:04:05Z"), formatFloat64(pt.Value))
+	diffs := existing.Diff(def)
+	if len(diffs) == 0 {
+		slog.Info("query already exists", "query_id", queryID, "name", def.Name, "source_id", def.SourceID)
+		return nil
 	}
-	return w.Flush()
+
+	if !cc.Bool("update") {
+		return fmt.Errorf("query %d already exists with a different definition: %s differ", queryID, strings.Join(diffs, ", "))
+	}
+	for _, d := range diffs {
+		if d == "start" || d == "interval" || d == "start-offset" {
+			return fmt.Errorf("query %d already exists with a different %s, which cannot be updated", queryID, d)
+		}
+	}
+
+	_, err = tx.Exec(ctx, "update queries set query=$2, query_type=$3, finish=$4, multi_series=$5, allow_partial=$6, group_name=$7, rollup=$8, multipoint_policy=$9, overwrite_lookback=$10, staged=$11, value_scale=$12, value_offset=$13, collection_delay_secs=$14, align=$15, latest_only=$16 where id=$1",
+		queryID, def.Query, def.QueryType, def.Finish, def.MultiSeries, def.AllowPartial, def.Group, def.Rollup, def.MultipointPolicy, def.OverwriteLookback, def.Staged, def.Scale, def.Offset, def.CollectionDelay, def.Align, def.LatestOnly)
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	slog.Info("updated query", "query_id", queryID, "name", def.Name, "source_id", def.SourceID, "changed", diffs)
+	return nil
+}
+
+func QueryExec(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	queryID := cc.Int("id")
+	seq := cc.Int("seq")
+	output := strings.TrimSpace(cc.String("output"))
+
+	if queryID < 0 {
+		return fmt.Errorf("ID must be a positive integer")
+	}
+
+	if err := validateOutputFormat(output); err != nil {
+		return err
+	}
+
+	if seq <= 0 {
+		return fmt.Errorf("sequence must be greater than zero")
+	}
+
+	db := NewDB(dbConnStr())
+
+	qry, err := GetQuery(ctx, db, queryID)
+	if err != nil {
+		return fmt.Errorf("get query: %w", err)
+	}
+
+	ss := new(SecretStore)
+	secrets, err := ss.Secrets(qry.ProviderID, qry.AuthType)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets for provider: %w", err)
+	}
+
+	points, err := DispatchQuery(ctx, qry, seq, secrets)
+	if err != nil {
+		return fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	if len(points) == 0 {
+		return fmt.Errorf("no points found")
+	}
+
+	return writePoints(os.Stdout, output, points, qry.MultiSeries)
 }
 
 func QueryNextSeq(cc *cli.Context) error {
@@ -367,11 +925,115 @@ func QueryNextSeq(cc *cli.Context) error {
 		return fmt.Errorf("get query: %w", err)
 	}
 
-	fmt.Printf("Expected next sequence: %d\n", qry.SeqAfter(time.Now().UTC()))
+	t := time.Now().UTC()
+	if timeStr := strings.TrimSpace(cc.String("time")); timeStr != "" {
+		t, err = parseTime(timeStr)
+		if err != nil {
+			return fmt.Errorf("time %w", err)
+		}
+		if t.Before(qry.Start) {
+			return fmt.Errorf("time must not be before the start of the query (%s)", qry.Start.Format("2006-01-02T15:04:05Z"))
+		}
+	}
+
+	fmt.Printf("Expected next sequence: %d\n", qry.SeqAfter(t))
 
 	return nil
 }
 
+func QueryReseq(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	queryID := cc.Int("id")
+	if queryID < 0 {
+		return fmt.Errorf("ID must be a positive integer")
+	}
+
+	oldStart, err := parseTime(strings.TrimSpace(cc.String("old-start")))
+	if err != nil {
+		return fmt.Errorf("old-start %w", err)
+	}
+	newStart, err := parseTime(strings.TrimSpace(cc.String("new-start")))
+	if err != nil {
+		return fmt.Errorf("new-start %w", err)
+	}
+
+	db := NewDB(dbConnStr())
+
+	qry, err := GetQuery(ctx, db, queryID)
+	if err != nil {
+		return fmt.Errorf("get query: %w", err)
+	}
+
+	if !qry.Start.Equal(oldStart) {
+		return fmt.Errorf("old-start does not match the start of the query (%s)", qry.Start.UTC().Format("2006-01-02T15:04:05Z"))
+	}
+
+	unit := qry.IntervalDuration()
+	if unit == 0 || qry.Interval == QueryIntervalMonthly {
+		return fmt.Errorf("unsupported interval: %q", qry.Interval)
+	}
+
+	// a value collected for seq ends at oldStart + seq*unit, which is newStart + (seq+delta)*unit
+	diff := oldStart.Sub(newStart)
+	if diff%unit != 0 {
+		return fmt.Errorf("difference between old-start and new-start must be a whole number of %s intervals", qry.IntervalString())
+	}
+	delta := int(diff / unit)
+	if delta == 0 {
+		printStatus("Start is unchanged, nothing to do")
+		return nil
+	}
+
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var minSeq *int
+	if err := tx.QueryRow(ctx, "select min(seq) from (select seq from collections where query_id=$1 union all select seq from collections_staging where query_id=$1) s", queryID).Scan(&minSeq); err != nil {
+		return fmt.Errorf("query: %w", err)
+	}
+	if minSeq != nil && *minSeq+delta < 0 {
+		return fmt.Errorf("new-start is after the time of collected sequence %d", *minSeq)
+	}
+
+	// renumber via negative sequences since the primary key is checked as each row is updated,
+	// which would otherwise conflict with rows yet to be renumbered
+	var renumbered int64
+	for _, table := range []string{"collections", "collections_staging", "collection_responses", "collection_attempts"} {
+		if _, err := tx.Exec(ctx, "update "+table+" set seq=-seq-1 where query_id=$1", queryID); err != nil {
+			return fmt.Errorf("update %s: %w", table, err)
+		}
+		tag, err := tx.Exec(ctx, "update "+table+" set seq=-seq-1+$2 where query_id=$1", queryID, delta)
+		if err != nil {
+			return fmt.Errorf("update %s: %w", table, err)
+		}
+		if table == "collections" {
+			renumbered = tag.RowsAffected()
+		}
+	}
+
+	if _, err := tx.Exec(ctx, "update queries set start=$2 where id=$1", queryID, newStart); err != nil {
+		return fmt.Errorf("update query: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	printStatus("Changed start to %s and renumbered %d collected values by %+d", newStart.Format("2006-01-02T15:04:05Z"), renumbered, delta)
+	return nil
+}
+
 func QueryTest(cc *cli.Context) error {
 	ctx := cc.Context
 	setupLogging()
@@ -382,11 +1044,16 @@ func QueryTest(cc *cli.Context) error {
 	interval := strings.TrimSpace(cc.String("interval"))
 	startStr := strings.TrimSpace(cc.String("start"))
 	seq := cc.Int("seq")
+	output := strings.TrimSpace(cc.String("output"))
 
 	if query == "" {
 		return fmt.Errorf("query must be supplied")
 	}
 
+	if err := validateOutputFormat(output); err != nil {
+		return err
+	}
+
 	if queryType == "" {
 		return fmt.Errorf("query-type must be supplied")
 	}
@@ -407,37 +1074,34 @@ func QueryTest(cc *cli.Context) error {
 		return fmt.Errorf("seq must be a positive integer")
 	}
 
-	start, err := time.Parse("2006-01-02T15:04:05Z", startStr)
+	start, err := parseTime(startStr)
 	if err != nil {
-		// attempt to parse as unix timestamp (seconds since epoch)
-		ts, err := strconv.ParseInt(startStr, 10, 32)
-		if err != nil {
-			return fmt.Errorf("start must be a time formatted as '2006-01-02T15:04:05Z' or a unix timestamp")
-		}
-		start = time.Unix(ts, 0)
+		return fmt.Errorf("start %w", err)
 	}
 
 	db := NewDB(dbConnStr())
-	if err := ValidateEnumValue(ctx, db, "interval_type", interval); err != nil {
-		return fmt.Errorf("unsupported interval type %q: %w", interval, err)
+	baseInterval, intervalFactor, err := ParseInterval(interval)
+	if err != nil {
+		return err
+	}
+	if err := ValidateEnumValue(ctx, db, "interval_type", string(baseInterval)); err != nil {
+		return fmt.Errorf("unsupported interval type %q: %w", baseInterval, err)
 	}
 	if err := ValidateEnumValue(ctx, db, "query_type", queryType); err != nil {
 		return fmt.Errorf("unsupported query type %q: %w", queryType, err)
 	}
 
-	startOrig := start
-	switch interval {
-	case "hourly":
-		start = start.Truncate(time.Hour)
-	case "daily":
-		start = start.Truncate(24 * time.Hour)
-	case "weekly":
-		start = start.Truncate(7 * 24 * time.Hour)
-	default:
-		return fmt.Errorf("unsupported interval: must be one of 'hourly','daily','weekly'")
-
+	policy, err := LoadQueryPolicy(cc)
+	if err != nil {
+		return err
+	}
+	if err := policy.Check(QueryType(queryType), query); err != nil {
+		return err
 	}
 
+	startOrig := start
+	start = TruncateInterval(start, baseInterval, intervalFactor)
+
 	if !startOrig.Equal(start) {
 		slog.Info("truncated start to " + start.Format("2006-01-02T15:04:05Z"))
 	}
@@ -448,16 +1112,24 @@ func QueryTest(cc *cli.Context) error {
 	}
 
 	q := &Query{
-		Name:       query,
-		Query:      query,
-		Interval:   QueryInterval(interval),
-		Start:      start,
-		QueryType:  QueryType(queryType),
-		Dataset:    s.Dataset,
-		ProviderID: s.ProviderID,
-		ApiType:    s.ApiType,
-		ApiURL:     s.ApiURL,
-		AuthType:   s.AuthType,
+		Name:           query,
+		Query:          query,
+		Interval:       baseInterval,
+		IntervalFactor: intervalFactor,
+		Start:          start,
+		QueryType:      QueryType(queryType),
+		Dataset:        s.Dataset,
+		DatasourceType: s.DatasourceType,
+		ProviderID:     s.ProviderID,
+		ApiType:        s.ApiType,
+		ApiURL:         s.ApiURL,
+		AuthType:       s.AuthType,
+		ValueScale:     1,
+		Align:          true,
+
+		RequestTimeoutSecs: s.RequestTimeoutSecs,
+		MaxRetries:         s.MaxRetries,
+		ExtraHeaders:       s.ExtraHeaders,
 	}
 
 	ss := new(SecretStore)
@@ -475,12 +1147,88 @@ func QueryTest(cc *cli.Context) error {
 		return fmt.Errorf("no points found")
 	}
 
-	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
-	fmt.Fprintln(w, "Seq\t| Time\t| Value")
-	for _, pt := range points {
-		fmt.Fprintf(w, "%d\t| %s\t| %v\t\n", pt.Seq, pt.Time.Format("2006-01-02T15:04:05Z"), formatFloat64(pt.Value))
+	// an instant query returns a point for each series
+	if err := policy.CheckSeries(q.QueryType, len(points)); err != nil {
+		return err
 	}
-	return w.Flush()
+
+	return writePoints(os.Stdout, output, points, false)
+}
+
+// QueryUpdate updates only the columns of a query whose flags are supplied. The interval and start cannot be
+// changed since they determine the time covered by each of the query's collected sequences.
+func QueryUpdate(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	queryID := cc.Int("id")
+	if queryID < 0 {
+		return fmt.Errorf("ID must be a positive integer")
+	}
+
+	if cc.IsSet("interval") {
+		return fmt.Errorf("the interval of a query cannot be changed since it would invalidate its collected sequences")
+	}
+	if cc.IsSet("start") {
+		return fmt.Errorf("the start of a query cannot be changed by update, use query reseq instead")
+	}
+
+	db := NewDB(dbConnStr())
+	qry, err := GetQuery(ctx, db, queryID)
+	if err != nil {
+		return fmt.Errorf("get query: %w", err)
+	}
+
+	var sets []string
+	var args []any
+	set := func(col string, v any) {
+		args = append(args, v)
+		sets = append(sets, fmt.Sprintf("%s=$%d", col, len(args)))
+	}
+
+	if cc.IsSet("name") {
+		name := strings.TrimSpace(cc.String("name"))
+		if name == "" {
+			return fmt.Errorf("name must not be empty")
+		}
+		set("name", name)
+	}
+
+	query, queryType := qry.Query, string(qry.QueryType)
+	if cc.IsSet("query") {
+		query = strings.TrimSpace(cc.String("query"))
+		if query == "" {
+			return fmt.Errorf("query must not be empty")
+		}
+		set("query", query)
+	}
+	if cc.IsSet("query-type") {
+		queryType = strings.TrimSpace(cc.String("query-type"))
+		set("query_type", queryType)
+	}
+
+	if len(sets) == 0 {
+		return fmt.Errorf("at least one of --name, --query or --query-type must be supplied")
+	}
+
+	if cc.IsSet("query") || cc.IsSet("query-type") {
+		if err := validateQuery(cc, db, queryType, query); err != nil {
+			return err
+		}
+	}
+
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	args = append(args, queryID)
+	if _, err := conn.Exec(ctx, fmt.Sprintf("update queries set %s where id=$%d", strings.Join(sets, ", "), len(args)), args...); err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+
+	return QueryShow(cc)
 }
 
 func QueryFinish(cc *cli.Context) error {
@@ -494,29 +1242,22 @@ func QueryFinish(cc *cli.Context) error {
 		return fmt.Errorf("ID must be a positive integer")
 	}
 
-	var finish *time.Time
 	if finishStr == "" {
 		return fmt.Errorf("finish time must be supplied")
 	}
 
-	if finishStr == "now" {
-		f := time.Now().UTC()
-		finish = &f
-	} else {
-		f, err := time.Parse("2006-01-02T15:04:05Z", finishStr)
-		if err != nil {
-			// attempt to parse as unix timestamp (seconds since epoch)
-			ts, err := strconv.ParseInt(finishStr, 10, 32)
-			if err != nil {
-				return fmt.Errorf("start must be a time formatted as '2006-01-02T15:04:05Z' or a unix timestamp")
-			}
-			f = time.Unix(ts, 0)
-		}
+	db := NewDB(dbConnStr())
+	qry, err := GetQuery(ctx, db, queryID)
+	if err != nil {
+		return fmt.Errorf("get query: %w", err)
+	}
 
-		finish = &f
+	f, err := parseRelativeTime(finishStr, qry.Start, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("finish %w", err)
 	}
+	finish := &f
 
-	db := NewDB(dbConnStr())
 	conn, err := db.NewConn(ctx)
 	if err != nil {
 		return fmt.Errorf("connect: %w", err)
@@ -541,3 +1282,454 @@ func QueryFinish(cc *cli.Context) error {
 
 	return nil
 }
+
+func QueryArchive(cc *cli.Context) error {
+	return setQueryArchived(cc, true)
+}
+
+func QueryUnarchive(cc *cli.Context) error {
+	return setQueryArchived(cc, false)
+}
+
+func setQueryArchived(cc *cli.Context, archived bool) error {
+	ctx := cc.Context
+	setupLogging()
+
+	queryID := cc.Int("id")
+
+	if queryID < 0 {
+		return fmt.Errorf("ID must be a positive integer")
+	}
+
+	db := NewDB(dbConnStr())
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "update queries set archived=$1 where id=$2", archived, queryID)
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("query %d: %w", queryID, ErrNotFound)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	return nil
+}
+
+func QueryShow(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	queryID := cc.Int("id")
+	if queryID < 0 {
+		return fmt.Errorf("ID must be a positive integer")
+	}
+
+	db := NewDB(dbConnStr())
+
+	qry, err := GetQuery(ctx, db, queryID)
+	if err != nil {
+		return fmt.Errorf("get query: %w", err)
+	}
+
+	lastErr, lastErrAt, err := GetQueryLastError(ctx, db, queryID)
+	if err != nil {
+		return fmt.Errorf("get last error: %w", err)
+	}
+
+	finish := "--"
+	if qry.Finish != nil {
+		finish = qry.Finish.UTC().Format("2006-01-02T15:04:05Z")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
+	fmt.Fprintf(w, "ID\t| %d\n", qry.ID)
+	fmt.Fprintf(w, "Name\t| %s\n", qry.Name)
+	fmt.Fprintf(w, "Group\t| %s\n", qry.Group)
+	fmt.Fprintf(w, "Query\t| %s\n", qry.Query)
+	fmt.Fprintf(w, "Query Type\t| %s\n", qry.QueryType)
+	fmt.Fprintf(w, "Interval\t| %s\n", qry.IntervalString())
+	fmt.Fprintf(w, "Start\t| %s\n", qry.Start.UTC().Format("2006-01-02T15:04:05Z"))
+	fmt.Fprintf(w, "Finish\t| %s\n", finish)
+	fmt.Fprintf(w, "Provider ID\t| %d\n", qry.ProviderID)
+	fmt.Fprintf(w, "Dataset\t| %s\n", qry.Dataset)
+	fmt.Fprintf(w, "Multi Series\t| %t\n", qry.MultiSeries)
+	fmt.Fprintf(w, "Allow Partial\t| %t\n", qry.AllowPartial)
+	fmt.Fprintf(w, "Rollup\t| %t\n", qry.Rollup)
+	fmt.Fprintf(w, "Multipoint Policy\t| %s\n", qry.MultipointPolicy)
+	fmt.Fprintf(w, "Overwrite Lookback\t| %d\n", qry.OverwriteLookback)
+	fmt.Fprintf(w, "Staged\t| %t\n", qry.Staged)
+	fmt.Fprintf(w, "Align\t| %t\n", qry.Align)
+	if qry.StartOffsetSecs != 0 {
+		fmt.Fprintf(w, "Start Offset\t| %s\n", time.Duration(qry.StartOffsetSecs)*time.Second)
+	}
+	fmt.Fprintf(w, "Latest Only\t| %t\n", qry.LatestOnly)
+	fmt.Fprintf(w, "Collection Delay\t| %s\n", time.Duration(qry.CollectionDelaySecs)*time.Second)
+	if qry.ValueScale != 1 || qry.ValueOffset != 0 {
+		fmt.Fprintf(w, "Transform\t| value*%s + %s\n", formatFloat64(qry.ValueScale), formatFloat64(qry.ValueOffset))
+	}
+	if lastErr != nil {
+		fmt.Fprintf(w, "Last Error\t| %s\n", *lastErr)
+		if lastErrAt != nil {
+			fmt.Fprintf(w, "Last Error At\t| %s\n", lastErrAt.UTC().Format("2006-01-02T15:04:05Z"))
+		}
+	} else {
+		fmt.Fprintf(w, "Last Error\t| --\n")
+	}
+	return w.Flush()
+}
+
+func QueryInspect(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	queryID := cc.Int("id")
+	if queryID < 0 {
+		return fmt.Errorf("ID must be a positive integer")
+	}
+
+	seq := cc.Int("seq")
+	if seq <= 0 {
+		return fmt.Errorf("sequence must be greater than zero")
+	}
+
+	db := NewDB(dbConnStr())
+
+	qry, err := GetQuery(ctx, db, queryID)
+	if err != nil {
+		return fmt.Errorf("get query: %w", err)
+	}
+
+	ss := new(SecretStore)
+	secrets, err := ss.Secrets(qry.ProviderID, qry.AuthType)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets for provider: %w", err)
+	}
+
+	w, err := SeqWindow(qry, seq)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Query:       %d (%s)\n", qry.ID, qry.Name)
+	fmt.Printf("Interval:    %s\n", qry.IntervalString())
+	fmt.Printf("Start:       %s (aligned: %t)\n", qry.Start.UTC().Format("2006-01-02T15:04:05Z"), qry.StartAligned())
+	fmt.Printf("Seq:         %d\n", seq)
+	fmt.Printf("From:        %s\n", w.From.Format("2006-01-02T15:04:05Z"))
+	fmt.Printf("To:          %s\n", w.To.Format("2006-01-02T15:04:05Z"))
+	if w.Provisional {
+		fmt.Printf("Query time:  %s (provisional)\n", w.QueryTime.Format("2006-01-02T15:04:05Z"))
+	}
+	fmt.Println()
+
+	querier, err := NewQuerier(ctx, qry, secrets)
+	if err != nil {
+		return err
+	}
+
+	points, err := ExecuteWindow(ctx, querier, qry, w)
+	if err != nil {
+		return fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	if len(points) == 0 {
+		fmt.Println("Provider returned no points")
+		return nil
+	}
+
+	matched := 0
+	tw := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
+	fmt.Fprintln(tw, "Time\t| Series\t| Value\t| Matched")
+	for _, pt := range points {
+		m := w.Matches(pt.Time)
+		if m {
+			matched++
+		}
+		fmt.Fprintf(tw, "%s\t| %s\t| %s\t| %t\n", pt.Time.UTC().Format("2006-01-02T15:04:05Z"), pt.Series, formatFloat64(pt.Value), m)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n%d of %d points matched the end of the window\n", matched, len(points))
+	return nil
+}
+
+// parseTime parses a time formatted as '2006-01-02T15:04:05Z' or a unix timestamp (seconds since epoch)
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02T15:04:05Z", s)
+	if err == nil {
+		return t, nil
+	}
+
+	// attempt to parse as unix timestamp (seconds since epoch)
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must be a time formatted as '2006-01-02T15:04:05Z' or a unix timestamp")
+	}
+	return time.Unix(ts, 0).UTC(), nil
+}
+
+// parseRelativeTime parses a time accepted by parseTime, the keyword 'now' or a time relative to start or now
+// written as 'start+90d' or 'now+30d', where the offset is a duration accepted by parseDuration.
+func parseRelativeTime(s string, start, now time.Time) (time.Time, error) {
+	if s == "now" {
+		return now, nil
+	}
+	for base, t := range map[string]time.Time{"start": start, "now": now} {
+		offset, ok := strings.CutPrefix(s, base+"+")
+		if !ok {
+			continue
+		}
+		d, err := parseDuration(offset)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("offset %w", err)
+		}
+		return t.Add(d), nil
+	}
+	t, err := parseTime(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must be a time formatted as '2006-01-02T15:04:05Z', a unix timestamp, 'now' or a time relative to start or now such as 'start+90d'")
+	}
+	return t, nil
+}
+
+// parseDuration parses a non-negative duration accepted by time.ParseDuration or a number of days with a d suffix.
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err == nil && n >= 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("must be a duration such as 36h or 7d")
+	}
+	return d, nil
+}
+
+type DataPointJSON struct {
+	Seq    int       `json:"seq"`
+	Time   time.Time `json:"time"`
+	Value  float64   `json:"value"`
+	Series string    `json:"series,omitempty"`
+}
+
+func validateOutputFormat(format string) error {
+	switch format {
+	case "table", "json":
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format: must be one of 'table','json'")
+	}
+}
+
+// writePoints writes data points in the output format, including the series of each point if showSeries is true
+func writePoints(out io.Writer, format string, points []DataPoint, showSeries bool) error {
+	if format == "json" {
+		pjs := make([]DataPointJSON, len(points))
+		for i, pt := range points {
+			pjs[i] = DataPointJSON{
+				Seq:    pt.Seq,
+				Time:   pt.Time,
+				Value:  pt.Value,
+				Series: pt.Series,
+			}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(pjs)
+	}
+
+	w := tabwriter.NewWriter(out, 1, 1, 4, ' ', 0)
+	if showSeries {
+		fmt.Fprintln(w, "Seq\t| Time\t| Series\t| Value")
+		for _, pt := range points {
+			fmt.Fprintf(w, "%d\t| %s\t| %s\t| %v\t\n", pt.Seq, pt.Time.Format("2006-01-02T15:04:05Z"), pt.Series, formatFloat64(pt.Value))
+		}
+		return w.Flush()
+	}
+
+	fmt.Fprintln(w, "Seq\t| Time\t| Value")
+	for _, pt := range points {
+		fmt.Fprintf(w, "%d\t| %s\t| %v\t\n", pt.Seq, pt.Time.Format("2006-01-02T15:04:05Z"), formatFloat64(pt.Value))
+	}
+	return w.Flush()
+}
+
+// QueryPreflight prints the resolved provider details and secret status of one or all active queries. It
+// returns an error if any query is missing a required secret or refers to an unset environment variable in its
+// provider's headers, so it can be used to validate configuration before deploying.
+func QueryPreflight(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	if cc.IsSet("id") == cc.Bool("all") {
+		return fmt.Errorf("exactly one of --id or --all must be supplied")
+	}
+
+	db := NewDB(dbConnStr())
+
+	var qs []*Query
+	if cc.Bool("all") {
+		var err error
+		qs, err = FetchActiveQueries(ctx, db)
+		if err != nil {
+			return fmt.Errorf("fetch active queries: %w", err)
+		}
+		sort.Slice(qs, func(i, j int) bool { return qs[i].ID < qs[j].ID })
+	} else {
+		queryID := cc.Int("id")
+		if queryID < 0 {
+			return fmt.Errorf("ID must be a positive integer")
+		}
+		qry, err := GetQuery(ctx, db, queryID)
+		if err != nil {
+			return fmt.Errorf("get query: %w", err)
+		}
+		qs = []*Query{qry}
+	}
+
+	ss := new(SecretStore)
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
+	fmt.Fprintln(w, "ID\t| Name\t| API Type\t| API URL\t| Auth Type\t| Secrets\t| Headers")
+	for _, qry := range qs {
+		ok := true
+
+		vars, err := SecretEnvVarNames(qry.ProviderID, qry.AuthType)
+		if err != nil {
+			return fmt.Errorf("secret env var names: %w", err)
+		}
+		types := make([]string, 0, len(vars))
+		for ty := range vars {
+			types = append(types, string(ty))
+		}
+		sort.Strings(types)
+
+		secrets := make([]string, 0, len(types))
+		for _, ty := range types {
+			name := vars[SecretType(ty)]
+			_, _, found, err := ss.Lookup(qry.ProviderID, SecretType(ty), name)
+			if err != nil {
+				return err
+			}
+			status := "set"
+			if !found {
+				status = "missing"
+				ok = false
+			}
+			secrets = append(secrets, name+"="+status)
+		}
+		if len(secrets) == 0 {
+			secrets = append(secrets, "(none)")
+		}
+
+		headers := "ok"
+		if _, err := ExpandHeaders(qry.ExtraHeaders); err != nil {
+			headers = err.Error()
+			ok = false
+		}
+
+		if !ok {
+			failed++
+		}
+		fmt.Fprintf(w, "%d\t| %s\t| %s\t| %s\t| %s\t| %s\t| %s\n", qry.ID, qry.Name, qry.ApiType, qry.ApiURL, qry.AuthType, strings.Join(secrets, ", "), headers)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d queries failed preflight", failed, len(qs))
+	}
+	return nil
+}
+
+// QueryCadence prints the observed collection cadence of one or all active queries. It returns a partial
+// failure if any query's cadence exceeds the threshold.
+func QueryCadence(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	if cc.IsSet("id") == cc.Bool("all") {
+		return fmt.Errorf("exactly one of --id or --all must be supplied")
+	}
+	window := cc.Int("window")
+	if window < 2 {
+		return fmt.Errorf("window must be at least 2 intervals")
+	}
+	threshold := cc.Float64("threshold")
+	if threshold <= 0 {
+		return fmt.Errorf("threshold must be greater than zero")
+	}
+
+	db := NewDB(dbConnStr())
+
+	var qs []*Query
+	if cc.Bool("all") {
+		var err error
+		qs, err = FetchActiveQueries(ctx, db)
+		if err != nil {
+			return fmt.Errorf("fetch active queries: %w", err)
+		}
+		sort.Slice(qs, func(i, j int) bool { return qs[i].ID < qs[j].ID })
+	} else {
+		queryID := cc.Int("id")
+		if queryID < 0 {
+			return fmt.Errorf("ID must be a positive integer")
+		}
+		qry, err := GetQuery(ctx, db, queryID)
+		if err != nil {
+			return fmt.Errorf("get query: %w", err)
+		}
+		qs = []*Query{qry}
+	}
+
+	now := time.Now()
+	flagged := 0
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
+	fmt.Fprintln(w, "ID\t| Name\t| Interval\t| Seqs\t| Mean Gap\t| Ratio\t| Status")
+	for _, qry := range qs {
+		c, err := GetCollectionCadence(ctx, db, qry.ID, now.Add(-time.Duration(window)*qry.IntervalDuration()))
+		if err != nil {
+			return fmt.Errorf("get cadence of query %d: %w", qry.ID, err)
+		}
+
+		meanGap, ratio, status := "-", "-", "insufficient data"
+		if c.Seqs >= 2 {
+			r := c.Ratio(qry)
+			meanGap = c.MeanGap().Round(time.Second).String()
+			ratio = strconv.FormatFloat(r, 'f', 2, 64)
+			status = "ok"
+			if r > threshold {
+				status = "behind"
+				flagged++
+			}
+		}
+		fmt.Fprintf(w, "%d\t| %s\t| %s\t| %d\t| %s\t| %s\t| %s\n", qry.ID, qry.Name, qry.IntervalString(), c.Seqs, meanGap, ratio, status)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if flagged > 0 {
+		printStatus("%d of %d queries are collected less often than their interval", flagged, len(qs))
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+var queryPolicyFlag = &cli.StringFlag{
+	Name:    "query-policy",
+	Usage:   "Reject queries that break the rules in YAML `FILE`, keyed by query type",
+	EnvVars: []string{envPrefix + "QUERY_POLICY"},
+}
+
+// A QueryPolicy holds the rules that query expressions must follow for each query type, guarding against
+// expensive or malicious queries being added in a shared deployment. A policy file looks like:
+//
+//	prometheus:
+//	  max_series: 50
+//	  disallowed_functions: [count_values, label_replace]
+//	  required_matchers: [job]
+//	elasticsearch_aggregate:
+//	  disallowed_aggregations: [scripted_metric]
+type QueryPolicy map[QueryType]QueryRules
+
+type QueryRules struct {
+	MaxSeries              int      `yaml:"max_series"`              // maximum number of series a PromQL query may return when tested
+	DisallowedFunctions    []string `yaml:"disallowed_functions"`    // PromQL functions and aggregation operators that may not be used
+	RequiredMatchers       []string `yaml:"required_matchers"`       // labels that every PromQL selector must match
+	DisallowedAggregations []string `yaml:"disallowed_aggregations"` // elasticsearch aggregation types that may not be used
+}
+
+// LoadQueryPolicy reads the policy file named by the query-policy flag. It returns a nil policy, which allows
+// every query, when no file is named.
+func LoadQueryPolicy(cc *cli.Context) (QueryPolicy, error) {
+	path := strings.TrimSpace(cc.String("query-policy"))
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read query policy: %w", err)
+	}
+
+	var p QueryPolicy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("parse query policy: %w", err)
+	}
+	return p, nil
+}
+
+// Check validates a query expression against the rules for its type.
+func (p QueryPolicy) Check(queryType QueryType, query string) error {
+	rules, ok := p[queryType]
+	if !ok {
+		return nil
+	}
+
+	switch queryType {
+	case QueryTypePrometheus:
+		return rules.checkPromQL(queryType, query)
+	case QueryTypeElasticSearchAggregate:
+		return rules.checkElasticSearch(queryType, query)
+	}
+	return nil
+}
+
+// CheckSeries validates the number of series returned by a test of a query against the rules for its type.
+func (p QueryPolicy) CheckSeries(queryType QueryType, n int) error {
+	rules, ok := p[queryType]
+	if !ok || rules.MaxSeries <= 0 {
+		return nil
+	}
+	if n > rules.MaxSeries {
+		return fmt.Errorf("query rejected by policy: returned %d series, more than the %d allowed for %s queries", n, rules.MaxSeries, queryType)
+	}
+	return nil
+}
+
+// promQLKeywords are identifiers in PromQL that are neither metric names nor functions.
+var promQLKeywords = map[string]bool{
+	"and": true, "or": true, "unless": true, "bool": true, "offset": true, "inf": true, "nan": true,
+}
+
+// promQLLabelListKeywords are PromQL keywords followed by a parenthesised list of label names.
+var promQLLabelListKeywords = map[string]bool{
+	"by": true, "without": true, "on": true, "ignoring": true, "group_left": true, "group_right": true,
+}
+
+// checkPromQL scans a PromQL expression for calls to disallowed functions and for selectors that do not match
+// the required labels. A metric name used without a label matcher counts as a selector matching no labels.
+func (r QueryRules) checkPromQL(queryType QueryType, query string) error {
+	if len(r.DisallowedFunctions) == 0 && len(r.RequiredMatchers) == 0 {
+		return nil
+	}
+
+	disallowed := make(map[string]bool, len(r.DisallowedFunctions))
+	for _, fn := range r.DisallowedFunctions {
+		disallowed[strings.ToLower(fn)] = true
+	}
+
+	checkMatchers := func(selector string, labels map[string]bool) error {
+		for _, l := range r.RequiredMatchers {
+			if !labels[l] {
+				return fmt.Errorf("query rejected by policy: selector %s must match label %q in %s queries", selector, l, queryType)
+			}
+		}
+		return nil
+	}
+
+	toks := lexPromQL(query)
+	for i := 0; i < len(toks); i++ {
+		tok := toks[i]
+		next := ""
+		if i+1 < len(toks) {
+			next = toks[i+1]
+		}
+
+		switch {
+		case tok == "{":
+			// a selector, optionally preceded by its metric name
+			name := "{...}"
+			if i > 0 && isPromQLIdent(toks[i-1]) {
+				name = toks[i-1] + "{...}"
+			}
+			labels := make(map[string]bool)
+			for i++; i < len(toks) && toks[i] != "}"; i++ {
+				if isPromQLIdent(toks[i]) && i+1 < len(toks) && strings.ContainsAny(toks[i+1], "=~") {
+					labels[toks[i]] = true
+				}
+			}
+			if err := checkMatchers(name, labels); err != nil {
+				return err
+			}
+		case tok == "[":
+			// range or subquery duration
+			for i < len(toks) && toks[i] != "]" {
+				i++
+			}
+		case isPromQLIdent(tok):
+			lower := strings.ToLower(tok)
+			switch {
+			case promQLLabelListKeywords[lower]:
+				if next == "(" {
+					for i < len(toks) && toks[i] != ")" {
+						i++
+					}
+				}
+			case promQLKeywords[lower]:
+			case next == "(" || promQLLabelListKeywords[strings.ToLower(next)]:
+				// a function call or an aggregation with its grouping before its arguments
+				if disallowed[lower] {
+					return fmt.Errorf("query rejected by policy: function %s is not allowed in %s queries", tok, queryType)
+				}
+			case next == "{":
+				// metric name of the selector that follows
+			default:
+				if err := checkMatchers(tok, nil); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// lexPromQL splits a PromQL expression into identifiers, numbers, operators and punctuation. String literals
+// are returned as a single token and comments are dropped.
+func lexPromQL(query string) []string {
+	var toks []string
+	rs := []rune(query)
+	for i := 0; i < len(rs); {
+		c := rs[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '#':
+			for i < len(rs) && rs[i] != '\n' {
+				i++
+			}
+		case c == '"' || c == '\'' || c == '`':
+			j := i + 1
+			for j < len(rs) && rs[j] != c {
+				if rs[j] == '\\' && c != '`' {
+					j++
+				}
+				j++
+			}
+			if j < len(rs) {
+				j++
+			}
+			toks = append(toks, string(rs[i:min(j, len(rs))]))
+			i = j
+		case c == '_' || c == ':' || unicode.IsLetter(c) || unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(rs) && (rs[j] == '_' || rs[j] == ':' || rs[j] == '.' || unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j])) {
+				j++
+			}
+			toks = append(toks, string(rs[i:j]))
+			i = j
+		case strings.ContainsRune("=!~<>", c):
+			j := i + 1
+			for j < len(rs) && strings.ContainsRune("=~", rs[j]) {
+				j++
+			}
+			toks = append(toks, string(rs[i:j]))
+			i = j
+		default:
+			toks = append(toks, string(c))
+			i++
+		}
+	}
+	return toks
+}
+
+// isPromQLIdent reports whether a token is an identifier, such as a metric, label or function name.
+func isPromQLIdent(tok string) bool {
+	if tok == "" {
+		return false
+	}
+	c := []rune(tok)[0]
+	return c == '_' || c == ':' || unicode.IsLetter(c)
+}
+
+// checkElasticSearch rejects an elasticsearch aggregation that uses, at any depth, an aggregation type that
+// is not allowed.
+func (r QueryRules) checkElasticSearch(queryType QueryType, query string) error {
+	if len(r.DisallowedAggregations) == 0 {
+		return nil
+	}
+
+	var aggs map[string]any
+	if err := json.Unmarshal([]byte(query), &aggs); err != nil {
+		return fmt.Errorf("invalid query %q: %w", query, err)
+	}
+
+	disallowed := make(map[string]bool, len(r.DisallowedAggregations))
+	for _, a := range r.DisallowedAggregations {
+		disallowed[a] = true
+	}
+
+	// the query is the body of a single aggregation, keyed by its type, which may contain sub-aggregations
+	var check func(agg map[string]any) error
+	check = func(agg map[string]any) error {
+		types := make([]string, 0, len(agg))
+		for ty := range agg {
+			types = append(types, ty)
+		}
+		sort.Strings(types)
+
+		for _, ty := range types {
+			if ty == "aggs" || ty == "aggregations" {
+				subs, _ := agg[ty].(map[string]any)
+				for _, sub := range subs {
+					if sa, ok := sub.(map[string]any); ok {
+						if err := check(sa); err != nil {
+							return err
+						}
+					}
+				}
+				continue
+			}
+			if disallowed[ty] {
+				return fmt.Errorf("query rejected by policy: aggregation %s is not allowed in %s queries", ty, queryType)
+			}
+		}
+		return nil
+	}
+	return check(aggs)
+}
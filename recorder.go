@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"golang.org/x/exp/slog"
+)
+
+// A ResponseRecorder captures the raw response bodies received by queriers while executing a query.
+type ResponseRecorder struct {
+	mu     sync.Mutex
+	bodies [][]byte
+}
+
+type responseRecorderKey struct{}
+
+// WithResponseRecorder returns a context that causes queriers to record the responses they receive in rec.
+func WithResponseRecorder(ctx context.Context, rec *ResponseRecorder) context.Context {
+	return context.WithValue(ctx, responseRecorderKey{}, rec)
+}
+
+// recordResponse records a response body with the recorder held by the context, if any.
+func recordResponse(ctx context.Context, body []byte) {
+	rec, ok := ctx.Value(responseRecorderKey{}).(*ResponseRecorder)
+	if !ok || rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.bodies = append(rec.bodies, body)
+}
+
+// Body returns all recorded response bodies separated by newlines, or nil if none were recorded.
+func (r *ResponseRecorder) Body() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.bodies) == 0 {
+		return nil
+	}
+	return bytes.Join(r.bodies, []byte("\n"))
+}
+
+// DispatchQueryStoringRaw executes the query for the given sequence in the same way as DispatchQuery and
+// stores the raw responses received from the provider against the sequence. Failure to store the
+// responses is logged but does not fail the query.
+func DispatchQueryStoringRaw(ctx context.Context, db *DB, qry *Query, seq int, ps ProviderSecrets) ([]DataPoint, error) {
+	rec := new(ResponseRecorder)
+	points, err := DispatchQuery(WithResponseRecorder(ctx, rec), qry, seq, ps)
+	if body := rec.Body(); body != nil {
+		if werr := WriteCollectionResponse(ctx, db, qry.ID, seq, body); werr != nil {
+			slog.Error("failed to store raw response", "query_id", qry.ID, "seq", seq, "error", werr)
+		}
+	}
+	return points, err
+}
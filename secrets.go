@@ -1,16 +1,104 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+
+	"github.com/urfave/cli/v2"
 )
 
 type ProviderSecrets map[SecretType]string
 
+// SecretsJSONEnvVarName is the name of an optional environment variable holding the secrets of every provider
+// as a JSON object mapping provider ids to objects of secret types and values, for example
+// {"1": {"bearer_token": "..."}, "2": {"username": "...", "password": "..."}}. Secrets found in it take
+// precedence over the individual environment variables named by SecretEnvVarNames.
+const SecretsJSONEnvVarName = envPrefix + "SECRETS"
+
+var secretsDirFlag = &cli.StringFlag{
+	Name:        "secrets-dir",
+	Usage:       "Read provider secrets that are not set in the environment from files in `DIR`, each named after the environment variable it replaces",
+	EnvVars:     []string{envPrefix + "SECRETS_DIR"},
+	Destination: &secretsDir,
+}
+
+// secretsDir is the directory holding secrets mounted as files, if any.
+var secretsDir string
+
+// A SecretStore resolves and caches the secrets of providers.
 type SecretStore struct {
-	mu      sync.Mutex
-	secrets map[int]map[SecretType]string
+	mu          sync.Mutex
+	secrets     map[int]map[SecretType]string
+	jsonLoaded  bool
+	jsonSecrets map[int]map[SecretType]string // secrets parsed from SecretsJSONEnvVarName
+}
+
+// loadJSON parses the secrets held in SecretsJSONEnvVarName, if set. It must be called with the lock held.
+func (p *SecretStore) loadJSON() error {
+	if p.jsonLoaded {
+		return nil
+	}
+
+	val, ok := os.LookupEnv(SecretsJSONEnvVarName)
+	if !ok {
+		p.jsonLoaded = true
+		return nil
+	}
+
+	var raw map[string]map[SecretType]string
+	if err := json.Unmarshal([]byte(val), &raw); err != nil {
+		return fmt.Errorf("invalid %s: %w", SecretsJSONEnvVarName, err)
+	}
+	p.jsonSecrets = make(map[int]map[SecretType]string, len(raw))
+	for key, secrets := range raw {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return fmt.Errorf("invalid %s: provider id %q is not an integer", SecretsJSONEnvVarName, key)
+		}
+		p.jsonSecrets[id] = secrets
+	}
+	p.jsonLoaded = true
+	return nil
+}
+
+// Lookup returns the value of a secret of a provider and the name of where it was found, consulting
+// SecretsJSONEnvVarName, then the named environment variable, then a file of the same name in the secrets
+// directory.
+func (p *SecretStore) Lookup(id int, ty SecretType, name string) (string, string, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lookup(id, ty, name)
+}
+
+func (p *SecretStore) lookup(id int, ty SecretType, name string) (string, string, bool, error) {
+	if err := p.loadJSON(); err != nil {
+		return "", "", false, err
+	}
+	if val, ok := p.jsonSecrets[id][ty]; ok {
+		return val, fmt.Sprintf("%s[%d].%s", SecretsJSONEnvVarName, id, ty), true, nil
+	}
+	if val, ok := os.LookupEnv(name); ok {
+		return val, name, true, nil
+	}
+	if secretsDir == "" {
+		return "", name, false, nil
+	}
+	path := filepath.Join(secretsDir, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", name, false, nil
+		}
+		return "", "", false, fmt.Errorf("read secret file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), path, true, nil
 }
 
 func (p *SecretStore) Secrets(id int, authType AuthType) (ProviderSecrets, error) {
@@ -33,12 +121,27 @@ func (p *SecretStore) Secrets(id int, authType AuthType) (ProviderSecrets, error
 
 	s = make(map[SecretType]string)
 	for ty, name := range vars {
-		val, ok := os.LookupEnv(name)
+		val, _, ok, err := p.lookup(id, ty, name)
+		if err != nil {
+			return nil, err
+		}
 		if !ok {
+			if secretsDir != "" {
+				return nil, fmt.Errorf("missing environment variable or secret file: %q", name)
+			}
 			return nil, fmt.Errorf("missing environment variable: %q", name)
 		}
 		s[ty] = val
 	}
+	for ty, name := range OptionalSecretEnvVarNames(id, authType) {
+		val, _, ok, err := p.lookup(id, ty, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			s[ty] = val
+		}
+	}
 	p.secrets[id] = s
 	return s, nil
 }
@@ -51,12 +154,36 @@ func SecretEnvVarNames(id int, authType AuthType) (map[SecretType]string, error)
 	case AuthTypeBasicAuth:
 		vars[SecretTypeUsername] = fmt.Sprintf("%sPROVIDER%d_USERNAME", envPrefix, id)
 		vars[SecretTypePassword] = fmt.Sprintf("%sPROVIDER%d_PASSWORD", envPrefix, id)
+	case AuthTypeBearerTokenBasicAuth:
+		vars[SecretTypeBearerToken] = fmt.Sprintf("%sPROVIDER%d_BEARER_TOKEN", envPrefix, id)
+		vars[SecretTypeUsername] = fmt.Sprintf("%sPROVIDER%d_USERNAME", envPrefix, id)
+		vars[SecretTypePassword] = fmt.Sprintf("%sPROVIDER%d_PASSWORD", envPrefix, id)
 	case AuthTypeAWSAccessKey:
 		vars[SecretTypeAccessKeyID] = fmt.Sprintf("%sPROVIDER%d_ACCESS_KEY_ID", envPrefix, id)
 		vars[SecretTypeSecretAccessKey] = fmt.Sprintf("%sPROVIDER%d_SECRET_ACCESS_KEY", envPrefix, id)
-		vars[SecretTypeRegion] = fmt.Sprintf("%sPROVIDER%d_REGION", envPrefix, id)
+	case AuthTypeNone:
+	case AuthTypeAWSProfile:
+		vars[SecretTypeProfile] = fmt.Sprintf("%sPROVIDER%d_PROFILE", envPrefix, id)
 	default:
 		return nil, fmt.Errorf("unsupported auth type: %q", authType)
 	}
 	return vars, nil
 }
+
+// OptionalSecretEnvVarNames returns the names of environment variables holding secrets that a provider may
+// be configured without. The region of an aws provider is optional since sources may name their own region.
+func OptionalSecretEnvVarNames(id int, authType AuthType) map[SecretType]string {
+	vars := map[SecretType]string{
+		SecretTypeTenantID: TenantIDEnvVarName(id),
+	}
+	if authType == AuthTypeAWSAccessKey {
+		vars[SecretTypeRegion] = fmt.Sprintf("%sPROVIDER%d_REGION", envPrefix, id)
+	}
+	return vars
+}
+
+// TenantIDEnvVarName returns the name of the optional environment variable holding the tenant ID sent to
+// multi-tenant providers.
+func TenantIDEnvVarName(id int) string {
+	return fmt.Sprintf("%sPROVIDER%d_TENANT_ID", envPrefix, id)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretStoreSources(t *testing.T) {
+	dir := t.TempDir()
+	saved := secretsDir
+	secretsDir = dir
+	defer func() { secretsDir = saved }()
+
+	const name = envPrefix + "PROVIDER1_BEARER_TOKEN"
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("from-file\n"), 0o600); err != nil {
+		t.Fatalf("write secret file: %v", err)
+	}
+
+	t.Run("file", func(t *testing.T) {
+		ss := new(SecretStore)
+		val, source, ok, err := ss.Lookup(1, SecretTypeBearerToken, name)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !ok {
+			t.Fatalf("secret not found")
+		}
+		if val != "from-file" {
+			t.Errorf("got value %q, wanted %q", val, "from-file")
+		}
+		if want := filepath.Join(dir, name); source != want {
+			t.Errorf("got source %q, wanted %q", source, want)
+		}
+	})
+
+	t.Run("env takes precedence", func(t *testing.T) {
+		t.Setenv(name, "from-env")
+		ss := new(SecretStore)
+		val, source, ok, err := ss.Lookup(1, SecretTypeBearerToken, name)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !ok {
+			t.Fatalf("secret not found")
+		}
+		if val != "from-env" {
+			t.Errorf("got value %q, wanted %q", val, "from-env")
+		}
+		if source != name {
+			t.Errorf("got source %q, wanted %q", source, name)
+		}
+	})
+
+	t.Run("missing both", func(t *testing.T) {
+		ss := new(SecretStore)
+		if _, err := ss.Secrets(2, AuthTypeBearerToken); err == nil {
+			t.Errorf("got no error, wanted missing secret error")
+		}
+	})
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 
@@ -18,7 +22,47 @@ var sourceCommand = &cli.Command{
 			Name:   "list",
 			Usage:  "List known sources",
 			Action: SourceList,
-			Flags:  union([]cli.Flag{}, dbFlags, loggingFlags, hlogDefaultTrue),
+			Flags:  union([]cli.Flag{}, listFlags, dbFlags, loggingFlags, hlogDefaultTrue),
+		},
+		{
+			Name:   "discover",
+			Usage:  "List the datasources of a Grafana provider and optionally create a source for each one that has none",
+			Action: SourceDiscover,
+			Flags: union([]cli.Flag{
+				&cli.IntFlag{
+					Name:     "provider-id",
+					Required: true,
+					Usage:    "ID of a grafanacloud or grafana_proxy provider.",
+				},
+				&cli.StringFlag{
+					Name:  "type",
+					Usage: "Only include datasources of this type, such as prometheus.",
+				},
+				&cli.StringFlag{
+					Name:  "name-pattern",
+					Usage: "Only include datasources whose name matches this regular expression.",
+				},
+				&cli.StringFlag{
+					Name:  "name-prefix",
+					Usage: "Prefix added to the datasource name to form the name of each source created.",
+				},
+				&cli.BoolFlag{
+					Name:  "create",
+					Usage: "Create a source for each included datasource, skipping those that already have one.",
+				},
+			}, httpFlags, dbFlags, loggingFlags),
+		},
+		{
+			Name:   "show",
+			Usage:  "Show the details of a source, its provider, the number of queries using it and whether its provider's secrets resolve",
+			Action: SourceShow,
+			Flags: union([]cli.Flag{
+				&cli.IntFlag{
+					Name:     "id",
+					Required: true,
+					Usage:    "ID of source.",
+				},
+			}, dbFlags, loggingFlags),
 		},
 		{
 			Name:   "add",
@@ -38,7 +82,17 @@ var sourceCommand = &cli.Command{
 				&cli.StringFlag{
 					Name:     "dataset",
 					Required: false,
-					Usage:    "Optional dataset within the provider for source.",
+					Usage:    "Optional dataset within the provider for source. For Grafana this is the datasource UID, or a comma separated list of UIDs whose results are summed. For Elasticsearch this is the index, a comma separated list of indices, a wildcard or a dated pattern such as logs-{2006.01.02} that covers the daily indices of each window.",
+				},
+				&cli.StringFlag{
+					Name:     "datasource-type",
+					Required: false,
+					Usage:    "Optional type of the Grafana datasource identified by the dataset, such as prometheus or loki. Derived from the query type when not supplied.",
+				},
+				&cli.StringFlag{
+					Name:     "api-url",
+					Required: false,
+					Usage:    "Optional URL of the api used for the source, overriding the provider's URL while keeping its credentials.",
 				},
 			}, dbFlags, loggingFlags),
 		},
@@ -49,13 +103,23 @@ func SourceList(cc *cli.Context) error {
 	ctx := cc.Context
 	setupLogging()
 
+	orderLimit, err := listOrderLimit(cc, map[string]string{
+		"id":       "s.id",
+		"name":     "s.name",
+		"provider": "p.name",
+		"dataset":  "s.dataset",
+	}, "s.id")
+	if err != nil {
+		return err
+	}
+
 	db := NewDB(dbConnStr())
 	conn, err := db.NewConn(ctx)
 	if err != nil {
 		return fmt.Errorf("connect: %w", err)
 	}
 
-	rows, err := conn.Query(ctx, "select s.id, s.name, p.name, s.dataset from sources s join providers p on p.id=s.provider_id;")
+	rows, err := conn.Query(ctx, "select s.id, s.name, p.name, s.dataset from sources s join providers p on p.id=s.provider_id"+orderLimit)
 	if err != nil {
 		return fmt.Errorf("query: %w", err)
 	}
@@ -93,6 +157,8 @@ func SourceAdd(cc *cli.Context) error {
 	name := strings.TrimSpace(cc.String("name"))
 	providerID := cc.Int("provider-id")
 	dataset := strings.TrimSpace(cc.String("dataset"))
+	datasourceType := strings.TrimSpace(cc.String("datasource-type"))
+	apiURL := strings.TrimSpace(cc.String("api-url"))
 
 	if name == "" {
 		return fmt.Errorf("name must be supplied")
@@ -102,6 +168,14 @@ func SourceAdd(cc *cli.Context) error {
 		return fmt.Errorf("provider ID must be a positive integer")
 	}
 
+	var apiURLOverride *string
+	if apiURL != "" {
+		if _, err := url.Parse(apiURL); err != nil {
+			return fmt.Errorf("invalid api url: %w", err)
+		}
+		apiURLOverride = &apiURL
+	}
+
 	db := NewDB(dbConnStr())
 	conn, err := db.NewConn(ctx)
 	if err != nil {
@@ -114,7 +188,7 @@ func SourceAdd(cc *cli.Context) error {
 	}
 	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(ctx, "insert into sources(name,provider_id,dataset) values ($1,$2,$3)", name, providerID, dataset)
+	_, err = tx.Exec(ctx, "insert into sources(name,provider_id,dataset,datasource_type,api_url) values ($1,$2,$3,$4,$5)", name, providerID, dataset, datasourceType, apiURLOverride)
 	if err != nil {
 		return fmt.Errorf("exec (%T): %w", err, err)
 	}
@@ -126,3 +200,180 @@ func SourceAdd(cc *cli.Context) error {
 
 	return nil
 }
+
+func SourceShow(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	sourceID := cc.Int("id")
+	if sourceID < 0 {
+		return fmt.Errorf("ID must be a positive integer")
+	}
+
+	db := NewDB(dbConnStr())
+
+	src, err := GetSource(ctx, db, sourceID)
+	if err != nil {
+		return fmt.Errorf("get source: %w", err)
+	}
+
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	var providerName string
+	var apiURLOverride bool
+	if err := conn.QueryRow(ctx, "select p.name, s.api_url is not null from sources s join providers p on p.id=s.provider_id where s.id=$1", sourceID).Scan(&providerName, &apiURLOverride); err != nil {
+		return fmt.Errorf("get provider: %w", err)
+	}
+
+	var total, active int
+	if err := conn.QueryRow(ctx, "select count(*), count(*) filter (where (finish is null or finish > now()) and not archived) from queries where source_id=$1", sourceID).Scan(&total, &active); err != nil {
+		return fmt.Errorf("count queries: %w", err)
+	}
+
+	secrets := "ok"
+	if _, err := new(SecretStore).Secrets(src.ProviderID, src.AuthType); err != nil {
+		secrets = err.Error()
+	}
+
+	apiURL := src.ApiURL
+	if apiURLOverride {
+		apiURL += " (source override)"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
+	fmt.Fprintf(w, "ID\t| %d\n", src.ID)
+	fmt.Fprintf(w, "Name\t| %s\n", src.Name)
+	fmt.Fprintf(w, "Dataset\t| %s\n", src.Dataset)
+	fmt.Fprintf(w, "Datasource Type\t| %s\n", src.DatasourceType)
+	fmt.Fprintf(w, "Provider ID\t| %d\n", src.ProviderID)
+	fmt.Fprintf(w, "Provider Name\t| %s\n", providerName)
+	fmt.Fprintf(w, "API Type\t| %s\n", src.ApiType)
+	fmt.Fprintf(w, "API URL\t| %s\n", apiURL)
+	fmt.Fprintf(w, "Auth Type\t| %s\n", src.AuthType)
+	fmt.Fprintf(w, "Queries\t| %d (%d active)\n", total, active)
+	fmt.Fprintf(w, "Secrets\t| %s\n", secrets)
+	return w.Flush()
+}
+
+func SourceDiscover(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	providerID := cc.Int("provider-id")
+	if providerID < 0 {
+		return fmt.Errorf("provider ID must be a positive integer")
+	}
+	dsType := strings.TrimSpace(cc.String("type"))
+	namePrefix := cc.String("name-prefix")
+
+	var nameRe *regexp.Regexp
+	if pattern := strings.TrimSpace(cc.String("name-pattern")); pattern != "" {
+		var err error
+		nameRe, err = regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid name pattern: %w", err)
+		}
+	}
+
+	db := NewDB(dbConnStr())
+	conn, err := db.NewConn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Release()
+
+	var (
+		apiType            ApiType
+		apiURL             string
+		authType           AuthType
+		requestTimeoutSecs *int
+		maxRetries         *int
+		extraHeaders       map[string]string
+	)
+	err = conn.QueryRow(ctx, "select api_type, api_url, auth_type, request_timeout_secs, max_retries, extra_headers from providers where id=$1", providerID).
+		Scan(&apiType, &apiURL, &authType, &requestTimeoutSecs, &maxRetries, &extraHeaders)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("provider %d not found", providerID)
+		}
+		return fmt.Errorf("get provider: %w", err)
+	}
+	if apiType != ApiTypeGrafanaCloud && apiType != ApiTypeGrafanaProxy {
+		return fmt.Errorf("datasources can only be discovered for grafanacloud and grafana_proxy providers, not %s", apiType)
+	}
+
+	secrets, err := new(SecretStore).Secrets(providerID, authType)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets for provider: %w", err)
+	}
+	hopts, err := ProviderHTTPOptions(requestTimeoutSecs, maxRetries, extraHeaders)
+	if err != nil {
+		return err
+	}
+
+	dss, err := ListGrafanaDatasources(ctx, apiURL, HTTPAuth{AuthType: authType, Secrets: secrets}, hopts)
+	if err != nil {
+		return fmt.Errorf("list datasources: %w", err)
+	}
+
+	rows, err := conn.Query(ctx, "select dataset from sources where provider_id=$1 and dataset is not null", providerID)
+	if err != nil {
+		return fmt.Errorf("query sources: %w", err)
+	}
+	datasets, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("collect: %w", err)
+	}
+	existing := make(map[string]bool, len(datasets))
+	for _, d := range datasets {
+		existing[d] = true
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 4, ' ', 0)
+	fmt.Fprintln(w, "Dataset\t| Name\t| Type\t| Status")
+	created := 0
+	for _, ds := range dss {
+		if dsType != "" && ds.Type != dsType {
+			continue
+		}
+		if nameRe != nil && !nameRe.MatchString(ds.Name) {
+			continue
+		}
+
+		// the datasource proxy identifies datasources by their numeric id
+		dataset := ds.UID
+		if apiType == ApiTypeGrafanaProxy {
+			dataset = strconv.Itoa(ds.ID)
+		}
+
+		status := "new"
+		switch {
+		case existing[dataset]:
+			status = "exists"
+		case cc.Bool("create"):
+			tag, err := conn.Exec(ctx, "insert into sources(name,provider_id,dataset,datasource_type) values ($1,$2,$3,$4) on conflict (provider_id, dataset) do nothing", namePrefix+ds.Name, providerID, dataset, ds.Type)
+			if err != nil {
+				return fmt.Errorf("insert source for datasource %q: %w", ds.Name, err)
+			}
+			if tag.RowsAffected() == 0 {
+				status = "exists"
+			} else {
+				status = "created"
+				created++
+			}
+		}
+		fmt.Fprintf(w, "%s\t| %s\t| %s\t| %s\n", dataset, ds.Name, ds.Type, status)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if cc.Bool("create") {
+		printStatus("Created %d sources", created)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/exp/slog"
+)
+
+var sshFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:        "ssh-host",
+		Usage:       "Connect to the database through an SSH tunnel via the bastion at `HOST[:PORT]`. The database host is resolved by the bastion.",
+		EnvVars:     []string{envPrefix + "SSH_HOST"},
+		Destination: &sshOpts.host,
+	},
+	&cli.StringFlag{
+		Name:        "ssh-user",
+		Usage:       "The user to use when connecting to the SSH bastion",
+		EnvVars:     []string{envPrefix + "SSH_USER"},
+		Destination: &sshOpts.user,
+	},
+	&cli.StringFlag{
+		Name:        "ssh-key",
+		Usage:       "Path to the private key `FILE` to use when connecting to the SSH bastion",
+		EnvVars:     []string{envPrefix + "SSH_KEY"},
+		Destination: &sshOpts.keyFile,
+	},
+	&cli.StringFlag{
+		Name:        "ssh-known-hosts",
+		Usage:       "Path to the known hosts `FILE` used to verify the SSH bastion, defaults to ~/.ssh/known_hosts",
+		EnvVars:     []string{envPrefix + "SSH_KNOWN_HOSTS"},
+		Destination: &sshOpts.knownHostsFile,
+	},
+}
+
+var sshOpts struct {
+	host           string
+	user           string
+	keyFile        string
+	knownHostsFile string
+}
+
+// An SSHTunnel dials connections through an SSH client connected to a bastion host. The client is connected
+// when first needed and reconnected if the connection to the bastion is lost.
+type SSHTunnel struct {
+	addr   string
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// NewSSHTunnelFromOpts returns a tunnel configured by the ssh flags, or nil if no ssh host was supplied.
+func NewSSHTunnelFromOpts() (*SSHTunnel, error) {
+	if sshOpts.host == "" {
+		return nil, nil
+	}
+	if sshOpts.user == "" {
+		return nil, fmt.Errorf("ssh-user must be supplied when using an ssh tunnel")
+	}
+	if sshOpts.keyFile == "" {
+		return nil, fmt.Errorf("ssh-key must be supplied when using an ssh tunnel")
+	}
+
+	key, err := os.ReadFile(sshOpts.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ssh key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("parse ssh key: %w", err)
+	}
+
+	knownHostsFile := sshOpts.knownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("find home directory: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ssh known hosts: %w", err)
+	}
+
+	addr := sshOpts.host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	return &SSHTunnel{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            sshOpts.user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+		},
+	}, nil
+}
+
+// DialContext opens a connection to addr from the bastion host.
+func (t *SSHTunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := t.sshClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.Dial(network, addr)
+	if err == nil {
+		return conn, nil
+	}
+
+	// the connection to the bastion may have been lost, so reconnect and try once more
+	slog.Debug("ssh tunnel dial failed, reconnecting", "addr", addr, "error", err)
+	t.reset(client)
+	client, err = t.sshClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err = client.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s through ssh tunnel: %w", addr, err)
+	}
+	return conn, nil
+}
+
+func (t *SSHTunnel) sshClient(ctx context.Context) (*ssh.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.client != nil {
+		return t.client, nil
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial ssh host: %w", err)
+	}
+
+	sconn, chans, reqs, err := ssh.NewClientConn(conn, t.addr, t.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ssh handshake: %w", err)
+	}
+
+	slog.Debug("connected to ssh host", "addr", t.addr)
+	t.client = ssh.NewClient(sconn, chans, reqs)
+	return t.client, nil
+}
+
+// reset discards the client if it is still the current one.
+func (t *SSHTunnel) reset(client *ssh.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.client == client {
+		t.client.Close()
+		t.client = nil
+	}
+}